@@ -0,0 +1,151 @@
+package history
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// field extracts a value from a record, or from each new archive of a record, returning false when it is unknown
+type field struct {
+	value   func(record Record) (float64, bool)
+	archive func(archive Archive) (float64, bool)
+}
+
+// fields are the values of the records which can be aggregated, by name
+var fields = map[string]field{
+	"total_chunks":                 {value: func(r Record) (float64, bool) { return float64(r.TotalChunks), true }},
+	"total_compressed_size":        {value: func(r Record) (float64, bool) { return float64(r.TotalCompressedSize), true }},
+	"total_size":                   {value: func(r Record) (float64, bool) { return float64(r.TotalSize), true }},
+	"total_unique_chunks":          {value: func(r Record) (float64, bool) { return float64(r.TotalUniqueChunks), true }},
+	"deduplicated_compressed_size": {value: func(r Record) (float64, bool) { return float64(r.DeduplicatedCompressedSize), true }},
+	"deduplicated_size":            {value: func(r Record) (float64, bool) { return float64(r.DeduplicatedSize), true }},
+	"archives": {value: func(r Record) (float64, bool) {
+		if r.Archives == nil {
+			return 0, false
+		}
+		return float64(*r.Archives), true
+	}},
+	"archive_original_size":     {archive: archiveStat(func(s *ArchiveStats) float64 { return float64(s.OriginalSize) })},
+	"archive_compressed_size":   {archive: archiveStat(func(s *ArchiveStats) float64 { return float64(s.CompressedSize) })},
+	"archive_deduplicated_size": {archive: archiveStat(func(s *ArchiveStats) float64 { return float64(s.DeduplicatedSize) })},
+	"archive_files":             {archive: archiveStat(func(s *ArchiveStats) float64 { return float64(s.Files) })},
+	"archive_duration":          {archive: func(a Archive) (float64, bool) { return a.Duration, a.Duration > 0 }},
+}
+
+// archiveStat returns the extractor of a statistic of an archive, which is unknown when it has no statistics
+func archiveStat(value func(stats *ArchiveStats) float64) func(Archive) (float64, bool) {
+	return func(a Archive) (float64, bool) {
+		if a.Stats == nil {
+			return 0, false
+		}
+		return value(a.Stats), true
+	}
+}
+
+// Fields returns the names of the fields which can be aggregated, sorted
+func Fields() []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Bucket aggregates the values of a field over a period
+type Bucket struct {
+	// Start is the start of the period
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Last  float64   `json:"last"`
+}
+
+// Series aggregates the values of a field of a repository
+type Series struct {
+	Repository string   `json:"repository"`
+	Field      string   `json:"field"`
+	Buckets    []Bucket `json:"buckets"`
+	// Growth is the difference between the last and the first value
+	Growth float64 `json:"growth"`
+	// GrowthPerDay is the growth divided by the number of days between the first and the last value
+	GrowthPerDay float64 `json:"growth_per_day"`
+}
+
+// Aggregate aggregates a field of the records by repository, in buckets of the given step aligned on the step.
+// With a step of 0, the records of a repository are aggregated in a single bucket, starting at the first record.
+// The statistics of the archives are aggregated at their start time, each archive being recorded once by the store.
+func Aggregate(records []Record, name string, step time.Duration) ([]Series, error) {
+	f, ok := fields[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", name)
+	}
+	if step < 0 {
+		return nil, fmt.Errorf("negative step %s", step)
+	}
+
+	type point struct {
+		timestamp time.Time
+		value     float64
+	}
+	points := map[string][]point{}
+	for _, record := range records {
+		if f.archive != nil {
+			for _, archive := range record.NewArchives {
+				if value, ok := f.archive(archive); ok {
+					points[record.Repository] = append(points[record.Repository], point{timestamp: archive.Start, value: value})
+				}
+			}
+			continue
+		}
+		if value, ok := f.value(record); ok {
+			points[record.Repository] = append(points[record.Repository], point{timestamp: record.Timestamp, value: value})
+		}
+	}
+
+	repositories := make([]string, 0, len(points))
+	for repository := range points {
+		repositories = append(repositories, repository)
+		// The archives recorded once the archives are listed can be older than the archives recorded before
+		sort.SliceStable(points[repository], func(i, j int) bool {
+			return points[repository][i].timestamp.Before(points[repository][j].timestamp)
+		})
+	}
+	sort.Strings(repositories)
+
+	series := make([]Series, 0, len(repositories))
+	for _, repository := range repositories {
+		s := Series{Repository: repository, Field: name}
+		var bucket *Bucket
+		for _, p := range points[repository] {
+			start := points[repository][0].timestamp
+			if step > 0 {
+				start = p.timestamp.Truncate(step)
+			}
+			if bucket == nil || !bucket.Start.Equal(start) {
+				s.Buckets = append(s.Buckets, Bucket{Start: start, Min: p.value, Max: p.value})
+				bucket = &s.Buckets[len(s.Buckets)-1]
+			}
+			bucket.Count++
+			bucket.Min = min(bucket.Min, p.value)
+			bucket.Max = max(bucket.Max, p.value)
+			// The sum is kept in Avg until the end of the bucket
+			bucket.Avg += p.value
+			bucket.Last = p.value
+		}
+		for i := range s.Buckets {
+			s.Buckets[i].Avg /= float64(s.Buckets[i].Count)
+		}
+
+		first, last := points[repository][0], points[repository][len(points[repository])-1]
+		s.Growth = last.value - first.value
+		if days := last.timestamp.Sub(first.timestamp).Hours() / 24; days > 0 {
+			s.GrowthPerDay = s.Growth / days
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
@@ -0,0 +1,102 @@
+package history
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	day := time.Date(2024, 10, 29, 0, 0, 0, 0, time.UTC)
+	records := []Record{
+		{Timestamp: day.Add(2 * time.Hour), Repository: "laptop", DeduplicatedCompressedSize: 100, NewArchives: []Archive{
+			{ID: "b", Start: day.Add(time.Hour), Duration: 60, Stats: &ArchiveStats{Files: 20}},
+		}},
+		{Timestamp: day.Add(2 * time.Hour), Repository: "server", DeduplicatedCompressedSize: 1000},
+		{Timestamp: day.Add(14 * time.Hour), Repository: "laptop", DeduplicatedCompressedSize: 140},
+		// Once the archives are listed, the older archives are recorded without their statistics
+		{Timestamp: day.Add(26 * time.Hour), Repository: "laptop", DeduplicatedCompressedSize: 150, NewArchives: []Archive{
+			{ID: "a", Start: day, Duration: 30},
+			{ID: "c", Start: day.Add(25 * time.Hour), Duration: 90, Stats: &ArchiveStats{Files: 10}},
+		}},
+		{Timestamp: day.Add(50 * time.Hour), Repository: "laptop", DeduplicatedCompressedSize: 200, NewArchives: []Archive{
+			{ID: "d", Start: day.Add(49 * time.Hour), Duration: 120, Stats: &ArchiveStats{Files: 30}},
+		}},
+	}
+
+	tests := []struct {
+		name    string
+		field   string
+		step    time.Duration
+		want    []Series
+		wantErr bool
+	}{
+		{
+			name:  "daily",
+			field: "deduplicated_compressed_size",
+			step:  24 * time.Hour,
+			want: []Series{
+				{
+					Repository: "laptop",
+					Field:      "deduplicated_compressed_size",
+					Buckets: []Bucket{
+						{Start: day, Count: 2, Min: 100, Max: 140, Avg: 120, Last: 140},
+						{Start: day.AddDate(0, 0, 1), Count: 1, Min: 150, Max: 150, Avg: 150, Last: 150},
+						{Start: day.AddDate(0, 0, 2), Count: 1, Min: 200, Max: 200, Avg: 200, Last: 200},
+					},
+					Growth:       100,
+					GrowthPerDay: 50,
+				},
+				{
+					Repository: "server",
+					Field:      "deduplicated_compressed_size",
+					Buckets:    []Bucket{{Start: day, Count: 1, Min: 1000, Max: 1000, Avg: 1000, Last: 1000}},
+				},
+			},
+		},
+		{
+			name:  "archives statistics in a single bucket",
+			field: "archive_files",
+			want: []Series{
+				{
+					Repository:   "laptop",
+					Field:        "archive_files",
+					Buckets:      []Bucket{{Start: day.Add(time.Hour), Count: 3, Min: 10, Max: 30, Avg: 20, Last: 30}},
+					Growth:       10,
+					GrowthPerDay: 5,
+				},
+			},
+		},
+		{
+			name:  "archives in chronological order",
+			field: "archive_duration",
+			step:  24 * time.Hour,
+			want: []Series{
+				{
+					Repository: "laptop",
+					Field:      "archive_duration",
+					Buckets: []Bucket{
+						{Start: day, Count: 2, Min: 30, Max: 60, Avg: 45, Last: 60},
+						{Start: day.AddDate(0, 0, 1), Count: 1, Min: 90, Max: 90, Avg: 90, Last: 90},
+						{Start: day.AddDate(0, 0, 2), Count: 1, Min: 120, Max: 120, Avg: 120, Last: 120},
+					},
+					Growth:       90,
+					GrowthPerDay: 90.0 / (49.0 / 24),
+				},
+			},
+		},
+		{name: "unknown field", field: "unknown", wantErr: true},
+		{name: "negative step", field: "total_size", step: -time.Hour, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Aggregate(records, tt.field, tt.step)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+// Package history stores the statistics of every collection in an append-only file,
+// to follow the growth of the repositories over a longer period than the retention of Prometheus.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxRecordSize is the maximum size of a line of the history file
+const maxRecordSize = 1024 * 1024
+
+// Record holds the statistics of a repository and of its new archives at the time of a collection
+type Record struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Repository string    `json:"repository"`
+
+	// Repository statistics, from the cache stats of borg info
+	TotalChunks                int64 `json:"total_chunks"`
+	TotalCompressedSize        int64 `json:"total_compressed_size"`
+	TotalSize                  int64 `json:"total_size"`
+	TotalUniqueChunks          int64 `json:"total_unique_chunks"`
+	DeduplicatedCompressedSize int64 `json:"deduplicated_compressed_size"`
+	DeduplicatedSize           int64 `json:"deduplicated_size"`
+	// Archives is the number of archives, only set when the archives are listed
+	Archives *int `json:"archives,omitempty"`
+
+	// NewArchives holds the archives which were not recorded by a previous collection, from the oldest to the newest.
+	// Without the archives listing, only the last archive of the repository is known by a collection.
+	NewArchives []Archive `json:"new_archives,omitempty"`
+}
+
+// Archive holds the statistics of an archive
+type Archive struct {
+	Name     string    `json:"name"`
+	ID       string    `json:"id"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"`
+	// Stats is nil when the archive was not the last archive of the repository at the time of the collection,
+	// as borg info only reports the statistics of the last archive
+	Stats *ArchiveStats `json:"stats,omitempty"`
+}
+
+// ArchiveStats holds the sizes and the number of files of an archive
+type ArchiveStats struct {
+	OriginalSize     int64 `json:"original_size"`
+	CompressedSize   int64 `json:"compressed_size"`
+	DeduplicatedSize int64 `json:"deduplicated_size"`
+	Files            int64 `json:"files"`
+}
+
+// NewRecord returns the record of a collection of a repository, with all its archives as new archives.
+// The list is optional, it is nil when the archives are not collected.
+// The archives already recorded are removed by Store.Append.
+func NewRecord(timestamp time.Time, repository string, info *parser.InfoOutput, list *parser.ListOutput) Record {
+	stats := info.Cache.Stats
+	record := Record{
+		Timestamp:                  timestamp,
+		Repository:                 repository,
+		TotalChunks:                stats.TotalChunks,
+		TotalCompressedSize:        stats.TotalCompressedSize,
+		TotalSize:                  stats.TotalSize,
+		TotalUniqueChunks:          stats.TotalUniqueChunks,
+		DeduplicatedCompressedSize: stats.DeduplicatedCompressedSize,
+		DeduplicatedSize:           stats.DeduplicatedSize,
+	}
+	archiveStats := map[string]*ArchiveStats{}
+	for _, archive := range info.Archives {
+		archiveStats[archive.ID] = &ArchiveStats{
+			OriginalSize:     archive.Stats.OriginalSize,
+			CompressedSize:   archive.Stats.CompressedSize,
+			DeduplicatedSize: archive.Stats.DeduplicatedSize,
+			Files:            archive.Stats.NFiles,
+		}
+	}
+	if list != nil {
+		archives := len(list.Archives)
+		record.Archives = &archives
+		for _, archive := range list.Archives {
+			record.NewArchives = append(record.NewArchives, Archive{
+				Name:     archive.Name,
+				ID:       archive.ID,
+				Start:    archive.Start.Time,
+				Duration: archive.Duration(),
+				Stats:    archiveStats[archive.ID],
+			})
+		}
+		return record
+	}
+	for _, archive := range info.Archives {
+		record.NewArchives = append(record.NewArchives, Archive{
+			Name:     archive.Name,
+			ID:       archive.ID,
+			Start:    archive.Start.Time,
+			Duration: archive.Duration,
+			Stats:    archiveStats[archive.ID],
+		})
+	}
+	return record
+}
+
+// Query selects the records of a time range, From and To being inclusive.
+// Zero values don't filter.
+type Query struct {
+	Repository string
+	From       time.Time
+	To         time.Time
+}
+
+// matches returns true when the record is selected by the query
+func (q Query) matches(record Record) bool {
+	if q.Repository != "" && record.Repository != q.Repository {
+		return false
+	}
+	if !q.From.IsZero() && record.Timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && record.Timestamp.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// Store is an append-only history file, holding a JSON record per line.
+// The records are also kept in memory, so that the queries don't read the file.
+type Store struct {
+	sync.RWMutex
+	file *os.File
+	// records are only appended, so that a query can filter them without holding the lock
+	records []Record
+	// archives holds the IDs of the recorded archives by repository
+	archives map[string]map[string]bool
+}
+
+// Open opens the history file, creating it if needed, and loads its records
+func Open(path string) (*Store, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the history file: %w", err)
+	}
+	records, err := readRecords(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// A record partially written before a crash is terminated, so that it is not merged with the next record
+	complete, err := terminated(file)
+	if err == nil && !complete {
+		_, err = file.Write([]byte{'\n'})
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot write the history file: %w", err)
+	}
+	store := &Store{file: file, archives: map[string]map[string]bool{}}
+	for _, record := range records {
+		store.add(record)
+	}
+	return store, nil
+}
+
+// Close closes the history file
+func (s *Store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.file.Close()
+}
+
+// Append writes a record at the end of the history file.
+// The archives of the record which were already recorded for the repository are removed.
+func (s *Store) Append(record Record) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var archives []Archive
+	for _, archive := range record.NewArchives {
+		if !s.archives[record.Repository][archive.ID] {
+			archives = append(archives, archive)
+		}
+	}
+	record.NewArchives = archives
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot encode the history record: %w", err)
+	}
+	// The record is written at once, so that a record is never interleaved with another one
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("cannot write the history file: %w", err)
+	}
+	s.add(record)
+	return nil
+}
+
+// add adds a record to the records in memory. The caller must hold the write lock.
+func (s *Store) add(record Record) {
+	s.records = append(s.records, record)
+	for _, archive := range record.NewArchives {
+		if s.archives[record.Repository] == nil {
+			s.archives[record.Repository] = map[string]bool{}
+		}
+		s.archives[record.Repository][archive.ID] = true
+	}
+}
+
+// Query returns the records selected by the query, in the order they were appended
+func (s *Store) Query(query Query) []Record {
+	// The records are never modified once appended, so the slice can be read once the lock is released
+	s.RLock()
+	records := s.records
+	s.RUnlock()
+
+	selected := []Record{}
+	for _, record := range records {
+		if query.matches(record) {
+			selected = append(selected, record)
+		}
+	}
+	return selected
+}
+
+// readRecords decodes the records of a history file.
+// Lines which cannot be decoded, such as a record partially written before a crash, are skipped.
+func readRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read the history file: %w", err)
+	}
+	return records, nil
+}
+
+// terminated returns true when the file is empty or ends with a newline
+func terminated(file *os.File) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return true, nil
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return false, err
+	}
+	return last[0] == '\n', nil
+}
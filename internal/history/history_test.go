@@ -0,0 +1,140 @@
+package history
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewRecord(t *testing.T) {
+	now := time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC)
+	start := time.Date(2024, 10, 29, 2, 0, 0, 0, time.UTC)
+	info := &parser.InfoOutput{
+		Archives: []parser.InfoOutputArchive{{
+			Name:     "laptop-2024-10-29",
+			ID:       "abc",
+			Start:    parser.BorgTime{Time: start},
+			Duration: 120,
+			Stats:    parser.InfoOutputArchiveStats{OriginalSize: 1000, CompressedSize: 500, DeduplicatedSize: 50, NFiles: 42},
+		}},
+		Cache: parser.InfoOutputCache{Stats: parser.InfoOutputCacheStats{
+			TotalChunks: 10, TotalCompressedSize: 5000, TotalSize: 10000, TotalUniqueChunks: 5,
+			DeduplicatedCompressedSize: 800, DeduplicatedSize: 1600,
+		}},
+	}
+	list := &parser.ListOutput{Archives: []parser.ListOutputArchive{
+		{Name: "laptop-2024-10-28", ID: "def", Start: parser.BorgTime{Time: start.AddDate(0, 0, -1)}, End: parser.BorgTime{Time: start.AddDate(0, 0, -1).Add(time.Minute)}},
+		{Name: "laptop-2024-10-29", ID: "abc", Start: parser.BorgTime{Time: start}, End: parser.BorgTime{Time: start.Add(2 * time.Minute)}},
+	}}
+	stats := &ArchiveStats{OriginalSize: 1000, CompressedSize: 500, DeduplicatedSize: 50, Files: 42}
+
+	archives := 2
+	want := Record{
+		Timestamp: now, Repository: "laptop",
+		TotalChunks: 10, TotalCompressedSize: 5000, TotalSize: 10000, TotalUniqueChunks: 5,
+		DeduplicatedCompressedSize: 800, DeduplicatedSize: 1600,
+		Archives: &archives,
+		NewArchives: []Archive{
+			{Name: "laptop-2024-10-28", ID: "def", Start: start.AddDate(0, 0, -1), Duration: 60},
+			{Name: "laptop-2024-10-29", ID: "abc", Start: start, Duration: 120, Stats: stats},
+		},
+	}
+	if got := NewRecord(now, "laptop", info, list); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	// Without listing, only the last archive is known
+	want.Archives = nil
+	want.NewArchives = want.NewArchives[1:]
+	if got := NewRecord(now, "laptop", info, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	// Without archives nor listing
+	got := NewRecord(now, "laptop", &parser.InfoOutput{}, nil)
+	if got.NewArchives != nil || got.Archives != nil {
+		t.Errorf("Expected no archive statistics, got %+v", got)
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	now := time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC)
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []Record{
+		{Timestamp: now.AddDate(0, 0, -2), Repository: "laptop", TotalSize: 1, NewArchives: []Archive{{ID: "a"}}},
+		{Timestamp: now.AddDate(0, 0, -2), Repository: "server", TotalSize: 2, NewArchives: []Archive{{ID: "a"}}},
+		{Timestamp: now.AddDate(0, 0, -1), Repository: "laptop", TotalSize: 3, NewArchives: []Archive{{ID: "a"}, {ID: "b"}}},
+	}
+	for _, record := range records[:2] {
+		if err := store.Append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record partially written before a crash is skipped, and the store is reopened in append mode
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"timestamp":"2024-10`)
+	file.Close()
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Append(records[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query Query
+		want  []Record
+	}{
+		{name: "repository", query: Query{Repository: "laptop"}, want: []Record{records[0], records[2]}},
+		{name: "from", query: Query{From: now.AddDate(0, 0, -1)}, want: []Record{records[2]}},
+		{name: "to", query: Query{To: now.AddDate(0, 0, -2)}, want: []Record{records[0], records[1]}},
+		{name: "empty range", query: Query{From: now}, want: []Record{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := store.Query(tt.query)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected %d records, got %+v", len(tt.want), got)
+			}
+			for i := range got {
+				if !got[i].Timestamp.Equal(tt.want[i].Timestamp) || got[i].Repository != tt.want[i].Repository || got[i].TotalSize != tt.want[i].TotalSize {
+					t.Errorf("Expected %+v, got %+v", tt.want[i], got[i])
+				}
+			}
+		})
+	}
+
+	// The archives recorded before the restart are not recorded again
+	got := store.Query(Query{From: now.AddDate(0, 0, -1)})
+	if len(got) != 1 || len(got[0].NewArchives) != 1 || got[0].NewArchives[0].ID != "b" {
+		t.Errorf("Expected only the new archive b, got %+v", got)
+	}
+
+	// The partial record was terminated, so that the next record is kept
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := reopened.Query(Query{}); len(got) != 3 {
+		t.Errorf("Expected 3 records, got %+v", got)
+	}
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"time"
+)
+
+// backupProgressTimeout is the duration after which a backup whose progress is not reported anymore
+// is not considered in progress, for instance when the wrap command was killed
+const backupProgressTimeout = 5 * time.Minute
+
+// BackupSnapshot holds the progress of the backups run by the wrap command, and the result of the last one
+type BackupSnapshot struct {
+	// Running is true from the first progress report of a backup until its result is reported
+	Running bool
+	Start   time.Time
+	// Updated is the time of the last progress report
+	Updated          time.Time
+	OriginalSize     float64
+	CompressedSize   float64
+	DeduplicatedSize float64
+	Files            float64
+
+	// LastEnd is the end of the last backup whose result was reported, zero when there is none
+	LastEnd time.Time
+	// LastExitCode is the exit code of the last borg create, 1 or between 100 and 127 for warnings
+	LastExitCode int
+	// LastWarnings is the number of warnings logged by the last borg create
+	LastWarnings int
+}
+
+// InProgress returns true when a backup is running and its progress was reported recently
+func (b *BackupSnapshot) InProgress(now time.Time) bool {
+	return b.Running && now.Sub(b.Updated) < backupProgressTimeout
+}
+
+// AddArchive updates the snapshot with the output of borg create, so that the last backup metrics reflect
+// the created archive without waiting for the next collection.
+// Borg 2 doesn't report the cache statistics when creating an archive, in which case the ones of the last collection are kept.
+// The caller must hold the write lock.
+func (s *RepositorySnapshot) AddArchive(created *parser.InfoOutput) {
+	info := *created
+	if s.Info != nil && created.Cache.Stats == (parser.InfoOutputCacheStats{}) {
+		info.Cache = s.Info.Cache
+	}
+	s.Info = &info
+
+	if s.List != nil && len(created.Archives) > 0 {
+		archive := created.Archives[0]
+		list := *s.List
+		list.Archives = append(append([]parser.ListOutputArchive{}, s.List.Archives...), parser.ListOutputArchive{
+			Archive:  archive.Name,
+			End:      archive.End,
+			Hostname: archive.Hostname,
+			ID:       archive.ID,
+			Name:     archive.Name,
+			Start:    archive.Start,
+			Time:     archive.Start,
+			Username: archive.Username,
+		})
+		s.List = &list
+	}
+}
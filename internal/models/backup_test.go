@@ -0,0 +1,139 @@
+package models
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepositorySnapshot_AddArchive(t *testing.T) {
+	previous := &parser.InfoOutput{
+		Archives: []parser.InfoOutputArchive{{Name: "laptop-1"}},
+		Cache:    parser.InfoOutputCache{Stats: parser.InfoOutputCacheStats{TotalChunks: 100, DeduplicatedSize: 4096}},
+	}
+	archive := parser.InfoOutputArchive{
+		Name:  "laptop-2",
+		ID:    "5d2c",
+		Start: mustParseBorgTime(t, "2024-10-29T02:00:00.000000"),
+		End:   mustParseBorgTime(t, "2024-10-29T02:05:12.000000"),
+	}
+
+	tests := []struct {
+		name      string
+		info      *parser.InfoOutput
+		list      *parser.ListOutput
+		created   parser.InfoOutput
+		wantCache parser.InfoOutputCacheStats
+		wantList  []string
+	}{
+		{
+			name:      "cache statistics of borg 1.x",
+			info:      previous,
+			created:   parser.InfoOutput{Archives: []parser.InfoOutputArchive{archive}, Cache: parser.InfoOutputCache{Stats: parser.InfoOutputCacheStats{TotalChunks: 120}}},
+			wantCache: parser.InfoOutputCacheStats{TotalChunks: 120},
+		},
+		{
+			name:      "cache statistics kept for borg 2.x",
+			info:      previous,
+			created:   parser.InfoOutput{Archives: []parser.InfoOutputArchive{archive}},
+			wantCache: previous.Cache.Stats,
+		},
+		{
+			name:    "never collected",
+			created: parser.InfoOutput{Archives: []parser.InfoOutputArchive{archive}},
+		},
+		{
+			name:      "archives listed",
+			info:      previous,
+			list:      &parser.ListOutput{Archives: []parser.ListOutputArchive{{Name: "laptop-1"}}},
+			created:   parser.InfoOutput{Archives: []parser.InfoOutputArchive{archive}},
+			wantCache: previous.Cache.Stats,
+			wantList:  []string{"laptop-1", "laptop-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := &RepositorySnapshot{Info: tt.info, List: tt.list}
+			snapshot.AddArchive(&tt.created)
+
+			if len(snapshot.Info.Archives) != 1 || snapshot.Info.Archives[0].Name != "laptop-2" {
+				t.Errorf("Expected the created archive as last archive, got %+v", snapshot.Info.Archives)
+			}
+			if tt.info != nil && snapshot.Info.Cache.Stats != tt.wantCache {
+				t.Errorf("Expected cache statistics %+v, got %+v", tt.wantCache, snapshot.Info.Cache.Stats)
+			}
+			if tt.list == nil {
+				if snapshot.List != nil {
+					t.Errorf("Expected no archives listing, got %+v", snapshot.List)
+				}
+				return
+			}
+			var names []string
+			for _, listed := range snapshot.List.Archives {
+				names = append(names, listed.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantList, ",") {
+				t.Errorf("Expected archives %v, got %v", tt.wantList, names)
+			}
+			if len(tt.list.Archives) != 1 {
+				t.Errorf("The previous listing was modified: %+v", tt.list.Archives)
+			}
+		})
+	}
+}
+
+func TestMetricsCache_CollectBackup(t *testing.T) {
+	cache := newTestCache()
+	now := time.Date(2024, 10, 29, 2, 10, 0, 0, time.UTC)
+	cache.Metrics.Now = func() time.Time { return now }
+
+	// In progress, with the result of the previous backup
+	cache.Repository("laptop", map[string]string{"team": "infra"}).Backup = &BackupSnapshot{
+		Running:          true,
+		Start:            now.Add(-90 * time.Second),
+		Updated:          now.Add(-10 * time.Second),
+		OriginalSize:     1048576,
+		CompressedSize:   524288,
+		DeduplicatedSize: 4096,
+		Files:            12,
+		LastEnd:          now.Add(-24 * time.Hour),
+		LastExitCode:     1,
+		LastWarnings:     3,
+	}
+	// Not reported anymore, for instance when the wrap command was killed
+	cache.Repository("server", nil).Backup = &BackupSnapshot{
+		Running: true,
+		Start:   now.Add(-time.Hour),
+		Updated: now.Add(-10 * time.Minute),
+	}
+
+	expected := `
+# HELP borg_backup_in_progress 1 if a backup run by the wrap command is in progress, 0 otherwise
+# TYPE borg_backup_in_progress gauge
+borg_backup_in_progress{repository="laptop",team="infra"} 1
+borg_backup_in_progress{repository="server",team=""} 0
+# HELP borg_backup_progress_elapsed_seconds Time elapsed since the start of the backup in progress in seconds
+# TYPE borg_backup_progress_elapsed_seconds gauge
+borg_backup_progress_elapsed_seconds{repository="laptop",team="infra"} 90
+# HELP borg_backup_progress_files Number of files processed by the backup in progress
+# TYPE borg_backup_progress_files gauge
+borg_backup_progress_files{repository="laptop",team="infra"} 12
+# HELP borg_backup_progress_original_size_bytes Original size of the data processed by the backup in progress in bytes
+# TYPE borg_backup_progress_original_size_bytes gauge
+borg_backup_progress_original_size_bytes{repository="laptop",team="infra"} 1.048576e+06
+# HELP borg_last_backup_exit_code Exit code of the last borg create run by the wrap command
+# TYPE borg_last_backup_exit_code gauge
+borg_last_backup_exit_code{repository="laptop",team="infra"} 1
+# HELP borg_last_backup_warnings Number of warnings logged by the last borg create run by the wrap command
+# TYPE borg_last_backup_warnings gauge
+borg_last_backup_warnings{repository="laptop",team="infra"} 3
+`
+	err := testutil.CollectAndCompare(cache, strings.NewReader(expected),
+		"borg_backup_in_progress", "borg_backup_progress_elapsed_seconds", "borg_backup_progress_files",
+		"borg_backup_progress_original_size_bytes", "borg_last_backup_exit_code", "borg_last_backup_warnings")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -1,14 +1,219 @@
 package models
 
 import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
 	"sync"
 	"time"
 )
 
+// MetricsCache holds the last collected data of every repository.
+// It implements prometheus.Collector: the metrics are rendered from the snapshots at scrape time, under a read lock.
 type MetricsCache struct {
 	sync.RWMutex
-	LastUpdate time.Time
-	Collecting bool
-	Metrics    *BorgMetrics
-	Timeout    time.Duration
+	LastUpdate   time.Time
+	Collecting   bool
+	Metrics      *BorgMetrics
+	Timeout      time.Duration
+	Repositories map[string]*RepositorySnapshot
+	// LogRecordsLimit is the number of borg log records kept for each repository, see AddLogRecords
+	LogRecordsLimit int
+	// ForecastWindow is the duration of the size history used to forecast when the repositories are full,
+	// 0 to disable the forecast, see AddSizeSample
+	ForecastWindow time.Duration
+}
+
+// RepositorySnapshot holds the last collected data of a repository
+type RepositorySnapshot struct {
+	// Repository is the value of the repository label
+	Repository string
+	// Labels holds the extra labels of the repository
+	Labels map[string]string
+	// Freshness is the freshness policy of the repository, nil when no freshness is expected
+	Freshness *FreshnessPolicy
+	// Retention is the expected retention policy of the repository, nil when it is not checked
+	Retention *RetentionPolicy
+	// Encryption is the encryption policy of the repository, empty when the encryption mode is not checked
+	Encryption EncryptionPolicy
+
+	// Info is the output of the last successful collection, nil if the repository was never collected successfully
+	Info *parser.InfoOutput
+	// List is the archives listing of the last successful collection, sorted from the oldest to the newest archive.
+	// It is nil when the archives are not collected.
+	List *parser.ListOutput
+
+	LastCollectTimestamp        time.Time
+	LastCollectDuration         time.Duration
+	LastCollectSuccessTimestamp time.Time
+	LastCollectError            bool
+	// LastCollectErrorReason is the category of the error of the last collection, empty when it succeeded
+	LastCollectErrorReason string
+	// CollectErrors holds the number of collection errors by category
+	CollectErrors   map[string]float64
+	CollectTimeouts float64
+	// CollectSkipped is the number of collections skipped while the repository was checked
+	CollectSkipped float64
+
+	// LogWarnings and LogErrors are the number of warning and error records logged by borg
+	LogWarnings float64
+	LogErrors   float64
+	// LogRecords holds the last borg log records, from the oldest to the newest
+	LogRecords []parser.LogRecord
+
+	// Check is the result of the last borg check, nil if the repository was never checked
+	Check *CheckSnapshot
+
+	// Filesystem is the capacity of the filesystem containing the repository, nil when unknown
+	Filesystem *FilesystemSnapshot
+	// StorageQuota is the storage quota of the repository in bytes, 0 when not set or unknown
+	StorageQuota float64
+	// SizeHistory holds the deduplicated compressed size of the successful collections within the forecast window,
+	// from the oldest to the newest
+	SizeHistory []SizeSample
+
+	// Backup is the progress and the result of the backups run by the wrap command, nil when none was reported
+	Backup *BackupSnapshot
+}
+
+// CheckSnapshot holds the result of a borg check
+type CheckSnapshot struct {
+	Timestamp time.Time
+	Duration  time.Duration
+	Success   bool
+	Problems  int
+}
+
+// NewMetricsCache returns an empty cache rendering its snapshots with the given metrics
+func NewMetricsCache(metrics *BorgMetrics) *MetricsCache {
+	return &MetricsCache{
+		Metrics:      metrics,
+		Repositories: map[string]*RepositorySnapshot{},
+	}
+}
+
+// Stale returns true when the last collection failed and the metrics come from a previous collection
+func (s *RepositorySnapshot) Stale() bool {
+	return s.LastCollectError && s.Info != nil
+}
+
+// AddLogRecords counts the warnings and errors of the given borg log records,
+// and keeps the last limit records of the repository.
+// The caller must hold the write lock.
+func (s *RepositorySnapshot) AddLogRecords(records []parser.LogRecord, limit int) {
+	for _, record := range records {
+		if record.IsWarning() {
+			s.LogWarnings++
+		} else if record.IsError() {
+			s.LogErrors++
+		}
+	}
+	s.LogRecords = append(s.LogRecords, records...)
+	if len(s.LogRecords) > limit {
+		// The records are copied, so that the dropped ones can be garbage collected
+		s.LogRecords = append([]parser.LogRecord(nil), s.LogRecords[len(s.LogRecords)-limit:]...)
+	}
+}
+
+// Repository returns the snapshot of a repository, creating it if needed.
+// The caller must hold the write lock.
+func (c *MetricsCache) Repository(repository string, labels map[string]string) *RepositorySnapshot {
+	snapshot, ok := c.Repositories[repository]
+	if !ok {
+		snapshot = &RepositorySnapshot{Repository: repository}
+		c.Repositories[repository] = snapshot
+	}
+	snapshot.Labels = labels
+	return snapshot
+}
+
+// RetainRepositories removes the snapshots of the repositories which are not in the given list,
+// for instance after they have been removed from the configuration.
+// The caller must hold the write lock.
+func (c *MetricsCache) RetainRepositories(repositories []string) {
+	keep := map[string]bool{}
+	for _, repository := range repositories {
+		keep[repository] = true
+	}
+	for repository := range c.Repositories {
+		if !keep[repository] {
+			delete(c.Repositories, repository)
+		}
+	}
+}
+
+// Register registers the cache to the prometheus registry
+func (c *MetricsCache) Register(registry *prometheus.Registry) {
+	registry.MustRegister(c)
+}
+
+// Describe implements prometheus.Collector
+func (c *MetricsCache) Describe(ch chan<- *prometheus.Desc) {
+	c.Metrics.Describe(ch)
+}
+
+// Collect implements prometheus.Collector, rendering the metrics of all the repositories
+func (c *MetricsCache) Collect(ch chan<- prometheus.Metric) {
+	c.RLock()
+	defer c.RUnlock()
+
+	names := make([]string, 0, len(c.Repositories))
+	for name := range c.Repositories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snapshots := make([]*RepositorySnapshot, 0, len(names))
+	for _, name := range names {
+		snapshots = append(snapshots, c.Repositories[name])
+	}
+	c.Metrics.Collect(ch, snapshots)
+}
+
+// RepositoryCollector returns a collector rendering only the metrics of the given repository,
+// for instance to push the metrics of each repository separately.
+// The metrics which are not related to a repository are rendered by GlobalCollector.
+func (c *MetricsCache) RepositoryCollector(repository string) prometheus.Collector {
+	return &repositoryCollector{cache: c, repository: repository}
+}
+
+// repositoryCollector renders the metrics of a single repository of a MetricsCache
+type repositoryCollector struct {
+	cache      *MetricsCache
+	repository string
+}
+
+// Describe implements prometheus.Collector
+func (c *repositoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.cache.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *repositoryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.cache.RLock()
+	defer c.cache.RUnlock()
+
+	if snapshot, ok := c.cache.Repositories[c.repository]; ok {
+		c.cache.Metrics.collectRepository(ch, snapshot)
+	}
+}
+
+// GlobalCollector returns a collector rendering only the metrics which are not related to a repository
+func (c *MetricsCache) GlobalCollector() prometheus.Collector {
+	return &globalCollector{cache: c}
+}
+
+// globalCollector renders the metrics of a MetricsCache which are not related to a repository
+type globalCollector struct {
+	cache *MetricsCache
+}
+
+// Describe implements prometheus.Collector
+func (c *globalCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.cache.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *globalCollector) Collect(ch chan<- prometheus.Metric) {
+	c.cache.Metrics.collectGlobal(ch)
 }
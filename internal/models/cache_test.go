@@ -0,0 +1,140 @@
+package models
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCache() *MetricsCache {
+	metrics := NewBorgMetrics("borg 1.2.8", []string{"team"})
+	metrics.ArchiveSeriesLimit = 2
+	return NewMetricsCache(metrics)
+}
+
+func mustParseBorgTime(t *testing.T, s string) parser.BorgTime {
+	t.Helper()
+	result, err := parser.ParseBorgTime(s)
+	if err != nil {
+		t.Fatalf("Failed to parse time %q: %v", s, err)
+	}
+	return result
+}
+
+func TestMetricsCache_Collect(t *testing.T) {
+	// The borg 1.x timestamps are read in the local time
+	local := time.Local
+	time.Local = time.UTC
+	defer func() { time.Local = local }()
+
+	cache := newTestCache()
+	snapshot := cache.Repository("laptop", map[string]string{"team": "infra"})
+	snapshot.LastCollectTimestamp = time.Unix(1730200000, 0)
+	snapshot.LastCollectSuccessTimestamp = time.Unix(1730100000, 0)
+	snapshot.LastCollectError = true
+	snapshot.CollectErrors = map[string]float64{"lock_timeout": 1, "passphrase": 1}
+	snapshot.LastCollectErrorReason = "passphrase"
+	snapshot.Info = &parser.InfoOutput{
+		Archives: []parser.InfoOutputArchive{
+			{Name: "laptop-3", Start: mustParseBorgTime(t, "2024-10-28T20:37:04.000000"), Stats: parser.InfoOutputArchiveStats{NFiles: 42}},
+		},
+	}
+	snapshot.List = &parser.ListOutput{
+		Archives: []parser.ListOutputArchive{
+			{Name: "laptop-1", Start: mustParseBorgTime(t, "2024-10-26T20:00:00.000000")},
+			{Name: "laptop-2", Start: mustParseBorgTime(t, "2024-10-27T20:00:00.000000")},
+			{Name: "laptop-3", Start: mustParseBorgTime(t, "2024-10-28T20:00:00.000000")},
+		},
+	}
+
+	expected := `
+# HELP borg_archive_start_timestamp Start timestamp of an archive
+# TYPE borg_archive_start_timestamp gauge
+borg_archive_start_timestamp{archive="laptop-2",repository="laptop",team="infra"} 1.7300592e+09
+borg_archive_start_timestamp{archive="laptop-3",repository="laptop",team="infra"} 1.7301456e+09
+# HELP borg_archives Number of archives in the repository
+# TYPE borg_archives gauge
+borg_archives{repository="laptop",team="infra"} 3
+# HELP borg_collect_errors Number of errors encountered by borg exporter, by reason
+# TYPE borg_collect_errors counter
+borg_collect_errors{reason="lock_timeout",repository="laptop",team="infra"} 1
+borg_collect_errors{reason="passphrase",repository="laptop",team="infra"} 1
+# HELP borg_last_backup_files Number of files in the last backup
+# TYPE borg_last_backup_files gauge
+borg_last_backup_files{repository="laptop",team="infra"} 42
+# HELP borg_metrics_stale 1 if the last collection failed and the metrics come from a previous collection, 0 otherwise
+# TYPE borg_metrics_stale gauge
+borg_metrics_stale{repository="laptop",team="infra"} 1
+`
+	err := testutil.CollectAndCompare(cache, strings.NewReader(expected),
+		"borg_archive_start_timestamp", "borg_archives", "borg_collect_errors", "borg_last_backup_files", "borg_metrics_stale")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetricsCache_NeverCollected(t *testing.T) {
+	cache := newTestCache()
+	snapshot := cache.Repository("laptop", nil)
+	snapshot.LastCollectTimestamp = time.Unix(1730200000, 0)
+	snapshot.LastCollectError = true
+	snapshot.CollectErrors = map[string]float64{"command": 1}
+
+	// Only the collection metrics are exposed, and the repository is not considered stale
+	if count := testutil.CollectAndCount(cache, "borg_last_backup_files", "borg_metrics_stale"); count != 0 {
+		t.Errorf("Expected no backup metrics, got %d", count)
+	}
+	if count := testutil.CollectAndCount(cache, "borg_last_collect_error"); count != 1 {
+		t.Errorf("Expected the last collect error metric, got %d", count)
+	}
+}
+
+func TestMetricsCache_RetainRepositories(t *testing.T) {
+	cache := newTestCache()
+	cache.Repository("laptop", nil).LastCollectTimestamp = time.Now()
+	cache.Repository("server", nil).LastCollectTimestamp = time.Now()
+
+	cache.RetainRepositories([]string{"server"})
+
+	registry := prometheus.NewRegistry()
+	cache.Register(registry)
+	if count := testutil.CollectAndCount(cache, "borg_last_collect_timestamp"); count != 1 {
+		t.Errorf("Expected only the retained repository, got %d series", count)
+	}
+	if _, ok := cache.Repositories["laptop"]; ok {
+		t.Error("Expected removed repository to be dropped")
+	}
+}
+
+func TestMetricsCache_RepositoryCollector(t *testing.T) {
+	cache := newTestCache()
+	cache.Repository("laptop", nil).LastCollectTimestamp = time.Now()
+	cache.Repository("server", nil).LastCollectTimestamp = time.Now()
+
+	collector := cache.RepositoryCollector("server")
+	if count := testutil.CollectAndCount(collector, "borg_last_collect_timestamp"); count != 1 {
+		t.Errorf("Expected only the metrics of the repository, got %d series", count)
+	}
+	if count := testutil.CollectAndCount(cache.RepositoryCollector("unknown"), "borg_last_collect_timestamp"); count != 0 {
+		t.Errorf("Expected no metrics for an unknown repository, got %d series", count)
+	}
+	if count := testutil.CollectAndCount(collector, "borg_system_info"); count != 0 {
+		t.Errorf("Expected no global metrics, got %d series", count)
+	}
+}
+
+func TestMetricsCache_GlobalCollector(t *testing.T) {
+	cache := newTestCache()
+	cache.Repository("laptop", nil).LastCollectTimestamp = time.Now()
+
+	collector := cache.GlobalCollector()
+	if count := testutil.CollectAndCount(collector, "borg_system_info"); count != 1 {
+		t.Errorf("Expected the global metrics, got %d series", count)
+	}
+	if count := testutil.CollectAndCount(collector, "borg_last_collect_timestamp"); count != 0 {
+		t.Errorf("Expected no repository metrics, got %d series", count)
+	}
+}
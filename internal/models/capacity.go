@@ -0,0 +1,98 @@
+package models
+
+import (
+	"math"
+	"time"
+)
+
+// maxSizeSamples is the maximum number of samples of the size history within the forecast window
+const maxSizeSamples = 500
+
+// FilesystemSnapshot is the capacity of the filesystem containing a repository, in bytes
+type FilesystemSnapshot struct {
+	Size float64
+	Free float64
+	// Available is the free space available to borg, excluding the blocks reserved to root
+	Available float64
+}
+
+// SizeSample is the deduplicated compressed size of a repository at a point in time
+type SizeSample struct {
+	Timestamp time.Time
+	Size      float64
+}
+
+// AddSizeSample appends a sample to the size history, and removes the samples older than the window.
+// To bound the history, a sample closer than window/maxSizeSamples to the one before the last sample replaces
+// the last sample, so that the samples are spaced while the last one stays up to date.
+// Nothing is kept when the window is 0.
+// The caller must hold the write lock.
+func (s *RepositorySnapshot) AddSizeSample(sample SizeSample, window time.Duration) {
+	if window <= 0 {
+		s.SizeHistory = nil
+		return
+	}
+	if n := len(s.SizeHistory); n > 1 && sample.Timestamp.Sub(s.SizeHistory[n-2].Timestamp) < window/maxSizeSamples {
+		s.SizeHistory[n-1] = sample
+	} else {
+		s.SizeHistory = append(s.SizeHistory, sample)
+	}
+
+	start := 0
+	for start < len(s.SizeHistory) && sample.Timestamp.Sub(s.SizeHistory[start].Timestamp) > window {
+		start++
+	}
+	if start > 0 {
+		s.SizeHistory = append([]SizeSample(nil), s.SizeHistory[start:]...)
+	}
+}
+
+// GrowthRate returns the growth of the repository in bytes per second, computed by a linear regression
+// of the size history. It returns false when the history doesn't span over time.
+func GrowthRate(history []SizeSample) (float64, bool) {
+	if len(history) < 2 {
+		return 0, false
+	}
+	// The timestamps are relative to the first sample, to keep the precision of the sums
+	origin := history[0].Timestamp
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sample := range history {
+		x := sample.Timestamp.Sub(origin).Seconds()
+		sumX += x
+		sumY += sample.Size
+		sumXY += x * sample.Size
+		sumXX += x * x
+	}
+	n := float64(len(history))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
+
+// DaysUntilFull forecasts the number of days until the repository fills its filesystem or reaches its storage quota,
+// from its growth over the size history.
+// It returns false when the repository doesn't grow, or when neither its filesystem nor its quota is known.
+func (s *RepositorySnapshot) DaysUntilFull() (float64, bool) {
+	if len(s.SizeHistory) == 0 {
+		return 0, false
+	}
+	remaining := math.Inf(1)
+	if s.Filesystem != nil {
+		remaining = s.Filesystem.Available
+	}
+	if s.StorageQuota > 0 {
+		// borg counts the quota against the size of the segments, close to the deduplicated compressed size
+		size := s.SizeHistory[len(s.SizeHistory)-1].Size
+		remaining = math.Min(remaining, math.Max(s.StorageQuota-size, 0))
+	}
+	if math.IsInf(remaining, 1) {
+		return 0, false
+	}
+	rate, ok := GrowthRate(s.SizeHistory)
+	if !ok || rate <= 0 {
+		return 0, false
+	}
+	return remaining / rate / (24 * time.Hour).Seconds(), true
+}
@@ -0,0 +1,177 @@
+package models
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dailySizes returns one sample per day until the given end, growing by the given number of bytes per day
+func dailySizes(end time.Time, days int, size, growth float64) []SizeSample {
+	var samples []SizeSample
+	for i := days - 1; i >= 0; i-- {
+		samples = append(samples, SizeSample{Timestamp: end.AddDate(0, 0, -i), Size: size - float64(i)*growth})
+	}
+	return samples
+}
+
+func TestGrowthRate(t *testing.T) {
+	now := time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC)
+	day := (24 * time.Hour).Seconds()
+
+	tests := []struct {
+		name    string
+		history []SizeSample
+		want    float64
+		wantOk  bool
+	}{
+		{name: "no history"},
+		{name: "single sample", history: dailySizes(now, 1, 1000, 0)},
+		{name: "same timestamp", history: []SizeSample{{Timestamp: now, Size: 1}, {Timestamp: now, Size: 2}}},
+		{name: "linear growth", history: dailySizes(now, 10, 1000, 50), want: 50 / day, wantOk: true},
+		{
+			name: "noisy growth",
+			history: []SizeSample{
+				{Timestamp: now.AddDate(0, 0, -2), Size: 100},
+				{Timestamp: now.AddDate(0, 0, -1), Size: 130},
+				{Timestamp: now, Size: 140},
+			},
+			want:   20 / day,
+			wantOk: true,
+		},
+		{name: "shrinking", history: dailySizes(now, 10, 1000, -50), want: -50 / day, wantOk: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := GrowthRate(tt.history)
+			if ok != tt.wantOk || math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Expected %v (%v), got %v (%v)", tt.want, tt.wantOk, got, ok)
+			}
+		})
+	}
+}
+
+func TestRepositorySnapshot_DaysUntilFull(t *testing.T) {
+	now := time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC)
+	history := dailySizes(now, 10, 1000, 50)
+
+	tests := []struct {
+		name     string
+		snapshot RepositorySnapshot
+		want     float64
+		wantOk   bool
+	}{
+		{name: "unknown capacity", snapshot: RepositorySnapshot{SizeHistory: history}},
+		{name: "no history", snapshot: RepositorySnapshot{Filesystem: &FilesystemSnapshot{Available: 500}}},
+		{
+			name:     "filesystem",
+			snapshot: RepositorySnapshot{SizeHistory: history, Filesystem: &FilesystemSnapshot{Available: 500}},
+			want:     10,
+			wantOk:   true,
+		},
+		{
+			name:     "quota reached before the filesystem is full",
+			snapshot: RepositorySnapshot{SizeHistory: history, Filesystem: &FilesystemSnapshot{Available: 500}, StorageQuota: 1100},
+			want:     2,
+			wantOk:   true,
+		},
+		{
+			name:     "quota exceeded",
+			snapshot: RepositorySnapshot{SizeHistory: history, StorageQuota: 900},
+			want:     0,
+			wantOk:   true,
+		},
+		{
+			name:     "not growing",
+			snapshot: RepositorySnapshot{SizeHistory: dailySizes(now, 10, 1000, 0), Filesystem: &FilesystemSnapshot{Available: 500}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.snapshot.DaysUntilFull()
+			if ok != tt.wantOk || math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Expected %v (%v), got %v (%v)", tt.want, tt.wantOk, got, ok)
+			}
+		})
+	}
+}
+
+func TestRepositorySnapshot_AddSizeSample(t *testing.T) {
+	now := time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC)
+	window := 3 * 24 * time.Hour
+
+	snapshot := &RepositorySnapshot{}
+	for _, sample := range dailySizes(now, 5, 1000, 10) {
+		snapshot.AddSizeSample(sample, window)
+	}
+	if want := dailySizes(now, 4, 1000, 10); !equalSizeSamples(snapshot.SizeHistory, want) {
+		t.Errorf("Expected the samples of the window %v, got %v", want, snapshot.SizeHistory)
+	}
+
+	// A sample close to the one before the last sample replaces the last sample
+	snapshot.AddSizeSample(SizeSample{Timestamp: now.Add(time.Minute), Size: 1001}, window)
+	snapshot.AddSizeSample(SizeSample{Timestamp: now.Add(2 * time.Minute), Size: 1002}, window)
+	want := append(dailySizes(now, 3, 1000, 10), SizeSample{Timestamp: now.Add(2 * time.Minute), Size: 1002})
+	if !equalSizeSamples(snapshot.SizeHistory, want) {
+		t.Errorf("Expected %v, got %v", want, snapshot.SizeHistory)
+	}
+
+	snapshot.AddSizeSample(SizeSample{Timestamp: now, Size: 1000}, 0)
+	if snapshot.SizeHistory != nil {
+		t.Errorf("Expected no history without window, got %v", snapshot.SizeHistory)
+	}
+}
+
+func equalSizeSamples(a, b []SizeSample) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Timestamp.Equal(b[i].Timestamp) || a[i].Size != b[i].Size {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMetricsCache_CollectCapacity(t *testing.T) {
+	cache := newTestCache()
+	now := time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC)
+
+	snapshot := cache.Repository("laptop", map[string]string{"team": "infra"})
+	snapshot.Info = &parser.InfoOutput{}
+	snapshot.Filesystem = &FilesystemSnapshot{Size: 10000, Free: 600, Available: 500}
+	snapshot.StorageQuota = 1100
+	snapshot.SizeHistory = dailySizes(now, 10, 1000, 50)
+	// Without filesystem nor quota, there is no forecast
+	server := cache.Repository("server", nil)
+	server.Info = &parser.InfoOutput{}
+	server.SizeHistory = dailySizes(now, 10, 1000, 50)
+
+	expected := `
+# HELP borg_filesystem_avail_bytes Free space of the filesystem containing the repository available to non-root users in bytes
+# TYPE borg_filesystem_avail_bytes gauge
+borg_filesystem_avail_bytes{repository="laptop",team="infra"} 500
+# HELP borg_filesystem_free_bytes Free space of the filesystem containing the repository in bytes
+# TYPE borg_filesystem_free_bytes gauge
+borg_filesystem_free_bytes{repository="laptop",team="infra"} 600
+# HELP borg_filesystem_size_bytes Size of the filesystem containing the repository in bytes
+# TYPE borg_filesystem_size_bytes gauge
+borg_filesystem_size_bytes{repository="laptop",team="infra"} 10000
+# HELP borg_repository_days_until_full Forecast of the number of days until the repository fills its filesystem or reaches its storage quota
+# TYPE borg_repository_days_until_full gauge
+borg_repository_days_until_full{repository="laptop",team="infra"} 2
+# HELP borg_repository_storage_quota_bytes Storage quota of the repository in bytes
+# TYPE borg_repository_storage_quota_bytes gauge
+borg_repository_storage_quota_bytes{repository="laptop",team="infra"} 1100
+`
+	err := testutil.CollectAndCompare(cache, strings.NewReader(expected),
+		"borg_filesystem_avail_bytes", "borg_filesystem_free_bytes", "borg_filesystem_size_bytes",
+		"borg_repository_days_until_full", "borg_repository_storage_quota_bytes")
+	if err != nil {
+		t.Error(err)
+	}
+}
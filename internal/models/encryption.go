@@ -0,0 +1,40 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EncryptionPolicy is the minimum protection expected from the encryption mode of the repositories.
+// The empty policy doesn't check the encryption mode.
+type EncryptionPolicy string
+
+const (
+	// EncryptionPolicyAuthenticated flags the repositories without authentication, using the none mode
+	EncryptionPolicyAuthenticated EncryptionPolicy = "authenticated"
+	// EncryptionPolicyEncrypted flags the repositories without encryption, using the none or authenticated modes
+	EncryptionPolicyEncrypted EncryptionPolicy = "encrypted"
+)
+
+// Validate returns an error when the policy is unknown
+func (p EncryptionPolicy) Validate() error {
+	switch p {
+	case "", EncryptionPolicyAuthenticated, EncryptionPolicyEncrypted:
+		return nil
+	default:
+		return fmt.Errorf("unknown encryption policy %q, expected %s or %s", p, EncryptionPolicyAuthenticated, EncryptionPolicyEncrypted)
+	}
+}
+
+// Insecure returns true when the given borg encryption mode doesn't provide the protection required by the policy
+func (p EncryptionPolicy) Insecure(mode string) bool {
+	switch p {
+	case EncryptionPolicyAuthenticated:
+		return mode == "none"
+	case EncryptionPolicyEncrypted:
+		// The authenticated modes (authenticated, authenticated-blake2) store the data unencrypted
+		return mode == "none" || strings.HasPrefix(mode, "authenticated")
+	default:
+		return false
+	}
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+)
+
+func TestEncryptionPolicy_Insecure(t *testing.T) {
+	tests := []struct {
+		mode              string
+		wantAuthenticated bool
+		wantEncrypted     bool
+	}{
+		{mode: "none", wantAuthenticated: true, wantEncrypted: true},
+		{mode: "authenticated", wantEncrypted: true},
+		{mode: "authenticated-blake2", wantEncrypted: true},
+		{mode: "repokey"},
+		{mode: "keyfile-blake2"},
+		{mode: "repokey-aes-ocb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			if got := EncryptionPolicyAuthenticated.Insecure(tt.mode); got != tt.wantAuthenticated {
+				t.Errorf("Expected insecure %v for the authenticated policy, got %v", tt.wantAuthenticated, got)
+			}
+			if got := EncryptionPolicyEncrypted.Insecure(tt.mode); got != tt.wantEncrypted {
+				t.Errorf("Expected insecure %v for the encrypted policy, got %v", tt.wantEncrypted, got)
+			}
+			if EncryptionPolicy("").Insecure(tt.mode) {
+				t.Error("Expected no insecure mode without policy")
+			}
+		})
+	}
+}
+
+func TestMetricsCache_CollectEncryptionAndSettings(t *testing.T) {
+	cache := newTestCache()
+	// The ratio is exposed even when it is 0, as for a tiny archive
+	var maxArchiveSize float64
+	laptop := cache.Repository("laptop", map[string]string{"team": "infra"})
+	laptop.Encryption = EncryptionPolicyEncrypted
+	laptop.Info = &parser.InfoOutput{
+		Archives: []parser.InfoOutputArchive{{
+			ChunkerParams: parser.ChunkerParams{"buzhash", 19.0, 23.0, 21.0, 4095.0},
+			CommandLine:   []string{"borg", "create", "--compression", "zstd,3", "::laptop", "/home"},
+			Limits:        parser.InfoOutputArchiveLimits{MaxArchiveSize: &maxArchiveSize},
+		}},
+		Encryption: parser.InfoOutputEncryption{Mode: "authenticated"},
+	}
+	// Without encryption policy, the encryption mode is not checked
+	cache.Repository("server", nil).Info = &parser.InfoOutput{Encryption: parser.InfoOutputEncryption{Mode: "none"}}
+
+	expected := `
+# HELP borg_last_archive_settings_info Chunker parameters and compression of the last backup archive
+# TYPE borg_last_archive_settings_info gauge
+borg_last_archive_settings_info{chunker_params="buzhash,19,23,21,4095",compression="zstd,3",repository="laptop",team="infra"} 1
+# HELP borg_last_backup_max_archive_size_ratio Ratio of the metadata size of the last backup to the maximum archive size of borg
+# TYPE borg_last_backup_max_archive_size_ratio gauge
+borg_last_backup_max_archive_size_ratio{repository="laptop",team="infra"} 0
+# HELP borg_repository_encryption_info Encryption mode and key type of the backup repository
+# TYPE borg_repository_encryption_info gauge
+borg_repository_encryption_info{key_type="repokey",mode="authenticated",repository="laptop",team="infra"} 1
+borg_repository_encryption_info{key_type="none",mode="none",repository="server",team=""} 1
+# HELP borg_repository_encryption_insecure 1 if the encryption mode of the repository doesn't meet the encryption policy, 0 otherwise
+# TYPE borg_repository_encryption_insecure gauge
+borg_repository_encryption_insecure{repository="laptop",team="infra"} 1
+`
+	err := testutil.CollectAndCompare(cache, strings.NewReader(expected),
+		"borg_last_archive_settings_info", "borg_last_backup_max_archive_size_ratio",
+		"borg_repository_encryption_info", "borg_repository_encryption_insecure")
+	if err != nil {
+		t.Error(err)
+	}
+}
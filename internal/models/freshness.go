@@ -0,0 +1,74 @@
+package models
+
+import (
+	"time"
+)
+
+// FreshnessPolicy defines the maximum expected age of the last backup of a repository
+type FreshnessPolicy struct {
+	// MaxAge is the maximum age of the last backup, 0 to only use the daily schedule
+	MaxAge time.Duration
+	// Daily expects a backup every day, started before DailyBefore
+	Daily bool
+	// DailyBefore is the time of day before which the daily backup is expected, as a duration since midnight
+	DailyBefore time.Duration
+	// Location is the time zone of DailyBefore, the local time zone when nil
+	Location *time.Location
+	// MaintenanceWindows are the periods during which the backups are never considered stale
+	MaintenanceWindows []MaintenanceWindow
+}
+
+// MaintenanceWindow is a period during which the backups are never considered stale
+type MaintenanceWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+// ExpectedMaxAge returns the maximum expected age of the last backup at the given time.
+// With a daily schedule, the backup of the last deadline must have started during the day before it:
+// the expected age is 24h right at the deadline, and grows until the next deadline.
+// When both a maximum age and a daily schedule are defined, the strictest applies.
+func (p *FreshnessPolicy) ExpectedMaxAge(now time.Time) time.Duration {
+	maxAge := p.MaxAge
+	if !p.Daily {
+		return maxAge
+	}
+
+	location := p.Location
+	if location == nil {
+		location = time.Local
+	}
+	local := now.In(location)
+	hours, minutes := int(p.DailyBefore.Hours()), int(p.DailyBefore.Minutes())%60
+	deadline := time.Date(local.Year(), local.Month(), local.Day(), hours, minutes, 0, 0, location)
+	if deadline.After(local) {
+		deadline = deadline.AddDate(0, 0, -1)
+	}
+	dailyMaxAge := now.Sub(deadline.AddDate(0, 0, -1))
+	if maxAge == 0 || dailyMaxAge < maxAge {
+		maxAge = dailyMaxAge
+	}
+	return maxAge
+}
+
+// InMaintenance returns true when the given time is in a maintenance window
+func (p *FreshnessPolicy) InMaintenance(now time.Time) bool {
+	for _, window := range p.MaintenanceWindows {
+		if !now.Before(window.Start) && now.Before(window.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stale returns true when the last backup, started at the given time, is older than expected.
+// A zero last backup time means that there is no backup.
+func (p *FreshnessPolicy) Stale(lastBackup time.Time, now time.Time) bool {
+	if p.InMaintenance(now) {
+		return false
+	}
+	if lastBackup.IsZero() {
+		return true
+	}
+	return now.Sub(lastBackup) > p.ExpectedMaxAge(now)
+}
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFreshnessPolicy_ExpectedMaxAge(t *testing.T) {
+	daily := &FreshnessPolicy{Daily: true, DailyBefore: 6 * time.Hour, Location: time.UTC}
+
+	tests := []struct {
+		name   string
+		policy *FreshnessPolicy
+		now    time.Time
+		want   time.Duration
+	}{
+		{
+			name:   "max age",
+			policy: &FreshnessPolicy{MaxAge: 26 * time.Hour},
+			now:    time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC),
+			want:   26 * time.Hour,
+		},
+		{
+			name:   "daily at the deadline",
+			policy: daily,
+			now:    time.Date(2024, 10, 29, 6, 0, 0, 0, time.UTC),
+			want:   24 * time.Hour,
+		},
+		{
+			name:   "daily after the deadline",
+			policy: daily,
+			now:    time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC),
+			want:   30 * time.Hour,
+		},
+		{
+			name:   "daily before the deadline",
+			policy: daily,
+			now:    time.Date(2024, 10, 29, 5, 0, 0, 0, time.UTC),
+			want:   47 * time.Hour,
+		},
+		{
+			name:   "daily in another time zone",
+			policy: &FreshnessPolicy{Daily: true, DailyBefore: 6 * time.Hour, Location: time.FixedZone("UTC+2", 2*3600)},
+			now:    time.Date(2024, 10, 29, 6, 0, 0, 0, time.UTC),
+			want:   26 * time.Hour,
+		},
+		{
+			name:   "strictest of max age and daily",
+			policy: &FreshnessPolicy{MaxAge: 25 * time.Hour, Daily: true, DailyBefore: 6 * time.Hour, Location: time.UTC},
+			now:    time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC),
+			want:   25 * time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.ExpectedMaxAge(tt.now); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFreshnessPolicy_Stale(t *testing.T) {
+	now := time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC)
+	policy := &FreshnessPolicy{
+		MaxAge: 26 * time.Hour,
+		MaintenanceWindows: []MaintenanceWindow{
+			{Start: time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2024, 11, 3, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		lastBackup time.Time
+		now        time.Time
+		want       bool
+	}{
+		{name: "fresh", lastBackup: now.Add(-2 * time.Hour), now: now, want: false},
+		{name: "stale", lastBackup: now.Add(-27 * time.Hour), now: now, want: true},
+		{name: "no backup", now: now, want: true},
+		{name: "maintenance window", lastBackup: now, now: time.Date(2024, 11, 2, 0, 0, 0, 0, time.UTC), want: false},
+		{name: "after the maintenance window", lastBackup: now, now: time.Date(2024, 11, 3, 0, 0, 0, 0, time.UTC), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Stale(tt.lastBackup, tt.now); got != tt.want {
+				t.Errorf("Expected stale %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMetricsCache_CollectFreshness(t *testing.T) {
+	cache := newTestCache()
+	now := time.Date(2024, 10, 29, 20, 37, 4, 0, time.UTC)
+	cache.Metrics.Now = func() time.Time { return now }
+
+	snapshot := cache.Repository("laptop", map[string]string{"team": "infra"})
+	snapshot.Freshness = &FreshnessPolicy{MaxAge: 12 * time.Hour}
+	snapshot.Info = &parser.InfoOutput{
+		Archives: []parser.InfoOutputArchive{
+			{Name: "laptop-3", Start: parser.BorgTime{Time: now.Add(-24 * time.Hour)}},
+		},
+	}
+	// Without freshness policy, only the age is exposed
+	cache.Repository("server", nil).Info = &parser.InfoOutput{
+		Archives: []parser.InfoOutputArchive{
+			{Name: "server-1", Start: parser.BorgTime{Time: now.Add(-time.Hour)}},
+		},
+	}
+
+	expected := `
+# HELP borg_backup_age_seconds Age of the last backup in seconds
+# TYPE borg_backup_age_seconds gauge
+borg_backup_age_seconds{repository="laptop",team="infra"} 86400
+borg_backup_age_seconds{repository="server",team=""} 3600
+# HELP borg_backup_expected_max_age_seconds Maximum expected age of the last backup in seconds
+# TYPE borg_backup_expected_max_age_seconds gauge
+borg_backup_expected_max_age_seconds{repository="laptop",team="infra"} 43200
+# HELP borg_backup_stale 1 if the last backup is older than expected, 0 otherwise or during a maintenance window
+# TYPE borg_backup_stale gauge
+borg_backup_stale{repository="laptop",team="infra"} 1
+`
+	err := testutil.CollectAndCompare(cache, strings.NewReader(expected),
+		"borg_backup_age_seconds", "borg_backup_expected_max_age_seconds", "borg_backup_stale")
+	if err != nil {
+		t.Error(err)
+	}
+}
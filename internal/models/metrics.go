@@ -3,176 +3,648 @@ package models
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"os"
+	"sort"
+	"time"
 )
 
 type BorgMetrics struct {
 	// archive metrics
-	LastBackupDuration         *prometheus.GaugeVec
-	LastBackupCompressedSize   *prometheus.GaugeVec
-	LastBackupDeduplicatedSize *prometheus.GaugeVec
-	LastBackupFiles            *prometheus.GaugeVec
-	LastBackupOriginalSize     *prometheus.GaugeVec
-	LastBackupTimestamp        *prometheus.GaugeVec
+	LastBackupDuration         *prometheus.Desc
+	LastBackupCompressedSize   *prometheus.Desc
+	LastBackupDeduplicatedSize *prometheus.Desc
+	LastBackupFiles            *prometheus.Desc
+	LastBackupOriginalSize     *prometheus.Desc
+	LastBackupTimestamp        *prometheus.Desc
+	LastBackupMaxSizeRatio     *prometheus.Desc
+
+	// archives metrics (from borg list)
+	ArchiveCount           *prometheus.Desc
+	OldestArchiveTimestamp *prometheus.Desc
+	NewestArchiveTimestamp *prometheus.Desc
+	ArchiveStartTimestamp  *prometheus.Desc
+	ArchiveDuration        *prometheus.Desc
 
 	// repository metrics (from borg info cache stats)
-	TotalChunks                *prometheus.GaugeVec
-	TotalCompressedSize        *prometheus.GaugeVec
-	TotalSize                  *prometheus.GaugeVec
-	TotalUniqueChunks          *prometheus.GaugeVec
-	DeduplicatedCompressedSize *prometheus.GaugeVec // unique_csize
-	DeduplicatedSize           *prometheus.GaugeVec // unique_size
+	TotalChunks                *prometheus.Desc
+	TotalCompressedSize        *prometheus.Desc
+	TotalSize                  *prometheus.Desc
+	TotalUniqueChunks          *prometheus.Desc
+	DeduplicatedCompressedSize *prometheus.Desc // unique_csize
+	DeduplicatedSize           *prometheus.Desc // unique_size
+
+	// capacity metrics, only rendered when the filesystem or the storage quota of the repository is known
+	FilesystemSize      *prometheus.Desc
+	FilesystemFree      *prometheus.Desc
+	FilesystemAvailable *prometheus.Desc
+	StorageQuota        *prometheus.Desc
+	DaysUntilFull       *prometheus.Desc
+
+	// freshness metrics, computed at scrape time
+	BackupAge            *prometheus.Desc
+	BackupExpectedMaxAge *prometheus.Desc
+	BackupStale          *prometheus.Desc
+
+	// backup metrics, reported by the wrap command
+	BackupInProgress               *prometheus.Desc
+	BackupProgressOriginalSize     *prometheus.Desc
+	BackupProgressCompressedSize   *prometheus.Desc
+	BackupProgressDeduplicatedSize *prometheus.Desc
+	BackupProgressFiles            *prometheus.Desc
+	BackupProgressElapsed          *prometheus.Desc
+	LastBackupExitCode             *prometheus.Desc
+	LastBackupWarnings             *prometheus.Desc
+
+	// retention metrics (from borg list), computed at scrape time
+	RetentionBuckets          *prometheus.Desc
+	RetentionMissingBuckets   *prometheus.Desc
+	RetentionOldestArchiveAge *prometheus.Desc
+
+	// encryption metrics, only rendered when an encryption policy is defined
+	EncryptionInsecure *prometheus.Desc
+
+	// check metrics (from borg check)
+	CheckLastTimestamp *prometheus.Desc
+	CheckDuration      *prometheus.Desc
+	CheckSuccess       *prometheus.Desc
+	CheckProblems      *prometheus.Desc
 
 	// exporter collection metrics
-	CollectErrors        *prometheus.CounterVec
-	LastCollectError     *prometheus.GaugeVec
-	LastCollectDuration  *prometheus.GaugeVec
-	LastCollectTimestamp *prometheus.GaugeVec
+	CollectErrors        *prometheus.Desc
+	CollectTimeouts      *prometheus.Desc
+	CollectSkipped       *prometheus.Desc
+	LastCollectError     *prometheus.Desc
+	LogMessages          *prometheus.Desc
+	LastCollectDuration  *prometheus.Desc
+	LastCollectTimestamp *prometheus.Desc
+
+	LastCollectSuccessTimestamp *prometheus.Desc
+	MetricsStale                *prometheus.Desc
 
 	// info metrics
-	LastArchiveInfo *prometheus.GaugeVec
-	RepositoryInfo  *prometheus.GaugeVec
-	SystemInfo      *prometheus.GaugeVec
+	LastArchiveInfo         *prometheus.Desc
+	LastArchiveSettingsInfo *prometheus.Desc
+	RepositoryInfo          *prometheus.Desc
+	EncryptionInfo          *prometheus.Desc
+	SystemInfo              *prometheus.Desc
+
+	// ArchiveMetrics renders the archives metrics of the listings, which are also collected to check the retention
+	ArchiveMetrics bool
+	// ArchiveSeriesLimit is the maximum number of most recent archives rendered as labeled series
+	ArchiveSeriesLimit int
+	// Now returns the current time, used to compute the freshness metrics
+	Now func() time.Time
+
+	extraLabels []string
+	hostname    string
+	borgVersion string
 }
 
-// NewBorgMetrics creates a BorgMetrics object containing all the metrics and returns a pointer to it
-func NewBorgMetrics(borgVersion string) *BorgMetrics {
+// NewBorgMetrics creates a BorgMetrics object containing all the metrics and returns a pointer to it.
+// The repository metrics are labeled by repository, followed by the given extra labels.
+func NewBorgMetrics(borgVersion string, extraLabels []string) *BorgMetrics {
 	hostname, err := os.Hostname()
 	if err != nil {
 		hostname = "unknown"
 	}
 
+	labels := func(names ...string) []string {
+		labelNames := append([]string{"repository"}, extraLabels...)
+		return append(labelNames, names...)
+	}
+
 	m := &BorgMetrics{
 		// archive metrics
-		LastBackupDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_last_backup_duration_seconds",
-			Help: "Duration of the last backup in seconds",
-		}, []string{"repository"}),
-		LastBackupCompressedSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_last_backup_compressed_size_bytes",
-			Help: "Compressed size of the last backup in bytes",
-		}, []string{"repository"}),
-		LastBackupDeduplicatedSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_last_backup_deduplicated_size_bytes",
-			Help: "Deduplicated size of the last backup in bytes",
-		}, []string{"repository"}),
-		LastBackupFiles: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_last_backup_files",
-			Help: "Number of files in the last backup",
-		}, []string{"repository"}),
-		LastBackupOriginalSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_last_backup_original_size_bytes",
-			Help: "Original size of the last backup in bytes",
-		}, []string{"repository"}),
-		LastBackupTimestamp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_last_backup_timestamp",
-			Help: "Timestamp of the last backup",
-		}, []string{"repository"}),
+		LastBackupDuration: prometheus.NewDesc(
+			"borg_last_backup_duration_seconds",
+			"Duration of the last backup in seconds",
+			labels(), nil),
+		LastBackupCompressedSize: prometheus.NewDesc(
+			"borg_last_backup_compressed_size_bytes",
+			"Compressed size of the last backup in bytes",
+			labels(), nil),
+		LastBackupDeduplicatedSize: prometheus.NewDesc(
+			"borg_last_backup_deduplicated_size_bytes",
+			"Deduplicated size of the last backup in bytes",
+			labels(), nil),
+		LastBackupFiles: prometheus.NewDesc(
+			"borg_last_backup_files",
+			"Number of files in the last backup",
+			labels(), nil),
+		LastBackupOriginalSize: prometheus.NewDesc(
+			"borg_last_backup_original_size_bytes",
+			"Original size of the last backup in bytes",
+			labels(), nil),
+		LastBackupTimestamp: prometheus.NewDesc(
+			"borg_last_backup_timestamp",
+			"Timestamp of the last backup",
+			labels(), nil),
+		LastBackupMaxSizeRatio: prometheus.NewDesc(
+			"borg_last_backup_max_archive_size_ratio",
+			"Ratio of the metadata size of the last backup to the maximum archive size of borg",
+			labels(), nil),
+
+		// archives metrics
+		ArchiveCount: prometheus.NewDesc(
+			"borg_archives",
+			"Number of archives in the repository",
+			labels(), nil),
+		OldestArchiveTimestamp: prometheus.NewDesc(
+			"borg_oldest_archive_timestamp",
+			"Start timestamp of the oldest archive in the repository",
+			labels(), nil),
+		NewestArchiveTimestamp: prometheus.NewDesc(
+			"borg_newest_archive_timestamp",
+			"Start timestamp of the newest archive in the repository",
+			labels(), nil),
+		ArchiveStartTimestamp: prometheus.NewDesc(
+			"borg_archive_start_timestamp",
+			"Start timestamp of an archive",
+			labels("archive"), nil),
+		ArchiveDuration: prometheus.NewDesc(
+			"borg_archive_duration_seconds",
+			"Duration of an archive creation in seconds",
+			labels("archive"), nil),
 
 		// repository metrics
-		TotalChunks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_total_chunks",
-			Help: "Repository total chunks",
-		}, []string{"repository"}),
-		TotalCompressedSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_total_compressed_size_bytes",
-			Help: "Repository total compressed size",
-		}, []string{"repository"}),
-		TotalSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_total_size_bytes",
-			Help: "Repository total size",
-		}, []string{"repository"}),
-		TotalUniqueChunks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_total_unique_chunks",
-			Help: "Repository total unique chunks",
-		}, []string{"repository"}),
-		DeduplicatedCompressedSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_deduplicated_compressed_size_bytes",
-			Help: "Repository deduplicated compressed size",
-		}, []string{"repository"}),
-		DeduplicatedSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_deduplicated_size_bytes",
-			Help: "Repository deduplicated size",
-		}, []string{"repository"}),
+		TotalChunks: prometheus.NewDesc(
+			"borg_total_chunks",
+			"Repository total chunks",
+			labels(), nil),
+		TotalCompressedSize: prometheus.NewDesc(
+			"borg_total_compressed_size_bytes",
+			"Repository total compressed size",
+			labels(), nil),
+		TotalSize: prometheus.NewDesc(
+			"borg_total_size_bytes",
+			"Repository total size",
+			labels(), nil),
+		TotalUniqueChunks: prometheus.NewDesc(
+			"borg_total_unique_chunks",
+			"Repository total unique chunks",
+			labels(), nil),
+		DeduplicatedCompressedSize: prometheus.NewDesc(
+			"borg_deduplicated_compressed_size_bytes",
+			"Repository deduplicated compressed size",
+			labels(), nil),
+		DeduplicatedSize: prometheus.NewDesc(
+			"borg_deduplicated_size_bytes",
+			"Repository deduplicated size",
+			labels(), nil),
+
+		// capacity metrics
+		FilesystemSize: prometheus.NewDesc(
+			"borg_filesystem_size_bytes",
+			"Size of the filesystem containing the repository in bytes",
+			labels(), nil),
+		FilesystemFree: prometheus.NewDesc(
+			"borg_filesystem_free_bytes",
+			"Free space of the filesystem containing the repository in bytes",
+			labels(), nil),
+		FilesystemAvailable: prometheus.NewDesc(
+			"borg_filesystem_avail_bytes",
+			"Free space of the filesystem containing the repository available to non-root users in bytes",
+			labels(), nil),
+		StorageQuota: prometheus.NewDesc(
+			"borg_repository_storage_quota_bytes",
+			"Storage quota of the repository in bytes",
+			labels(), nil),
+		DaysUntilFull: prometheus.NewDesc(
+			"borg_repository_days_until_full",
+			"Forecast of the number of days until the repository fills its filesystem or reaches its storage quota",
+			labels(), nil),
+
+		// freshness metrics
+		BackupAge: prometheus.NewDesc(
+			"borg_backup_age_seconds",
+			"Age of the last backup in seconds",
+			labels(), nil),
+		BackupExpectedMaxAge: prometheus.NewDesc(
+			"borg_backup_expected_max_age_seconds",
+			"Maximum expected age of the last backup in seconds",
+			labels(), nil),
+		BackupStale: prometheus.NewDesc(
+			"borg_backup_stale",
+			"1 if the last backup is older than expected, 0 otherwise or during a maintenance window",
+			labels(), nil),
+
+		// backup metrics
+		BackupInProgress: prometheus.NewDesc(
+			"borg_backup_in_progress",
+			"1 if a backup run by the wrap command is in progress, 0 otherwise",
+			labels(), nil),
+		BackupProgressOriginalSize: prometheus.NewDesc(
+			"borg_backup_progress_original_size_bytes",
+			"Original size of the data processed by the backup in progress in bytes",
+			labels(), nil),
+		BackupProgressCompressedSize: prometheus.NewDesc(
+			"borg_backup_progress_compressed_size_bytes",
+			"Compressed size of the data processed by the backup in progress in bytes",
+			labels(), nil),
+		BackupProgressDeduplicatedSize: prometheus.NewDesc(
+			"borg_backup_progress_deduplicated_size_bytes",
+			"Deduplicated size of the data processed by the backup in progress in bytes",
+			labels(), nil),
+		BackupProgressFiles: prometheus.NewDesc(
+			"borg_backup_progress_files",
+			"Number of files processed by the backup in progress",
+			labels(), nil),
+		BackupProgressElapsed: prometheus.NewDesc(
+			"borg_backup_progress_elapsed_seconds",
+			"Time elapsed since the start of the backup in progress in seconds",
+			labels(), nil),
+		LastBackupExitCode: prometheus.NewDesc(
+			"borg_last_backup_exit_code",
+			"Exit code of the last borg create run by the wrap command",
+			labels(), nil),
+		LastBackupWarnings: prometheus.NewDesc(
+			"borg_last_backup_warnings",
+			"Number of warnings logged by the last borg create run by the wrap command",
+			labels(), nil),
+
+		// retention metrics
+		RetentionBuckets: prometheus.NewDesc(
+			"borg_retention_buckets",
+			"Number of periods expected to contain an archive by the retention policy",
+			labels("rule"), nil),
+		RetentionMissingBuckets: prometheus.NewDesc(
+			"borg_retention_missing_buckets",
+			"Number of periods expected by the retention policy without archive",
+			labels("rule"), nil),
+		RetentionOldestArchiveAge: prometheus.NewDesc(
+			"borg_retention_oldest_archive_age_seconds",
+			"Age of the oldest archive selected by the retention policy in seconds",
+			labels(), nil),
+
+		// check metrics
+		CheckLastTimestamp: prometheus.NewDesc(
+			"borg_check_last_timestamp",
+			"Timestamp of the last borg check",
+			labels(), nil),
+		CheckDuration: prometheus.NewDesc(
+			"borg_check_duration_seconds",
+			"Duration of the last borg check in seconds",
+			labels(), nil),
+		CheckSuccess: prometheus.NewDesc(
+			"borg_check_success",
+			"1 if the last borg check succeeded, 0 if it failed",
+			labels(), nil),
+		CheckProblems: prometheus.NewDesc(
+			"borg_check_problems",
+			"Number of problems reported by the last borg check",
+			labels(), nil),
 
 		// Exporter collection metrics
-		CollectErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Name: "borg_collect_errors",
-			Help: "Number of errors encountered by borg exporter",
-		}, []string{"repository"}),
-		LastCollectError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_last_collect_error",
-			Help: "1 if the last collection failed, 0 if successful",
-		}, []string{"repository"}),
-		LastCollectDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_last_collect_duration_seconds",
-			Help: "Duration of the last metrics collection",
-		}, []string{"repository"}),
-		LastCollectTimestamp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: "borg_last_collect_timestamp",
-			Help: "Timestamp of the last metrics collection",
-		}, []string{"repository"}),
+		CollectErrors: prometheus.NewDesc(
+			"borg_collect_errors",
+			"Number of errors encountered by borg exporter, by reason",
+			labels("reason"), nil),
+		CollectTimeouts: prometheus.NewDesc(
+			"borg_collect_timeouts_total",
+			"Number of borg commands killed after reaching their timeout during the metrics collection",
+			labels(), nil),
+		CollectSkipped: prometheus.NewDesc(
+			"borg_collect_skipped_total",
+			"Number of collections skipped as the repository was locked by borg check, keeping the previous metrics",
+			labels(), nil),
+		LastCollectError: prometheus.NewDesc(
+			"borg_last_collect_error",
+			"1 if the last collection failed, 0 if successful, with the reason of the failure",
+			labels("reason"), nil),
+		LogMessages: prometheus.NewDesc(
+			"borg_log_messages_total",
+			"Number of messages logged by borg, by level (warning or error)",
+			labels("level"), nil),
+		LastCollectDuration: prometheus.NewDesc(
+			"borg_last_collect_duration_seconds",
+			"Duration of the last metrics collection",
+			labels(), nil),
+		LastCollectTimestamp: prometheus.NewDesc(
+			"borg_last_collect_timestamp",
+			"Timestamp of the last metrics collection",
+			labels(), nil),
+		LastCollectSuccessTimestamp: prometheus.NewDesc(
+			"borg_last_collect_success_timestamp",
+			"Timestamp of the last successful metrics collection",
+			labels(), nil),
+		MetricsStale: prometheus.NewDesc(
+			"borg_metrics_stale",
+			"1 if the last collection failed and the metrics come from a previous collection, 0 otherwise",
+			labels(), nil),
 
 		// Info metrics
-		LastArchiveInfo: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "borg_last_archive_info",
-				Help: "Information about the last backup archive",
-			},
-			[]string{"repository", "comment", "start_time", "end_time", "hostname", "id", "name", "username"},
-		),
-
-		RepositoryInfo: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "borg_repository_info",
-				Help: "Information about the backup repository",
-			},
-			[]string{"repository", "id", "last_modified", "location"},
-		),
-
-		SystemInfo: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "borg_system_info",
-				Help: "Information about the borg backup system",
-			},
-			[]string{"hostname", "borg_version"},
-		),
-	}
-
-	// Set static system info
-	m.SystemInfo.WithLabelValues(
-		hostname,
-		borgVersion,
-	).Set(1)
+		LastArchiveInfo: prometheus.NewDesc(
+			"borg_last_archive_info",
+			"Information about the last backup archive",
+			labels("comment", "start_time", "end_time", "hostname", "id", "name", "username"), nil),
+		LastArchiveSettingsInfo: prometheus.NewDesc(
+			"borg_last_archive_settings_info",
+			"Chunker parameters and compression of the last backup archive",
+			labels("chunker_params", "compression"), nil),
+		RepositoryInfo: prometheus.NewDesc(
+			"borg_repository_info",
+			"Information about the backup repository",
+			labels("id", "last_modified", "location"), nil),
+		EncryptionInfo: prometheus.NewDesc(
+			"borg_repository_encryption_info",
+			"Encryption mode and key type of the backup repository",
+			labels("mode", "key_type"), nil),
+		EncryptionInsecure: prometheus.NewDesc(
+			"borg_repository_encryption_insecure",
+			"1 if the encryption mode of the repository doesn't meet the encryption policy, 0 otherwise",
+			labels(), nil),
+		SystemInfo: prometheus.NewDesc(
+			"borg_system_info",
+			"Information about the borg backup system",
+			[]string{"hostname", "borg_version"}, nil),
+
+		ArchiveMetrics:     true,
+		ArchiveSeriesLimit: 30,
+		Now:                time.Now,
+
+		extraLabels: extraLabels,
+		hostname:    hostname,
+		borgVersion: borgVersion,
+	}
 
 	return m
 }
 
-// Register registers the metrics to the prometheus registry
-func (m *BorgMetrics) Register(registry *prometheus.Registry) {
+// Describe sends the descriptors of all the metrics
+func (m *BorgMetrics) Describe(ch chan<- *prometheus.Desc) {
 	// archive metrics
-	registry.MustRegister(m.LastBackupDuration)
-	registry.MustRegister(m.LastBackupCompressedSize)
-	registry.MustRegister(m.LastBackupDeduplicatedSize)
-	registry.MustRegister(m.LastBackupFiles)
-	registry.MustRegister(m.LastBackupOriginalSize)
-	registry.MustRegister(m.LastBackupTimestamp)
+	ch <- m.LastBackupDuration
+	ch <- m.LastBackupCompressedSize
+	ch <- m.LastBackupDeduplicatedSize
+	ch <- m.LastBackupFiles
+	ch <- m.LastBackupOriginalSize
+	ch <- m.LastBackupTimestamp
+	ch <- m.LastBackupMaxSizeRatio
+
+	// archives metrics
+	ch <- m.ArchiveCount
+	ch <- m.OldestArchiveTimestamp
+	ch <- m.NewestArchiveTimestamp
+	ch <- m.ArchiveStartTimestamp
+	ch <- m.ArchiveDuration
 
 	// repository metrics
-	registry.MustRegister(m.TotalChunks)
-	registry.MustRegister(m.TotalCompressedSize)
-	registry.MustRegister(m.TotalSize)
-	registry.MustRegister(m.TotalUniqueChunks)
-	registry.MustRegister(m.DeduplicatedCompressedSize)
-	registry.MustRegister(m.DeduplicatedSize)
+	ch <- m.TotalChunks
+	ch <- m.TotalCompressedSize
+	ch <- m.TotalSize
+	ch <- m.TotalUniqueChunks
+	ch <- m.DeduplicatedCompressedSize
+	ch <- m.DeduplicatedSize
+
+	// capacity metrics
+	ch <- m.FilesystemSize
+	ch <- m.FilesystemFree
+	ch <- m.FilesystemAvailable
+	ch <- m.StorageQuota
+	ch <- m.DaysUntilFull
+
+	// freshness metrics
+	ch <- m.BackupAge
+	ch <- m.BackupExpectedMaxAge
+	ch <- m.BackupStale
+
+	// backup metrics
+	ch <- m.BackupInProgress
+	ch <- m.BackupProgressOriginalSize
+	ch <- m.BackupProgressCompressedSize
+	ch <- m.BackupProgressDeduplicatedSize
+	ch <- m.BackupProgressFiles
+	ch <- m.BackupProgressElapsed
+	ch <- m.LastBackupExitCode
+	ch <- m.LastBackupWarnings
+
+	// retention metrics
+	ch <- m.RetentionBuckets
+	ch <- m.RetentionMissingBuckets
+	ch <- m.RetentionOldestArchiveAge
+
+	// check metrics
+	ch <- m.CheckLastTimestamp
+	ch <- m.CheckDuration
+	ch <- m.CheckSuccess
+	ch <- m.CheckProblems
 
 	// exporter collection metrics
-	registry.MustRegister(m.CollectErrors)
-	registry.MustRegister(m.LastCollectError)
-	registry.MustRegister(m.LastCollectDuration)
-	registry.MustRegister(m.LastCollectTimestamp)
+	ch <- m.CollectErrors
+	ch <- m.CollectTimeouts
+	ch <- m.CollectSkipped
+	ch <- m.LastCollectError
+	ch <- m.LogMessages
+	ch <- m.LastCollectDuration
+	ch <- m.LastCollectTimestamp
+	ch <- m.LastCollectSuccessTimestamp
+	ch <- m.MetricsStale
 
 	// info metrics
-	registry.MustRegister(m.LastArchiveInfo)
-	registry.MustRegister(m.RepositoryInfo)
-	registry.MustRegister(m.SystemInfo)
+	ch <- m.LastArchiveInfo
+	ch <- m.LastArchiveSettingsInfo
+	ch <- m.RepositoryInfo
+	ch <- m.EncryptionInfo
+	ch <- m.EncryptionInsecure
+	ch <- m.SystemInfo
+}
+
+// Collect renders the metrics of the exporter and of the given repository snapshots
+func (m *BorgMetrics) Collect(ch chan<- prometheus.Metric, snapshots []*RepositorySnapshot) {
+	m.collectGlobal(ch)
+	for _, snapshot := range snapshots {
+		m.collectRepository(ch, snapshot)
+	}
+}
+
+// collectGlobal renders the metrics which are not related to a repository
+func (m *BorgMetrics) collectGlobal(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(m.SystemInfo, prometheus.GaugeValue, 1, m.hostname, m.borgVersion)
+}
+
+// collectRepository renders the metrics of a repository snapshot
+func (m *BorgMetrics) collectRepository(ch chan<- prometheus.Metric, s *RepositorySnapshot) {
+	labelValues := func(values ...string) []string {
+		labelValues := []string{s.Repository}
+		for _, label := range m.extraLabels {
+			labelValues = append(labelValues, s.Labels[label])
+		}
+		return append(labelValues, values...)
+	}
+	gauge := func(desc *prometheus.Desc, value float64, values ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelValues(values...)...)
+	}
+	counter := func(desc *prometheus.Desc, value float64, values ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labelValues(values...)...)
+	}
+
+	// Exporter collection metrics
+	reasons := make([]string, 0, len(s.CollectErrors))
+	for reason := range s.CollectErrors {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		counter(m.CollectErrors, s.CollectErrors[reason], reason)
+	}
+	counter(m.CollectTimeouts, s.CollectTimeouts)
+	counter(m.CollectSkipped, s.CollectSkipped)
+	counter(m.LogMessages, s.LogWarnings, "warning")
+	counter(m.LogMessages, s.LogErrors, "error")
+	if !s.LastCollectTimestamp.IsZero() {
+		gauge(m.LastCollectError, boolToFloat(s.LastCollectError), s.LastCollectErrorReason)
+		gauge(m.LastCollectDuration, s.LastCollectDuration.Seconds())
+		gauge(m.LastCollectTimestamp, float64(s.LastCollectTimestamp.Unix()))
+	}
+
+	// Check metrics
+	if s.Check != nil {
+		gauge(m.CheckLastTimestamp, float64(s.Check.Timestamp.Unix()))
+		gauge(m.CheckDuration, s.Check.Duration.Seconds())
+		gauge(m.CheckSuccess, boolToFloat(s.Check.Success))
+		gauge(m.CheckProblems, float64(s.Check.Problems))
+	}
+
+	// Backup metrics, the progress is only rendered while the backup is in progress
+	now := m.Now()
+	if s.Backup != nil {
+		inProgress := s.Backup.InProgress(now)
+		gauge(m.BackupInProgress, boolToFloat(inProgress))
+		if inProgress {
+			gauge(m.BackupProgressOriginalSize, s.Backup.OriginalSize)
+			gauge(m.BackupProgressCompressedSize, s.Backup.CompressedSize)
+			gauge(m.BackupProgressDeduplicatedSize, s.Backup.DeduplicatedSize)
+			gauge(m.BackupProgressFiles, s.Backup.Files)
+			gauge(m.BackupProgressElapsed, now.Sub(s.Backup.Start).Seconds())
+		}
+		if !s.Backup.LastEnd.IsZero() {
+			gauge(m.LastBackupExitCode, float64(s.Backup.LastExitCode))
+			gauge(m.LastBackupWarnings, float64(s.Backup.LastWarnings))
+		}
+	}
+
+	// The remaining metrics are only available after a successful collection,
+	// or once the wrap command reported a created archive
+	if s.Info == nil {
+		return
+	}
+	info := s.Info
+
+	if !s.LastCollectSuccessTimestamp.IsZero() {
+		gauge(m.LastCollectSuccessTimestamp, float64(s.LastCollectSuccessTimestamp.Unix()))
+	}
+	gauge(m.MetricsStale, boolToFloat(s.Stale()))
+
+	// Freshness metrics, computed at scrape time so that they change between two collections
+	var lastBackup time.Time
+	if len(info.Archives) > 0 {
+		lastBackup = info.Archives[len(info.Archives)-1].Start.Time
+		gauge(m.BackupAge, now.Sub(lastBackup).Seconds())
+	}
+	if s.Freshness != nil {
+		gauge(m.BackupExpectedMaxAge, s.Freshness.ExpectedMaxAge(now).Seconds())
+		gauge(m.BackupStale, boolToFloat(s.Freshness.Stale(lastBackup, now)))
+	}
+
+	if len(info.Archives) > 0 {
+		// Archive metrics
+		latest := info.Archives[len(info.Archives)-1]
+
+		gauge(m.LastBackupDuration, latest.Duration)
+		gauge(m.LastBackupCompressedSize, float64(latest.Stats.CompressedSize))
+		gauge(m.LastBackupDeduplicatedSize, float64(latest.Stats.DeduplicatedSize))
+		gauge(m.LastBackupFiles, float64(latest.Stats.NFiles))
+		gauge(m.LastBackupOriginalSize, float64(latest.Stats.OriginalSize))
+		gauge(m.LastBackupTimestamp, float64(latest.Start.Unix()))
+
+		// Last archive info metric
+		gauge(m.LastArchiveInfo, 1,
+			latest.Comment,
+			latest.Start.Format(time.RFC3339),
+			latest.End.Format(time.RFC3339),
+			latest.Hostname,
+			latest.ID,
+			latest.Name,
+			latest.Username,
+		)
+		gauge(m.LastArchiveSettingsInfo, 1, latest.ChunkerParams.String(), latest.Compression())
+		// Borg 2 doesn't limit the archive size anymore
+		if latest.Limits.MaxArchiveSize != nil {
+			gauge(m.LastBackupMaxSizeRatio, *latest.Limits.MaxArchiveSize)
+		}
+	}
+
+	// Repository metrics
+	gauge(m.TotalChunks, float64(info.Cache.Stats.TotalChunks))
+	gauge(m.TotalCompressedSize, float64(info.Cache.Stats.TotalCompressedSize))
+	gauge(m.TotalSize, float64(info.Cache.Stats.TotalSize))
+	gauge(m.TotalUniqueChunks, float64(info.Cache.Stats.TotalUniqueChunks))
+	gauge(m.DeduplicatedCompressedSize, float64(info.Cache.Stats.DeduplicatedCompressedSize))
+	gauge(m.DeduplicatedSize, float64(info.Cache.Stats.DeduplicatedSize))
+
+	// Capacity metrics
+	if s.Filesystem != nil {
+		gauge(m.FilesystemSize, s.Filesystem.Size)
+		gauge(m.FilesystemFree, s.Filesystem.Free)
+		gauge(m.FilesystemAvailable, s.Filesystem.Available)
+	}
+	if s.StorageQuota > 0 {
+		gauge(m.StorageQuota, s.StorageQuota)
+	}
+	if days, ok := s.DaysUntilFull(); ok {
+		gauge(m.DaysUntilFull, days)
+	}
+
+	// Repository info metric
+	gauge(m.RepositoryInfo, 1,
+		info.Repository.ID,
+		info.Repository.LastModified.Format(time.RFC3339),
+		info.Repository.Location,
+	)
+	gauge(m.EncryptionInfo, 1, info.Encryption.Mode, info.Encryption.KeyType())
+	if s.Encryption != "" {
+		gauge(m.EncryptionInsecure, boolToFloat(s.Encryption.Insecure(info.Encryption.Mode)))
+	}
+
+	// Archives metrics
+	if s.List != nil {
+		archives := s.List.Archives
+		if m.ArchiveMetrics {
+			gauge(m.ArchiveCount, float64(len(archives)))
+			if len(archives) > 0 {
+				gauge(m.OldestArchiveTimestamp, float64(archives[0].Start.Unix()))
+				gauge(m.NewestArchiveTimestamp, float64(archives[len(archives)-1].Start.Unix()))
+			}
+
+			// Only the most recent archives are exposed as labeled series.
+			// Borg 2.x allows several archives with the same name, in which case only the newest one is exposed.
+			seen := map[string]bool{}
+			for i := len(archives) - 1; i >= 0 && len(seen) < m.ArchiveSeriesLimit; i-- {
+				archive := archives[i]
+				if seen[archive.Name] {
+					continue
+				}
+				seen[archive.Name] = true
+				gauge(m.ArchiveStartTimestamp, float64(archive.Start.Unix()), archive.Name)
+				gauge(m.ArchiveDuration, archive.Duration(), archive.Name)
+			}
+		}
+
+		// Retention metrics
+		if s.Retention != nil {
+			for _, buckets := range s.Retention.Buckets(archives, now) {
+				gauge(m.RetentionBuckets, float64(buckets.Keep), buckets.Rule)
+				gauge(m.RetentionMissingBuckets, float64(buckets.Missing), buckets.Rule)
+			}
+			if selected := s.Retention.Archives(archives); len(selected) > 0 {
+				gauge(m.RetentionOldestArchiveAge, now.Sub(selected[0].Start.Time).Seconds())
+			}
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
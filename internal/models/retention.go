@@ -0,0 +1,163 @@
+package models
+
+import (
+	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"path"
+	"time"
+)
+
+// RetentionPolicy is the keep policy of borg prune expected for a repository
+type RetentionPolicy struct {
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	// Glob only selects the archives whose name matches, as the --glob-archives option of borg prune
+	Glob string
+}
+
+// RetentionBuckets is the coverage of the periods of a retention rule
+type RetentionBuckets struct {
+	// Rule is daily, weekly, monthly or yearly
+	Rule string
+	// Keep is the number of periods expected to contain an archive
+	Keep int
+	// Missing is the number of expected periods without archive
+	Missing int
+}
+
+// retentionRule defines the periods of a retention rule
+type retentionRule struct {
+	name string
+	// start returns the start of the period containing the given time
+	start func(t time.Time) time.Time
+	// previous returns the start of the period before the period starting at the given time
+	previous func(start time.Time) time.Time
+}
+
+var retentionRules = []retentionRule{
+	{
+		name: "daily",
+		start: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		},
+		previous: func(start time.Time) time.Time { return start.AddDate(0, 0, -1) },
+	},
+	{
+		name: "weekly",
+		start: func(t time.Time) time.Time {
+			// ISO weeks start on monday, as the weekly rule of borg prune
+			daysSinceMonday := (int(t.Weekday()) + 6) % 7
+			return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, t.Location())
+		},
+		previous: func(start time.Time) time.Time { return start.AddDate(0, 0, -7) },
+	},
+	{
+		name: "monthly",
+		start: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		},
+		previous: func(start time.Time) time.Time { return start.AddDate(0, -1, 0) },
+	},
+	{
+		name: "yearly",
+		start: func(t time.Time) time.Time {
+			return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+		},
+		previous: func(start time.Time) time.Time { return start.AddDate(-1, 0, 0) },
+	},
+}
+
+// keep returns the number of periods to keep for the given rule
+func (p *RetentionPolicy) keep(rule string) int {
+	switch rule {
+	case "daily":
+		return p.KeepDaily
+	case "weekly":
+		return p.KeepWeekly
+	case "monthly":
+		return p.KeepMonthly
+	case "yearly":
+		return p.KeepYearly
+	default:
+		return 0
+	}
+}
+
+// Validate returns an error when the policy doesn't keep anything or its glob is invalid
+func (p *RetentionPolicy) Validate() error {
+	if p.KeepDaily < 0 || p.KeepWeekly < 0 || p.KeepMonthly < 0 || p.KeepYearly < 0 {
+		return fmt.Errorf("the number of archives to keep cannot be negative")
+	}
+	if p.KeepDaily+p.KeepWeekly+p.KeepMonthly+p.KeepYearly == 0 {
+		return fmt.Errorf("the retention policy doesn't keep any archive")
+	}
+	if _, err := path.Match(p.Glob, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %w", p.Glob, err)
+	}
+	return nil
+}
+
+// Archives returns the archives selected by the glob of the policy
+func (p *RetentionPolicy) Archives(archives []parser.ListOutputArchive) []parser.ListOutputArchive {
+	if p.Glob == "" {
+		return archives
+	}
+	var selected []parser.ListOutputArchive
+	for _, archive := range archives {
+		if matched, _ := path.Match(p.Glob, archive.Name); matched {
+			selected = append(selected, archive)
+		}
+	}
+	return selected
+}
+
+// Buckets returns the coverage of each rule of the policy by the given archives.
+// As borg prune, the rules cascade from daily to yearly: a period whose newest archive is already kept by a previous
+// rule doesn't count, so that each rule expects its Keep periods before the ones of the previous rules.
+// A period without archive is expected to contain a backup at its end, which is kept by the rule counting it as missing.
+// As the backup of the current period may not have run yet, the current period is skipped when it doesn't contain an archive.
+func (p *RetentionPolicy) Buckets(archives []parser.ListOutputArchive, now time.Time) []RetentionBuckets {
+	archives = p.Archives(archives)
+	// kept holds the times of the archives kept by the previous rules, including the expected ones of the missing periods
+	kept := map[time.Time]bool{}
+	var buckets []RetentionBuckets
+	for _, rule := range retentionRules {
+		keep := p.keep(rule.name)
+		if keep == 0 {
+			continue
+		}
+
+		newest := map[time.Time]time.Time{}
+		for _, archive := range archives {
+			start := archive.Start.In(now.Location())
+			period := rule.start(start)
+			if last, ok := newest[period]; !ok || start.After(last) {
+				newest[period] = start
+			}
+		}
+		current := rule.start(now)
+		counted, missing := 0, 0
+		// end is the start of the period following the examined one
+		for period, end := current, now; counted < keep; period, end = rule.previous(period), period {
+			last, ok := newest[period]
+			if !ok {
+				if period.Equal(current) {
+					continue
+				}
+				last = end.Add(-time.Nanosecond)
+			}
+			if kept[last] {
+				continue
+			}
+			kept[last] = true
+			counted++
+			if !ok {
+				missing++
+			}
+		}
+		buckets = append(buckets, RetentionBuckets{Rule: rule.name, Keep: keep, Missing: missing})
+	}
+	return buckets
+}
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dailyArchives returns one archive per day, from the given number of days ago until the given end
+func dailyArchives(name string, end time.Time, days int) []parser.ListOutputArchive {
+	var archives []parser.ListOutputArchive
+	for i := days - 1; i >= 0; i-- {
+		archives = append(archives, parser.ListOutputArchive{
+			Name:  name + "-" + end.AddDate(0, 0, -i).Format("2006-01-02"),
+			Start: parser.BorgTime{Time: end.AddDate(0, 0, -i)},
+		})
+	}
+	return archives
+}
+
+func TestRetentionPolicy_Buckets(t *testing.T) {
+	// Tuesday
+	now := time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC)
+	policy := &RetentionPolicy{KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 6, Glob: "laptop-*"}
+
+	tests := []struct {
+		name     string
+		archives []parser.ListOutputArchive
+		want     []RetentionBuckets
+	}{
+		{
+			name:     "compliant",
+			archives: dailyArchives("laptop", now.Add(-8*time.Hour), 200),
+			want: []RetentionBuckets{
+				{Rule: "daily", Keep: 7},
+				{Rule: "weekly", Keep: 4},
+				{Rule: "monthly", Keep: 6},
+			},
+		},
+		{
+			name: "backup of the current period not run yet",
+			// the last backup ran yesterday
+			archives: dailyArchives("laptop", now.AddDate(0, 0, -1), 200),
+			want: []RetentionBuckets{
+				{Rule: "daily", Keep: 7},
+				{Rule: "weekly", Keep: 4},
+				{Rule: "monthly", Keep: 6},
+			},
+		},
+		{
+			name: "backups stopped 3 days ago",
+			// tuesday, the current week still contains the archive of monday
+			archives: dailyArchives("laptop", now.AddDate(0, 0, -3), 200),
+			want: []RetentionBuckets{
+				{Rule: "daily", Keep: 7, Missing: 2},
+				{Rule: "weekly", Keep: 4},
+				{Rule: "monthly", Keep: 6},
+			},
+		},
+		{
+			name: "prune keeping only the last days",
+			archives: append(dailyArchives("laptop", now, 10),
+				// not selected by the glob
+				dailyArchives("server", now.AddDate(0, 0, -10), 200)...),
+			// the weeks and the month of the last days are already kept by the daily rule
+			want: []RetentionBuckets{
+				{Rule: "daily", Keep: 7},
+				{Rule: "weekly", Keep: 4, Missing: 3},
+				{Rule: "monthly", Keep: 6, Missing: 6},
+			},
+		},
+		{
+			name: "no archive",
+			want: []RetentionBuckets{
+				{Rule: "daily", Keep: 7, Missing: 7},
+				{Rule: "weekly", Keep: 4, Missing: 4},
+				{Rule: "monthly", Keep: 6, Missing: 6},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policy.Buckets(tt.archives, now)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRetentionPolicy_BucketsCascade(t *testing.T) {
+	// Tuesday
+	now := time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC)
+	policy := &RetentionPolicy{KeepDaily: 7, KeepWeekly: 2}
+
+	tests := []struct {
+		name     string
+		archives []parser.ListOutputArchive
+		want     []RetentionBuckets
+	}{
+		{
+			// the daily rule keeps the archives of the current and previous weeks,
+			// so the weekly rule expects the two weeks before them
+			name:     "weeks kept by the daily rule",
+			archives: dailyArchives("laptop", now, 21),
+			want: []RetentionBuckets{
+				{Rule: "daily", Keep: 7},
+				{Rule: "weekly", Keep: 2},
+			},
+		},
+		{
+			name:     "weeks before the daily rule missing",
+			archives: dailyArchives("laptop", now, 14),
+			want: []RetentionBuckets{
+				{Rule: "daily", Keep: 7},
+				{Rule: "weekly", Keep: 2, Missing: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policy.Buckets(tt.archives, now)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRetentionPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		wantErr bool
+	}{
+		{name: "valid", policy: RetentionPolicy{KeepDaily: 7, Glob: "laptop-*"}},
+		{name: "nothing kept", policy: RetentionPolicy{}, wantErr: true},
+		{name: "negative", policy: RetentionPolicy{KeepDaily: 7, KeepWeekly: -1}, wantErr: true},
+		{name: "invalid glob", policy: RetentionPolicy{KeepDaily: 7, Glob: "laptop-["}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestMetricsCache_CollectRetention(t *testing.T) {
+	cache := newTestCache()
+	now := time.Date(2024, 10, 29, 12, 0, 0, 0, time.UTC)
+	cache.Metrics.Now = func() time.Time { return now }
+	// The archives are only listed for the retention check
+	cache.Metrics.ArchiveMetrics = false
+
+	snapshot := cache.Repository("laptop", map[string]string{"team": "infra"})
+	snapshot.Retention = &RetentionPolicy{KeepDaily: 7, KeepWeekly: 4}
+	snapshot.Info = &parser.InfoOutput{}
+	snapshot.List = &parser.ListOutput{Archives: dailyArchives("laptop", now, 10)}
+
+	expected := `
+# HELP borg_retention_missing_buckets Number of periods expected by the retention policy without archive
+# TYPE borg_retention_missing_buckets gauge
+borg_retention_missing_buckets{repository="laptop",rule="daily",team="infra"} 0
+borg_retention_missing_buckets{repository="laptop",rule="weekly",team="infra"} 3
+# HELP borg_retention_oldest_archive_age_seconds Age of the oldest archive selected by the retention policy in seconds
+# TYPE borg_retention_oldest_archive_age_seconds gauge
+borg_retention_oldest_archive_age_seconds{repository="laptop",team="infra"} 777600
+`
+	err := testutil.CollectAndCompare(cache, strings.NewReader(expected),
+		"borg_retention_missing_buckets", "borg_retention_oldest_archive_age_seconds",
+		"borg_archives", "borg_archive_start_timestamp", "borg_archive_duration_seconds")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateVersion is the version of the state file format, incremented on incompatible changes
+const stateVersion = 1
+
+// state is the content of the state file
+type state struct {
+	Version      int               `json:"version"`
+	Repositories []repositoryState `json:"repositories"`
+}
+
+// repositoryState holds the persisted data of a RepositorySnapshot.
+// The labels and the policies come from the configuration, so they are not persisted.
+type repositoryState struct {
+	Repository                  string              `json:"repository"`
+	Info                        *parser.InfoOutput  `json:"info,omitempty"`
+	List                        *parser.ListOutput  `json:"list,omitempty"`
+	LastCollectTimestamp        time.Time           `json:"last_collect_timestamp"`
+	LastCollectDuration         time.Duration       `json:"last_collect_duration"`
+	LastCollectSuccessTimestamp time.Time           `json:"last_collect_success_timestamp"`
+	LastCollectError            bool                `json:"last_collect_error"`
+	LastCollectErrorReason      string              `json:"last_collect_error_reason,omitempty"`
+	CollectErrors               map[string]float64  `json:"collect_errors,omitempty"`
+	CollectTimeouts             float64             `json:"collect_timeouts"`
+	CollectSkipped              float64             `json:"collect_skipped,omitempty"`
+	Check                       *CheckSnapshot      `json:"check,omitempty"`
+	Filesystem                  *FilesystemSnapshot `json:"filesystem,omitempty"`
+	StorageQuota                float64             `json:"storage_quota,omitempty"`
+	SizeHistory                 []SizeSample        `json:"size_history,omitempty"`
+	Backup                      *BackupSnapshot     `json:"backup,omitempty"`
+}
+
+// SaveState writes the snapshots to the given file.
+// The file is written to a temporary file in the same directory then renamed,
+// so that a crash never leaves a partially written state file.
+func (c *MetricsCache) SaveState(path string) error {
+	c.RLock()
+	content := state{Version: stateVersion}
+	for _, snapshot := range c.Repositories {
+		content.Repositories = append(content.Repositories, repositoryState{
+			Repository:                  snapshot.Repository,
+			Info:                        snapshot.Info,
+			List:                        snapshot.List,
+			LastCollectTimestamp:        snapshot.LastCollectTimestamp,
+			LastCollectDuration:         snapshot.LastCollectDuration,
+			LastCollectSuccessTimestamp: snapshot.LastCollectSuccessTimestamp,
+			LastCollectError:            snapshot.LastCollectError,
+			LastCollectErrorReason:      snapshot.LastCollectErrorReason,
+			CollectErrors:               snapshot.CollectErrors,
+			CollectTimeouts:             snapshot.CollectTimeouts,
+			CollectSkipped:              snapshot.CollectSkipped,
+			Check:                       snapshot.Check,
+			Filesystem:                  snapshot.Filesystem,
+			StorageQuota:                snapshot.StorageQuota,
+			SizeHistory:                 snapshot.SizeHistory,
+			Backup:                      snapshot.Backup,
+		})
+	}
+	data, err := json.Marshal(content)
+	c.RUnlock()
+	if err != nil {
+		return fmt.Errorf("cannot encode the state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("cannot create the state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write the state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot write the state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("cannot write the state file: %w", err)
+	}
+	return nil
+}
+
+// LoadState restores the snapshots saved in the given file, keeping their original collection timestamps.
+// A missing file is not an error, as it is expected on the first start.
+// The caller is expected to set the labels and policies of the restored snapshots, see Repository.
+func (c *MetricsCache) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read the state file: %w", err)
+	}
+	var content state
+	if err := json.Unmarshal(data, &content); err != nil {
+		return fmt.Errorf("cannot decode the state file: %w", err)
+	}
+	if content.Version != stateVersion {
+		return fmt.Errorf("unsupported state file version %d", content.Version)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for _, saved := range content.Repositories {
+		c.Repositories[saved.Repository] = &RepositorySnapshot{
+			Repository:                  saved.Repository,
+			Info:                        saved.Info,
+			List:                        saved.List,
+			LastCollectTimestamp:        saved.LastCollectTimestamp,
+			LastCollectDuration:         saved.LastCollectDuration,
+			LastCollectSuccessTimestamp: saved.LastCollectSuccessTimestamp,
+			LastCollectError:            saved.LastCollectError,
+			LastCollectErrorReason:      saved.LastCollectErrorReason,
+			CollectErrors:               saved.CollectErrors,
+			CollectTimeouts:             saved.CollectTimeouts,
+			CollectSkipped:              saved.CollectSkipped,
+			Check:                       saved.Check,
+			Filesystem:                  saved.Filesystem,
+			StorageQuota:                saved.StorageQuota,
+			SizeHistory:                 saved.SizeHistory,
+			Backup:                      saved.Backup,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetricsCache_SaveLoadState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	cache := newTestCache()
+	snapshot := cache.Repository("laptop", map[string]string{"team": "infra"})
+	snapshot.Freshness = &FreshnessPolicy{MaxAge: 26 * time.Hour}
+	snapshot.LastCollectTimestamp = time.Unix(1730200000, 0).UTC()
+	snapshot.LastCollectSuccessTimestamp = time.Unix(1730100000, 0).UTC()
+	snapshot.LastCollectDuration = 3 * time.Second
+	snapshot.LastCollectError = true
+	snapshot.CollectErrors = map[string]float64{"lock_timeout": 2}
+	snapshot.LastCollectErrorReason = "lock_timeout"
+	snapshot.Info = &parser.InfoOutput{
+		Archives: []parser.InfoOutputArchive{
+			// borg 1.x timestamps have no time zone
+			{Name: "laptop-3", Start: mustParseBorgTime(t, "2024-10-28T20:37:04.000000"), Stats: parser.InfoOutputArchiveStats{NFiles: 42}},
+		},
+	}
+	snapshot.List = &parser.ListOutput{
+		Archives: []parser.ListOutputArchive{
+			{Name: "laptop-3", Start: mustParseBorgTime(t, "2024-10-28T20:37:04+02:00")},
+		},
+	}
+	snapshot.Check = &CheckSnapshot{Timestamp: time.Unix(1730000000, 0).UTC(), Duration: time.Hour, Problems: 1}
+	snapshot.Filesystem = &FilesystemSnapshot{Size: 1000, Free: 300, Available: 200}
+	snapshot.StorageQuota = 800
+	snapshot.SizeHistory = []SizeSample{
+		{Timestamp: time.Unix(1730000000, 0).UTC(), Size: 100},
+		{Timestamp: time.Unix(1730100000, 0).UTC(), Size: 110},
+	}
+	snapshot.Backup = &BackupSnapshot{
+		Start:        time.Unix(1730167200, 0).UTC(),
+		Updated:      time.Unix(1730167500, 0).UTC(),
+		Files:        12,
+		LastEnd:      time.Unix(1730167512, 0).UTC(),
+		LastExitCode: 1,
+		LastWarnings: 3,
+	}
+
+	if err := cache.SaveState(path); err != nil {
+		t.Fatalf("Failed to save the state: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the state file, got %v", entries)
+	}
+
+	restored := newTestCache()
+	if err := restored.LoadState(path); err != nil {
+		t.Fatalf("Failed to load the state: %v", err)
+	}
+	got, ok := restored.Repositories["laptop"]
+	if !ok {
+		t.Fatalf("Expected the laptop repository to be restored, got %v", restored.Repositories)
+	}
+	if got.Labels != nil || got.Freshness != nil {
+		t.Errorf("Expected the configuration not to be persisted, got labels %v and freshness %v", got.Labels, got.Freshness)
+	}
+	got.Labels, got.Freshness = snapshot.Labels, snapshot.Freshness
+	// The times are compared with Equal, as the restored ones have no monotonic clock and may have another location
+	if !got.Info.Archives[0].Start.Equal(snapshot.Info.Archives[0].Start.Time) || !got.List.Archives[0].Start.Equal(snapshot.List.Archives[0].Start.Time) {
+		t.Errorf("Expected the archive times to be restored, got %v and %v", got.Info.Archives[0].Start, got.List.Archives[0].Start)
+	}
+	got.Info.Archives[0].Start, got.List.Archives[0].Start = snapshot.Info.Archives[0].Start, snapshot.List.Archives[0].Start
+	if !reflect.DeepEqual(got, snapshot) {
+		t.Errorf("Expected %+v, got %+v", snapshot, got)
+	}
+}
+
+func TestMetricsCache_LoadState(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	unsupported := filepath.Join(dir, "unsupported.json")
+	if err := os.WriteFile(unsupported, []byte(`{"version": 99}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "missing file", path: filepath.Join(dir, "missing.json")},
+		{name: "invalid file", path: invalid, wantErr: true},
+		{name: "unsupported version", path: unsupported, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newTestCache()
+			if err := cache.LoadState(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if len(cache.Repositories) != 0 {
+				t.Errorf("Expected no repository, got %v", cache.Repositories)
+			}
+		})
+	}
+}
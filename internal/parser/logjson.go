@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Log levels of the borg log records
+const (
+	LevelDebug    = "DEBUG"
+	LevelInfo     = "INFO"
+	LevelWarning  = "WARNING"
+	LevelError    = "ERROR"
+	LevelCritical = "CRITICAL"
+)
+
+// LogRecord is a log message written by borg on its standard error with --log-json
+type LogRecord struct {
+	// Time is the unix timestamp of the record
+	Time float64 `json:"time"`
+	// Level is the level name, such as WARNING or ERROR
+	Level string `json:"levelname"`
+	// Name is the name of the borg logger, such as borg.repository
+	Name string `json:"name"`
+	// MsgID identifies the message, such as LockTimeout, it is empty for most messages
+	MsgID   string `json:"msgid,omitempty"`
+	Message string `json:"message"`
+}
+
+// Types of the progress lines of the --log-json output, written when borg runs with --progress
+const (
+	TypeArchiveProgress = "archive_progress"
+	TypeProgressMessage = "progress_message"
+	TypeProgressPercent = "progress_percent"
+)
+
+// Progress is a progress line of the --log-json output.
+// The sizes, the number of files and the path are only set by the archive progress lines of borg create,
+// and are absent from the last line, which is only flagged as finished.
+type Progress struct {
+	Type string `json:"type"`
+	// Time is the unix timestamp of the line
+	Time             float64 `json:"time"`
+	Finished         bool    `json:"finished"`
+	OriginalSize     int64   `json:"original_size"`
+	CompressedSize   int64   `json:"compressed_size"`
+	DeduplicatedSize int64   `json:"deduplicated_size"`
+	NFiles           int64   `json:"nfiles"`
+	Path             string  `json:"path"`
+	Message          string  `json:"message"`
+}
+
+// logJSONLine is a line of the --log-json output, which also contains progress and file status lines
+type logJSONLine struct {
+	Type string `json:"type"`
+	LogRecord
+}
+
+// ParseLogJSON returns the log records of the standard error of borg run with --log-json.
+// The lines which are not JSON, such as the messages of ssh, are returned as WARNING records without name,
+// while the progress and file status lines are ignored.
+func ParseLogJSON(stdErr []byte) []LogRecord {
+	var records []LogRecord
+	for _, line := range strings.Split(string(stdErr), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var parsed logJSONLine
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &parsed) != nil {
+			records = append(records, LogRecord{Level: LevelWarning, Message: line})
+			continue
+		}
+		if parsed.Type == "log_message" {
+			records = append(records, parsed.LogRecord)
+		}
+	}
+	return records
+}
+
+// IsWarning returns true for the WARNING records
+func (r LogRecord) IsWarning() bool {
+	return r.Level == LevelWarning
+}
+
+// IsError returns true for the ERROR and CRITICAL records
+func (r LogRecord) IsError() bool {
+	return r.Level == LevelError || r.Level == LevelCritical
+}
+
+// ParseProgress parses a line of the standard error of borg run with --progress and --log-json,
+// returning false when it is not a progress line, such as a log message.
+func ParseProgress(line []byte) (Progress, bool) {
+	var progress Progress
+	if json.Unmarshal(line, &progress) != nil {
+		return Progress{}, false
+	}
+	switch progress.Type {
+	case TypeArchiveProgress, TypeProgressMessage, TypeProgressPercent:
+		return progress, true
+	default:
+		return Progress{}, false
+	}
+}
@@ -0,0 +1,69 @@
+package parser
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseLogJSON(t *testing.T) {
+	stdErr := `{"type": "log_message", "time": 1730147824.5, "message": "Remote: Borg 1.2.8: exception in RPC call", "levelname": "ERROR", "name": "borg.repository"}
+{"type": "progress_percent", "finished": false, "message": "Checking segments 12.5%", "current": 1, "total": 8}
+{"type": "log_message", "time": 1730147825.0, "message": "Failed to create/acquire the lock /backups/laptop/lock.exclusive (timeout).", "levelname": "ERROR", "name": "borg.archiver", "msgid": "LockTimeout"}
+Connection to backup.example.com closed by remote host.
+
+`
+	want := []LogRecord{
+		{Time: 1730147824.5, Level: LevelError, Name: "borg.repository", Message: "Remote: Borg 1.2.8: exception in RPC call"},
+		{Time: 1730147825.0, Level: LevelError, Name: "borg.archiver", MsgID: "LockTimeout", Message: "Failed to create/acquire the lock /backups/laptop/lock.exclusive (timeout)."},
+		{Level: LevelWarning, Message: "Connection to backup.example.com closed by remote host."},
+	}
+
+	assert.Equal(t, want, ParseLogJSON([]byte(stdErr)))
+	assert.Empty(t, ParseLogJSON(nil))
+}
+
+func TestParseProgress(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		want   Progress
+		wantOk bool
+	}{
+		{
+			name: "archive progress",
+			line: `{"type": "archive_progress", "original_size": 1048576, "compressed_size": 524288, "deduplicated_size": 4096, "nfiles": 12, "path": "home/user/notes.txt", "time": 1730167200.5, "finished": false}`,
+			want: Progress{
+				Type: TypeArchiveProgress, Time: 1730167200.5, OriginalSize: 1048576, CompressedSize: 524288,
+				DeduplicatedSize: 4096, NFiles: 12, Path: "home/user/notes.txt",
+			},
+			wantOk: true,
+		},
+		{
+			name:   "archive progress finished",
+			line:   `{"type": "archive_progress", "time": 1730167500.0, "finished": true}`,
+			want:   Progress{Type: TypeArchiveProgress, Time: 1730167500.0, Finished: true},
+			wantOk: true,
+		},
+		{
+			name:   "progress message",
+			line:   `{"type": "progress_message", "operation": 1, "msgid": "cache.begin_transaction", "finished": false, "message": "Initializing cache transaction: Reading files", "time": 1730167200.1}`,
+			want:   Progress{Type: TypeProgressMessage, Time: 1730167200.1, Message: "Initializing cache transaction: Reading files"},
+			wantOk: true,
+		},
+		{
+			name: "log message",
+			line: `{"type": "log_message", "time": 1730167201.0, "message": "/home/user/missing: [Errno 2] No such file or directory", "levelname": "WARNING", "name": "borg.archiver"}`,
+		},
+		{
+			name: "not JSON",
+			line: "Connection to backup.example.com closed by remote host.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseProgress([]byte(tt.line))
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
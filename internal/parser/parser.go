@@ -2,14 +2,23 @@ package parser
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// BorgTimeLayout is the timestamp layout used by borg 1.x, without timezone (local time)
 var BorgTimeLayout = "2006-01-02T15:04:05.000000"
 
+// Borg2TimeLayout is the timestamp layout used by borg 2.x, which includes the timezone offset
+var Borg2TimeLayout = time.RFC3339Nano
+
 type BorgParserInterface interface {
 	ParseInfo(text []byte) (InfoOutput, error)
+	ParseList(text []byte) (ListOutput, error)
+	// ParseCreate parses the output of `borg create --json` as the info of the created archive
+	ParseCreate(text []byte) (InfoOutput, error)
 }
 
 // BorgTime is a custom time type for borg, which uses ISO 8601
@@ -30,10 +39,16 @@ func (bt *BorgTime) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// ParseBorgTime parses a borg timestamp, either in the borg 1.x layout, read in the local time of the host,
+// or in the timezone-aware borg 2.x layout
 func ParseBorgTime(s string) (BorgTime, error) {
-	t, err := time.Parse(BorgTimeLayout, s)
+	t, err := time.ParseInLocation(BorgTimeLayout, s, time.Local)
 	if err != nil {
-		return BorgTime{}, err
+		var err2 error
+		t, err2 = time.Parse(Borg2TimeLayout, s)
+		if err2 != nil {
+			return BorgTime{}, err
+		}
 	}
 	bt := BorgTime{}
 	bt.Time = t
@@ -48,16 +63,74 @@ type InfoOutput struct {
 	Encryption InfoOutputEncryption `json:"encryption"`
 }
 
+// CreateOutput represents the root node of the `borg create --json` output, which describes the created archive
+type CreateOutput struct {
+	Archive    InfoOutputArchive    `json:"archive"`
+	Cache      InfoOutputCache      `json:"cache"`
+	Repository InfoOutputRepository `json:"repository"`
+	Encryption InfoOutputEncryption `json:"encryption"`
+}
+
 type InfoOutputArchive struct {
-	Comment  string                 `json:"comment"`
-	Duration float64                `json:"duration"`
-	End      BorgTime               `json:"end"`
-	Hostname string                 `json:"hostname"`
-	ID       string                 `json:"id"`
-	Name     string                 `json:"name"`
-	Start    BorgTime               `json:"start"`
-	Stats    InfoOutputArchiveStats `json:"stats"`
-	Username string                 `json:"username"`
+	ChunkerParams ChunkerParams           `json:"chunker_params"`
+	CommandLine   []string                `json:"command_line"`
+	Comment       string                  `json:"comment"`
+	Duration      float64                 `json:"duration"`
+	End           BorgTime                `json:"end"`
+	Hostname      string                  `json:"hostname"`
+	ID            string                  `json:"id"`
+	Limits        InfoOutputArchiveLimits `json:"limits"`
+	Name          string                  `json:"name"`
+	Start         BorgTime                `json:"start"`
+	Stats         InfoOutputArchiveStats  `json:"stats"`
+	Username      string                  `json:"username"`
+}
+
+// ChunkerParams are the chunker parameters of an archive, such as ["buzhash", 19, 23, 21, 4095].
+// Borg < 1.2 doesn't include the algorithm.
+type ChunkerParams []any
+
+// String returns the chunker parameters in the format of the --chunker-params option, such as buzhash,19,23,21,4095
+func (p ChunkerParams) String() string {
+	params := make([]string, len(p))
+	for i, param := range p {
+		// The numbers are decoded as float64, which fmt formats with an exponent when they are large
+		if number, ok := param.(float64); ok {
+			params[i] = strconv.FormatFloat(number, 'f', -1, 64)
+			continue
+		}
+		params[i] = fmt.Sprint(param)
+	}
+	return strings.Join(params, ",")
+}
+
+// InfoOutputArchiveLimits holds the usage of the limits of borg for an archive
+type InfoOutputArchiveLimits struct {
+	// MaxArchiveSize is the ratio of the archive metadata size to its maximum size, 1 being the limit.
+	// It is nil when borg doesn't report it, as borg 2 which doesn't limit the archive size anymore.
+	MaxArchiveSize *float64 `json:"max_archive_size"`
+}
+
+// defaultCompression is the compression used by borg create when --compression is not given
+const defaultCompression = "lz4"
+
+// Compression returns the compression given to borg create in the command line of the archive,
+// the default compression when there is none, or an empty string when the command line is unknown.
+func (a InfoOutputArchive) Compression() string {
+	if len(a.CommandLine) == 0 {
+		return ""
+	}
+	for i, arg := range a.CommandLine {
+		switch {
+		case (arg == "--compression" || arg == "-C") && i+1 < len(a.CommandLine):
+			return a.CommandLine[i+1]
+		case strings.HasPrefix(arg, "--compression="):
+			return strings.TrimPrefix(arg, "--compression=")
+		case strings.HasPrefix(arg, "-C") && len(arg) > 2:
+			return strings.TrimPrefix(arg, "-C")
+		}
+	}
+	return defaultCompression
 }
 
 type InfoOutputArchiveStats struct {
@@ -89,6 +162,54 @@ type InfoOutputRepository struct {
 
 type InfoOutputEncryption struct {
 	Mode string `json:"mode"`
+	// Keyfile is the path of the key file, only set for the keyfile modes
+	Keyfile string `json:"keyfile,omitempty"`
+}
+
+// KeyType returns where the key of the repository is stored: repokey, keyfile, or none when there is no key.
+// The authenticated modes also have a key, stored in the repository unless borg reports a key file.
+func (e InfoOutputEncryption) KeyType() string {
+	switch {
+	case strings.HasPrefix(e.Mode, "repokey"):
+		return "repokey"
+	case strings.HasPrefix(e.Mode, "keyfile"):
+		return "keyfile"
+	case strings.HasPrefix(e.Mode, "authenticated"):
+		if e.Keyfile != "" {
+			return "keyfile"
+		}
+		return "repokey"
+	default:
+		return "none"
+	}
+}
+
+// ListOutput represents the root node of the `borg list --json` output
+type ListOutput struct {
+	Archives   []ListOutputArchive  `json:"archives"`
+	Encryption InfoOutputEncryption `json:"encryption"`
+	Repository InfoOutputRepository `json:"repository"`
+}
+
+// ListOutputArchive is an archive as listed by `borg list --json`.
+// End, Hostname and Username are only present when requested through --format.
+type ListOutputArchive struct {
+	Archive  string   `json:"archive"`
+	End      BorgTime `json:"end"`
+	Hostname string   `json:"hostname"`
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Start    BorgTime `json:"start"`
+	Time     BorgTime `json:"time"`
+	Username string   `json:"username"`
+}
+
+// Duration returns the duration of the archive creation in seconds, or 0 if the end time is unknown
+func (a ListOutputArchive) Duration() float64 {
+	if a.End.IsZero() || a.Start.IsZero() {
+		return 0
+	}
+	return a.End.Sub(a.Start.Time).Seconds()
 }
 
 type BorgParser struct{}
@@ -100,3 +221,24 @@ func (p *BorgParser) ParseInfo(text []byte) (InfoOutput, error) {
 	}
 	return borgInfoOutput, nil
 }
+
+func (p *BorgParser) ParseList(text []byte) (ListOutput, error) {
+	var borgListOutput ListOutput
+	if err := json.Unmarshal(text, &borgListOutput); err != nil {
+		return ListOutput{}, err
+	}
+	return borgListOutput, nil
+}
+
+func (p *BorgParser) ParseCreate(text []byte) (InfoOutput, error) {
+	var borgCreateOutput CreateOutput
+	if err := json.Unmarshal(text, &borgCreateOutput); err != nil {
+		return InfoOutput{}, err
+	}
+	return InfoOutput{
+		Archives:   []InfoOutputArchive{borgCreateOutput.Archive},
+		Cache:      borgCreateOutput.Cache,
+		Repository: borgCreateOutput.Repository,
+		Encryption: borgCreateOutput.Encryption,
+	}, nil
+}
@@ -0,0 +1,144 @@
+package parser
+
+import (
+	"encoding/json"
+)
+
+// Info2Output represents the root node of the borg 2.x `borg info --json` output.
+// Compared to borg 1.x, the compressed sizes have been removed from the statistics.
+type Info2Output struct {
+	Archives   []Info2OutputArchive `json:"archives"`
+	Cache      Info2OutputCache     `json:"cache"`
+	Repository InfoOutputRepository `json:"repository"`
+	Encryption InfoOutputEncryption `json:"encryption"`
+}
+
+// Create2Output represents the root node of the borg 2.x `borg create --json` output
+type Create2Output struct {
+	Archive    Info2OutputArchive   `json:"archive"`
+	Cache      Info2OutputCache     `json:"cache"`
+	Repository InfoOutputRepository `json:"repository"`
+	Encryption InfoOutputEncryption `json:"encryption"`
+}
+
+type Info2OutputArchive struct {
+	ChunkerParams ChunkerParams           `json:"chunker_params"`
+	CommandLine   []string                `json:"command_line"`
+	Comment       string                  `json:"comment"`
+	Duration      float64                 `json:"duration"`
+	End           BorgTime                `json:"end"`
+	Hostname      string                  `json:"hostname"`
+	ID            string                  `json:"id"`
+	Name          string                  `json:"name"`
+	Start         BorgTime                `json:"start"`
+	Stats         Info2OutputArchiveStats `json:"stats"`
+	Tags          []string                `json:"tags"`
+	Username      string                  `json:"username"`
+}
+
+type Info2OutputArchiveStats struct {
+	NFiles       int64 `json:"nfiles"`
+	OriginalSize int64 `json:"original_size"`
+}
+
+type Info2OutputCache struct {
+	Path  string                `json:"path"`
+	Stats Info2OutputCacheStats `json:"stats"`
+}
+
+type Info2OutputCacheStats struct {
+	TotalChunks       int64 `json:"total_chunks"`
+	TotalSize         int64 `json:"total_size"`
+	TotalUniqueChunks int64 `json:"total_unique_chunks"`
+	DeduplicatedSize  int64 `json:"unique_size"`
+}
+
+// RepoList2Output represents the root node of the borg 2.x `borg repo-list --json` output
+type RepoList2Output struct {
+	Archives   []RepoList2OutputArchive `json:"archives"`
+	Encryption InfoOutputEncryption     `json:"encryption"`
+	Repository InfoOutputRepository     `json:"repository"`
+}
+
+type RepoList2OutputArchive struct {
+	ListOutputArchive
+	Tags []string `json:"tags"`
+}
+
+// Borg2Parser parses the output of borg 2.x and converts it to the same types as BorgParser,
+// so that both versions fill the same metrics.
+type Borg2Parser struct{}
+
+func (p *Borg2Parser) ParseInfo(text []byte) (InfoOutput, error) {
+	var borgInfoOutput Info2Output
+	if err := json.Unmarshal(text, &borgInfoOutput); err != nil {
+		return InfoOutput{}, err
+	}
+	return borgInfoOutput.info(), nil
+}
+
+func (p *Borg2Parser) ParseCreate(text []byte) (InfoOutput, error) {
+	var borgCreateOutput Create2Output
+	if err := json.Unmarshal(text, &borgCreateOutput); err != nil {
+		return InfoOutput{}, err
+	}
+	borgInfoOutput := Info2Output{
+		Archives:   []Info2OutputArchive{borgCreateOutput.Archive},
+		Cache:      borgCreateOutput.Cache,
+		Repository: borgCreateOutput.Repository,
+		Encryption: borgCreateOutput.Encryption,
+	}
+	return borgInfoOutput.info(), nil
+}
+
+// info converts the borg 2.x output to the borg 1.x types
+func (o Info2Output) info() InfoOutput {
+	info := InfoOutput{
+		Cache: InfoOutputCache{
+			Path: o.Cache.Path,
+			Stats: InfoOutputCacheStats{
+				TotalChunks:       o.Cache.Stats.TotalChunks,
+				TotalSize:         o.Cache.Stats.TotalSize,
+				TotalUniqueChunks: o.Cache.Stats.TotalUniqueChunks,
+				DeduplicatedSize:  o.Cache.Stats.DeduplicatedSize,
+			},
+		},
+		Repository: o.Repository,
+		Encryption: o.Encryption,
+	}
+	for _, archive := range o.Archives {
+		info.Archives = append(info.Archives, InfoOutputArchive{
+			ChunkerParams: archive.ChunkerParams,
+			CommandLine:   archive.CommandLine,
+			Comment:       archive.Comment,
+			Duration:      archive.Duration,
+			End:           archive.End,
+			Hostname:      archive.Hostname,
+			ID:            archive.ID,
+			Name:          archive.Name,
+			Start:         archive.Start,
+			Stats: InfoOutputArchiveStats{
+				NFiles:       archive.Stats.NFiles,
+				OriginalSize: archive.Stats.OriginalSize,
+			},
+			Username: archive.Username,
+		})
+	}
+	return info
+}
+
+func (p *Borg2Parser) ParseList(text []byte) (ListOutput, error) {
+	var borgListOutput RepoList2Output
+	if err := json.Unmarshal(text, &borgListOutput); err != nil {
+		return ListOutput{}, err
+	}
+
+	list := ListOutput{
+		Encryption: borgListOutput.Encryption,
+		Repository: borgListOutput.Repository,
+	}
+	for _, archive := range borgListOutput.Archives {
+		list.Archives = append(list.Archives, archive.ListOutputArchive)
+	}
+	return list, nil
+}
@@ -0,0 +1,159 @@
+package parser
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBorg2Parser_ParseInfo(t *testing.T) {
+	tests := []struct {
+		name           string
+		testFile       string
+		wantErr        error
+		wantInfoOutput InfoOutput
+	}{
+		{
+			name:     "Parse valid output",
+			testFile: "testdata/borg2-info.json",
+			wantErr:  nil,
+			wantInfoOutput: InfoOutput{
+				Archives: []InfoOutputArchive{
+					{
+						ChunkerParams: ChunkerParams{"buzhash", 19.0, 23.0, 21.0, 4095.0},
+						CommandLine:   []string{"/usr/bin/borg", "create", "-r", "ssh://backup-host/backups/backup-name", "--info", "my-hostname"},
+						Comment:       "",
+						Duration:      4540.154685,
+						End:           mustParseBorgTime(t, "2024-10-28T21:52:44.000000+01:00"),
+						Hostname:      "my-hostname",
+						ID:            "a0ef59abfd45d22460a586053e7266e24b9989d00d44aae8442d3d8e6fe92cbf",
+						Name:          "my-hostname",
+						Start:         mustParseBorgTime(t, "2024-10-28T20:37:04.000000+01:00"),
+						Stats: InfoOutputArchiveStats{
+							NFiles:       13079758,
+							OriginalSize: 1341294469810,
+						},
+						Username: "root",
+					},
+				},
+				Cache: InfoOutputCache{
+					Path: "/root/.cache/borg/03a461422fd3be21cbf5235e8d40c2ecbe28b1e4c295ae2ac456563ca62c94af",
+					Stats: InfoOutputCacheStats{
+						TotalChunks:       139398821,
+						TotalSize:         7047547605252,
+						TotalUniqueChunks: 1675085,
+						DeduplicatedSize:  454963879225,
+					},
+				},
+				Repository: InfoOutputRepository{
+					ID:           "c58db5835b4fbd34ac8c747897674d46c58db5835b4fbd34ac8c747897674d46",
+					LastModified: mustParseBorgTime(t, "2024-10-28T22:00:45.000000+01:00"),
+					Location:     "ssh://backup-host/backups/backup-name",
+				},
+				Encryption: InfoOutputEncryption{
+					Mode: "repokey-aes-ocb",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := Borg2Parser{}
+			data, err := os.ReadFile(tt.testFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			infoOutput, err := parser.ParseInfo(data)
+			assert.Equal(t, tt.wantErr, err)
+			assert.EqualValues(t, tt.wantInfoOutput, infoOutput)
+		})
+	}
+}
+
+func TestBorg2Parser_ParseList(t *testing.T) {
+	parser := Borg2Parser{}
+	data, err := os.ReadFile("testdata/borg2-repo-list.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listOutput, err := parser.ParseList(data)
+	assert.NoError(t, err)
+	assert.Len(t, listOutput.Archives, 2)
+	assert.Equal(t, "a0ef59abfd45d22460a586053e7266e24b9989d00d44aae8442d3d8e6fe92cbf", listOutput.Archives[1].ID)
+	assert.Equal(t, 4540.0, listOutput.Archives[1].Duration())
+	assert.Equal(t, "repokey-aes-ocb", listOutput.Encryption.Mode)
+}
+
+func TestBorg2Parser_ParseCreate(t *testing.T) {
+	parser := Borg2Parser{}
+	data, err := os.ReadFile("testdata/borg2-create.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := parser.ParseCreate(data)
+	assert.NoError(t, err)
+	if assert.Len(t, info.Archives, 1) {
+		archive := info.Archives[0]
+		assert.Equal(t, "laptop", archive.Name)
+		assert.Equal(t, mustParseBorgTime(t, "2024-10-29T02:05:12.000000+01:00"), archive.End)
+		assert.Equal(t, InfoOutputArchiveStats{NFiles: 241876, OriginalSize: 16106127360}, archive.Stats)
+	}
+	// The cache statistics are not reported by borg 2.x create
+	assert.Equal(t, InfoOutputCacheStats{}, info.Cache.Stats)
+	assert.Equal(t, "repokey-aes-ocb", info.Encryption.Mode)
+}
+
+func TestParseBorgTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:  "borg 1.x layout",
+			value: "2024-10-28T20:37:04.000000",
+			want:  time.Date(2024, 10, 28, 20, 37, 4, 0, time.Local),
+		},
+		{
+			name:  "borg 2.x layout with offset",
+			value: "2024-10-28T20:37:04.000000+01:00",
+			want:  time.Date(2024, 10, 28, 19, 37, 4, 0, time.UTC),
+		},
+		{
+			name:    "invalid",
+			value:   "yesterday",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bt, err := ParseBorgTime(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, tt.want.Equal(bt.Time), "expected %v, got %v", tt.want, bt.Time)
+		})
+	}
+}
+
+func TestParseBorgTimeLocal(t *testing.T) {
+	// borg 1.x timestamps are in the local time of the host running borg
+	local := time.Local
+	time.Local = time.FixedZone("UTC+2", 2*60*60)
+	defer func() { time.Local = local }()
+
+	bt, err := ParseBorgTime("2024-10-28T20:37:04.000000")
+	assert.NoError(t, err)
+	want := time.Date(2024, 10, 28, 18, 37, 4, 0, time.UTC)
+	assert.True(t, want.Equal(bt.Time), "expected %v, got %v", want, bt.Time)
+
+	// The offset of borg 2.x timestamps is kept
+	bt, err = ParseBorgTime("2024-10-28T20:37:04.000000+01:00")
+	assert.NoError(t, err)
+	want = time.Date(2024, 10, 28, 19, 37, 4, 0, time.UTC)
+	assert.True(t, want.Equal(bt.Time), "expected %v, got %v", want, bt.Time)
+}
@@ -7,6 +7,7 @@ import (
 )
 
 func TestBorgParser_ParseInfo(t *testing.T) {
+	maxArchiveSize := 0.08339693161364536
 	tests := []struct {
 		name           string
 		testFile       string
@@ -20,11 +21,17 @@ func TestBorgParser_ParseInfo(t *testing.T) {
 			wantInfoOutput: InfoOutput{
 				Archives: []InfoOutputArchive{
 					{
+						ChunkerParams: ChunkerParams{"buzhash", 19.0, 23.0, 21.0, 4095.0},
+						CommandLine: []string{
+							"/usr/bin/borg", "create", "--patterns-from", "/tmp/tmpubnzdodg", "--exclude-from", "/tmp/tmphz6b47hp", "--info",
+							"ssh://backuphost/backups/backup-name::{hostname}-{now:%Y-%m-%dT%H:%M:%S.%f}",
+						},
 						Comment:  "",
 						Duration: 4540.154685,
 						End:      mustParseBorgTime(t, "2024-10-28T21:52:44.000000"),
 						Hostname: "my-hostname",
 						ID:       "a0ef59abfd45d22460a586053e7266e24b9989d00d44aae8442d3d8e6fe92cbf",
+						Limits:   InfoOutputArchiveLimits{MaxArchiveSize: &maxArchiveSize},
 						Name:     "my-hostname-2024-10-28T20:37:03.464475",
 						Start:    mustParseBorgTime(t, "2024-10-28T20:37:04.000000"),
 						Stats: InfoOutputArchiveStats{
@@ -72,6 +79,134 @@ func TestBorgParser_ParseInfo(t *testing.T) {
 	}
 }
 
+func TestBorgParser_ParseList(t *testing.T) {
+	tests := []struct {
+		name           string
+		testFile       string
+		wantErr        error
+		wantListOutput ListOutput
+	}{
+		{
+			name:     "Parse valid output",
+			testFile: "testdata/borg-list.json",
+			wantErr:  nil,
+			wantListOutput: ListOutput{
+				Archives: []ListOutputArchive{
+					{
+						Archive:  "my-hostname-2024-10-26T20:37:02.123456",
+						End:      mustParseBorgTime(t, "2024-10-26T21:40:12.000000"),
+						Hostname: "my-hostname",
+						ID:       "5c1fbc3b0e4f5bd0b1a4f3e0bb2b7a2e3d2b7f8c7c1d0e9f8a7b6c5d4e3f2a1b",
+						Name:     "my-hostname-2024-10-26T20:37:02.123456",
+						Start:    mustParseBorgTime(t, "2024-10-26T20:37:03.000000"),
+						Time:     mustParseBorgTime(t, "2024-10-26T20:37:03.000000"),
+						Username: "root",
+					},
+					{
+						Archive:  "my-hostname-2024-10-28T20:37:03.464475",
+						End:      mustParseBorgTime(t, "2024-10-28T21:52:44.000000"),
+						Hostname: "my-hostname",
+						ID:       "a0ef59abfd45d22460a586053e7266e24b9989d00d44aae8442d3d8e6fe92cbf",
+						Name:     "my-hostname-2024-10-28T20:37:03.464475",
+						Start:    mustParseBorgTime(t, "2024-10-28T20:37:04.000000"),
+						Time:     mustParseBorgTime(t, "2024-10-28T20:37:04.000000"),
+						Username: "root",
+					},
+				},
+				Encryption: InfoOutputEncryption{
+					Mode: "none",
+				},
+				Repository: InfoOutputRepository{
+					ID:           "c58db5835b4fbd34ac8c747897674d46c58db5835b4fbd34ac8c747897674d46",
+					LastModified: mustParseBorgTime(t, "2024-10-28T22:00:45.000000"),
+					Location:     "ssh://backup-host/backups/backup-name",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := BorgParser{}
+			data, err := os.ReadFile(tt.testFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listOutput, err := parser.ParseList(data)
+			assert.Equal(t, tt.wantErr, err)
+			assert.EqualValues(t, tt.wantListOutput, listOutput)
+		})
+	}
+}
+
+func TestBorgParser_ParseCreate(t *testing.T) {
+	parser := BorgParser{}
+	data, err := os.ReadFile("testdata/borg-create.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := parser.ParseCreate(data)
+	assert.NoError(t, err)
+	if assert.Len(t, info.Archives, 1) {
+		archive := info.Archives[0]
+		assert.Equal(t, "laptop-2024-10-29T02:00:00", archive.Name)
+		assert.Equal(t, 312.517354, archive.Duration)
+		assert.Equal(t, mustParseBorgTime(t, "2024-10-29T02:00:00.000000"), archive.Start)
+		assert.Equal(t, InfoOutputArchiveStats{
+			CompressedSize:   9663676416,
+			DeduplicatedSize: 268435456,
+			NFiles:           241876,
+			OriginalSize:     16106127360,
+		}, archive.Stats)
+		assert.Equal(t, "buzhash,19,23,21,4095", archive.ChunkerParams.String())
+	}
+	assert.Equal(t, int64(22548578304), info.Cache.Stats.DeduplicatedCompressedSize)
+	assert.Equal(t, "/backups/laptop", info.Repository.Location)
+	assert.Equal(t, "repokey-blake2", info.Encryption.Mode)
+}
+
+func TestListOutputArchive_Duration(t *testing.T) {
+	archive := ListOutputArchive{
+		Start: mustParseBorgTime(t, "2024-10-28T20:37:04.000000"),
+		End:   mustParseBorgTime(t, "2024-10-28T21:52:44.000000"),
+	}
+	assert.Equal(t, 4540.0, archive.Duration())
+	assert.Equal(t, 0.0, ListOutputArchive{Start: archive.Start}.Duration())
+}
+
+func TestInfoOutputArchive_Compression(t *testing.T) {
+	tests := []struct {
+		name        string
+		commandLine []string
+		want        string
+	}{
+		{name: "long option", commandLine: []string{"borg", "create", "--compression", "zstd,3", "::archive", "/home"}, want: "zstd,3"},
+		{name: "long option with equal", commandLine: []string{"borg", "create", "--compression=auto,lzma,6", "::archive"}, want: "auto,lzma,6"},
+		{name: "short option", commandLine: []string{"borg", "create", "-C", "none", "::archive"}, want: "none"},
+		{name: "joined short option", commandLine: []string{"borg", "create", "-Czlib", "::archive"}, want: "zlib"},
+		{name: "default", commandLine: []string{"borg", "create", "::archive"}, want: "lz4"},
+		{name: "unknown command line", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, InfoOutputArchive{CommandLine: tt.commandLine}.Compression())
+		})
+	}
+}
+
+func TestChunkerParams_String(t *testing.T) {
+	assert.Equal(t, "buzhash,19,23,21,4095", ChunkerParams{"buzhash", 19.0, 23.0, 21.0, 4095.0}.String())
+	assert.Equal(t, "fixed,4194304", ChunkerParams{"fixed", 4194304.0}.String())
+	assert.Equal(t, "", ChunkerParams(nil).String())
+}
+
+func TestInfoOutputEncryption_KeyType(t *testing.T) {
+	assert.Equal(t, "repokey", InfoOutputEncryption{Mode: "repokey-blake2"}.KeyType())
+	assert.Equal(t, "keyfile", InfoOutputEncryption{Mode: "keyfile-aes-ocb"}.KeyType())
+	assert.Equal(t, "repokey", InfoOutputEncryption{Mode: "authenticated"}.KeyType())
+	assert.Equal(t, "keyfile", InfoOutputEncryption{Mode: "authenticated-blake2", Keyfile: "/root/.config/borg/keys/backups"}.KeyType())
+	assert.Equal(t, "none", InfoOutputEncryption{Mode: "none"}.KeyType())
+}
+
 func mustParseBorgTime(t *testing.T, s string) BorgTime {
 	t.Helper()
 	result, err := ParseBorgTime(s)
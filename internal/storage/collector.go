@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Collector scans the repositories matching its paths and exposes their on-disk state.
+// It implements prometheus.Collector: the metrics are rendered from the last scan at scrape time.
+type Collector struct {
+	sync.RWMutex
+	// Paths are the repositories, or the directories containing them, possibly as globs, see Discover
+	Paths []string
+	// LastScan is the time of the last scan
+	LastScan time.Time
+	// scans holds the last scan of each repository, by path
+	scans map[string]*scan
+
+	info            *prometheus.Desc
+	appendOnly      *prometheus.Desc
+	storageQuota    *prometheus.Desc
+	segmentsPerDir  *prometheus.Desc
+	segments        *prometheus.Desc
+	size            *prometheus.Desc
+	transactionID   *prometheus.Desc
+	lastWrite       *prometheus.Desc
+	scanError       *prometheus.Desc
+	scanTimestamp   *prometheus.Desc
+	scanDuration    *prometheus.Desc
+	repositoryCount *prometheus.Desc
+}
+
+// scan is the last scan of a repository
+type scan struct {
+	// Repository is the last successful scan, nil if the repository was never scanned successfully
+	Repository *Repository
+	Error      bool
+	Duration   time.Duration
+}
+
+// NewCollector returns a collector of the repositories matching the given paths
+func NewCollector(paths []string) *Collector {
+	labels := []string{"repository"}
+	return &Collector{
+		Paths: paths,
+		scans: map[string]*scan{},
+		info: prometheus.NewDesc("borg_storage_info",
+			"Information about the repository from its config file",
+			[]string{"repository", "id", "version"}, nil),
+		appendOnly: prometheus.NewDesc("borg_storage_append_only",
+			"1 if the repository is in append-only mode, 0 otherwise",
+			labels, nil),
+		storageQuota: prometheus.NewDesc("borg_storage_quota_bytes",
+			"Storage quota of the repository in bytes, only when a quota is set",
+			labels, nil),
+		segmentsPerDir: prometheus.NewDesc("borg_storage_segments_per_dir",
+			"Maximum number of segment files per directory of the repository",
+			labels, nil),
+		segments: prometheus.NewDesc("borg_storage_segments",
+			"Number of segment files of the repository",
+			labels, nil),
+		size: prometheus.NewDesc("borg_storage_size_bytes",
+			"Total size of the segment files of the repository in bytes",
+			labels, nil),
+		transactionID: prometheus.NewDesc("borg_storage_transaction_id",
+			"Id of the last committed transaction of the repository",
+			labels, nil),
+		lastWrite: prometheus.NewDesc("borg_storage_last_write_timestamp",
+			"Timestamp of the last write to the segments, index or hints files of the repository",
+			labels, nil),
+		scanError: prometheus.NewDesc("borg_storage_scan_error",
+			"1 if the last scan of the repository failed, 0 otherwise",
+			labels, nil),
+		scanTimestamp: prometheus.NewDesc("borg_storage_last_scan_timestamp",
+			"Timestamp of the last scan of the repositories",
+			nil, nil),
+		scanDuration: prometheus.NewDesc("borg_storage_scan_duration_seconds",
+			"Duration of the last scan of the repository in seconds",
+			labels, nil),
+		repositoryCount: prometheus.NewDesc("borg_storage_repositories",
+			"Number of repositories found in the storage paths",
+			nil, nil),
+	}
+}
+
+// Refresh discovers the repositories and scans them, keeping the last successful scan of a repository when it fails.
+// The repositories which are not found anymore are removed.
+func (c *Collector) Refresh() []error {
+	paths, err := Discover(c.Paths)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	scans := map[string]*scan{}
+	for _, path := range paths {
+		start := time.Now()
+		repository, err := Scan(path)
+		duration := time.Since(start)
+
+		c.RLock()
+		previous := c.scans[path]
+		c.RUnlock()
+
+		current := &scan{Repository: repository, Duration: duration}
+		if err != nil {
+			errs = append(errs, err)
+			current.Error = true
+			if previous != nil {
+				current.Repository = previous.Repository
+			}
+		}
+		scans[path] = current
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.scans = scans
+	c.LastScan = time.Now()
+	return errs
+}
+
+// Repositories returns the last successful scan of the repositories, sorted by path
+func (c *Collector) Repositories() []*Repository {
+	c.RLock()
+	defer c.RUnlock()
+	var repositories []*Repository
+	for _, path := range c.sortedPaths() {
+		if repository := c.scans[path].Repository; repository != nil {
+			repositories = append(repositories, repository)
+		}
+	}
+	return repositories
+}
+
+// sortedPaths returns the paths of the scanned repositories, sorted.
+// The caller must hold the lock.
+func (c *Collector) sortedPaths() []string {
+	paths := make([]string, 0, len(c.scans))
+	for path := range c.scans {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+	ch <- c.appendOnly
+	ch <- c.storageQuota
+	ch <- c.segmentsPerDir
+	ch <- c.segments
+	ch <- c.size
+	ch <- c.transactionID
+	ch <- c.lastWrite
+	ch <- c.scanError
+	ch <- c.scanTimestamp
+	ch <- c.scanDuration
+	ch <- c.repositoryCount
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.LastScan.IsZero() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.scanTimestamp, prometheus.GaugeValue, float64(c.LastScan.Unix()))
+	ch <- prometheus.MustNewConstMetric(c.repositoryCount, prometheus.GaugeValue, float64(len(c.scans)))
+
+	for _, path := range c.sortedPaths() {
+		scan := c.scans[path]
+		ch <- prometheus.MustNewConstMetric(c.scanError, prometheus.GaugeValue, boolToFloat(scan.Error), path)
+		ch <- prometheus.MustNewConstMetric(c.scanDuration, prometheus.GaugeValue, scan.Duration.Seconds(), path)
+
+		r := scan.Repository
+		if r == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, path, r.ID, strconv.Itoa(r.Version))
+		ch <- prometheus.MustNewConstMetric(c.appendOnly, prometheus.GaugeValue, boolToFloat(r.AppendOnly), path)
+		if r.StorageQuota > 0 {
+			ch <- prometheus.MustNewConstMetric(c.storageQuota, prometheus.GaugeValue, float64(r.StorageQuota), path)
+		}
+		if r.SegmentsPerDir > 0 {
+			ch <- prometheus.MustNewConstMetric(c.segmentsPerDir, prometheus.GaugeValue, float64(r.SegmentsPerDir), path)
+		}
+		ch <- prometheus.MustNewConstMetric(c.segments, prometheus.GaugeValue, float64(r.Segments), path)
+		ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(r.Size), path)
+		if r.TransactionID >= 0 {
+			ch <- prometheus.MustNewConstMetric(c.transactionID, prometheus.GaugeValue, float64(r.TransactionID), path)
+		}
+		if !r.LastWrite.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.lastWrite, prometheus.GaugeValue, float64(r.LastWrite.Unix()), path)
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollector(t *testing.T) {
+	root := t.TempDir()
+	modTime := time.Date(2024, 10, 29, 20, 37, 4, 0, time.UTC)
+	laptop := filepath.Join(root, "laptop")
+	server := filepath.Join(root, "server")
+	newTestRepository(t, laptop, modTime)
+	newTestRepository(t, server, modTime)
+
+	collector := NewCollector([]string{root})
+	if errs := collector.Refresh(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	// The config of the server becomes invalid, the metrics of its last successful scan are kept
+	if err := os.WriteFile(filepath.Join(server, "config"), []byte("[repository]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if errs := collector.Refresh(); len(errs) != 1 {
+		t.Fatalf("Expected 1 error, got %v", errs)
+	}
+
+	expected := fmt.Sprintf(`
+# HELP borg_storage_last_write_timestamp Timestamp of the last write to the segments, index or hints files of the repository
+# TYPE borg_storage_last_write_timestamp gauge
+borg_storage_last_write_timestamp{repository="%[1]s"} 1.730234224e+09
+borg_storage_last_write_timestamp{repository="%[2]s"} 1.730234224e+09
+# HELP borg_storage_quota_bytes Storage quota of the repository in bytes, only when a quota is set
+# TYPE borg_storage_quota_bytes gauge
+borg_storage_quota_bytes{repository="%[1]s"} 1.073741824e+09
+borg_storage_quota_bytes{repository="%[2]s"} 1.073741824e+09
+# HELP borg_storage_repositories Number of repositories found in the storage paths
+# TYPE borg_storage_repositories gauge
+borg_storage_repositories 2
+# HELP borg_storage_scan_error 1 if the last scan of the repository failed, 0 otherwise
+# TYPE borg_storage_scan_error gauge
+borg_storage_scan_error{repository="%[1]s"} 0
+borg_storage_scan_error{repository="%[2]s"} 1
+# HELP borg_storage_segments Number of segment files of the repository
+# TYPE borg_storage_segments gauge
+borg_storage_segments{repository="%[1]s"} 2
+borg_storage_segments{repository="%[2]s"} 2
+# HELP borg_storage_size_bytes Total size of the segment files of the repository in bytes
+# TYPE borg_storage_size_bytes gauge
+borg_storage_size_bytes{repository="%[1]s"} 300
+borg_storage_size_bytes{repository="%[2]s"} 300
+# HELP borg_storage_transaction_id Id of the last committed transaction of the repository
+# TYPE borg_storage_transaction_id gauge
+borg_storage_transaction_id{repository="%[1]s"} 5
+borg_storage_transaction_id{repository="%[2]s"} 5
+`, laptop, server)
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"borg_storage_last_write_timestamp", "borg_storage_quota_bytes", "borg_storage_repositories",
+		"borg_storage_scan_error", "borg_storage_segments", "borg_storage_size_bytes", "borg_storage_transaction_id")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The removed repositories are not exposed anymore
+	if err := os.RemoveAll(server); err != nil {
+		t.Fatal(err)
+	}
+	collector.Refresh()
+	if count := testutil.CollectAndCount(collector, "borg_storage_segments"); count != 1 {
+		t.Errorf("Expected 1 repository, got %d", count)
+	}
+}
+
+func TestCollector_NotScanned(t *testing.T) {
+	collector := NewCollector([]string{t.TempDir()})
+	if count := testutil.CollectAndCount(collector); count != 0 {
+		t.Errorf("Expected no metric before the first scan, got %d", count)
+	}
+}
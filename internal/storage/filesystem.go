@@ -0,0 +1,9 @@
+package storage
+
+// Filesystem is the capacity of a filesystem, in bytes
+type Filesystem struct {
+	Size uint64
+	Free uint64
+	// Available is the free space available to unprivileged users, such as the borg user
+	Available uint64
+}
@@ -0,0 +1,18 @@
+//go:build darwin
+
+package storage
+
+import "syscall"
+
+// StatFilesystem returns the capacity of the filesystem containing the given path
+func StatFilesystem(path string) (*Filesystem, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, err
+	}
+	return &Filesystem{
+		Size:      uint64(stat.Blocks) * uint64(stat.Bsize),
+		Free:      uint64(stat.Bfree) * uint64(stat.Bsize),
+		Available: uint64(stat.Bavail) * uint64(stat.Bsize),
+	}, nil
+}
@@ -0,0 +1,23 @@
+//go:build freebsd
+
+package storage
+
+import "syscall"
+
+// StatFilesystem returns the capacity of the filesystem containing the given path
+func StatFilesystem(path string) (*Filesystem, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, err
+	}
+	// The available blocks are negative when the reserved blocks are used
+	available := uint64(0)
+	if stat.Bavail > 0 {
+		available = uint64(stat.Bavail)
+	}
+	return &Filesystem{
+		Size:      stat.Blocks * stat.Bsize,
+		Free:      stat.Bfree * stat.Bsize,
+		Available: available * stat.Bsize,
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// StatFilesystem is not supported on this platform
+func StatFilesystem(path string) (*Filesystem, error) {
+	return nil, fmt.Errorf("cannot get the capacity of the filesystem of %s: %w", path, errors.ErrUnsupported)
+}
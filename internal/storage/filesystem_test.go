@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStatFilesystem(t *testing.T) {
+	filesystem, err := StatFilesystem(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filesystem.Size == 0 || filesystem.Free > filesystem.Size || filesystem.Available > filesystem.Free {
+		t.Errorf("Expected a consistent capacity, got %+v", filesystem)
+	}
+
+	if _, err := StatFilesystem(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("Expected an error for a missing path")
+	}
+}
@@ -0,0 +1,238 @@
+// Package storage inspects the borg repositories on the backup server, from their on-disk structure.
+// It doesn't need the passphrase of the repositories, as it never runs borg.
+// Only the layout of the borg 1.x repositories is supported.
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Repository is the on-disk state of a borg repository
+type Repository struct {
+	// Path is the directory of the repository
+	Path string
+
+	// Settings of the repository config file
+	ID             string
+	Version        int
+	AppendOnly     bool
+	StorageQuota   int64
+	SegmentsPerDir int
+
+	// Segments is the number of segment files of the data directory, and Size their total size in bytes
+	Segments int
+	Size     int64
+	// TransactionID is the id of the last committed transaction, from the index and hints files, -1 when there is none
+	TransactionID int64
+	// LastWrite is the latest modification time of the segments, index and hints files
+	LastWrite time.Time
+}
+
+// IsRepository returns true when the directory looks like a borg repository, with a config file and a data directory
+func IsRepository(path string) bool {
+	config, err := os.Stat(filepath.Join(path, "config"))
+	if err != nil || !config.Mode().IsRegular() {
+		return false
+	}
+	data, err := os.Stat(filepath.Join(path, "data"))
+	return err == nil && data.IsDir()
+}
+
+// Discover returns the repositories matching the given paths, sorted by path.
+// Each path can be a glob, and is either a repository or a directory whose subdirectories are repositories.
+func Discover(paths []string) ([]string, error) {
+	found := map[string]bool{}
+	for _, pattern := range paths {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q: %w", pattern, err)
+		}
+		for _, match := range matches {
+			if IsRepository(match) {
+				found[match] = true
+				continue
+			}
+			entries, err := os.ReadDir(match)
+			if err != nil {
+				// Files matched by a glob are not repositories
+				continue
+			}
+			for _, entry := range entries {
+				path := filepath.Join(match, entry.Name())
+				if entry.IsDir() && IsRepository(path) {
+					found[path] = true
+				}
+			}
+		}
+	}
+
+	repositories := make([]string, 0, len(found))
+	for path := range found {
+		repositories = append(repositories, path)
+	}
+	sort.Strings(repositories)
+	return repositories, nil
+}
+
+// ReadConfig only reads the config file of the repository in the given directory, without scanning its data
+func ReadConfig(path string) (*Repository, error) {
+	repository := &Repository{Path: path, TransactionID: -1}
+	if err := repository.readConfig(); err != nil {
+		return nil, err
+	}
+	return repository, nil
+}
+
+// Scan reads the on-disk structure of the repository in the given directory
+func Scan(path string) (*Repository, error) {
+	repository, err := ReadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := repository.scanData(); err != nil {
+		return nil, err
+	}
+	if err := repository.scanTransactions(); err != nil {
+		return nil, err
+	}
+	return repository, nil
+}
+
+// readConfig reads the settings of the repository section of the config file, which is an INI file
+func (r *Repository) readConfig() error {
+	file, err := os.Open(filepath.Join(r.Path, "config"))
+	if err != nil {
+		return fmt.Errorf("cannot read the repository config: %w", err)
+	}
+	defer file.Close()
+
+	var section string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != "repository" {
+			continue
+		}
+		if err := r.setConfig(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("invalid repository config: %w", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cannot read the repository config: %w", err)
+	}
+	if r.ID == "" {
+		return fmt.Errorf("invalid repository config: no repository id")
+	}
+	return nil
+}
+
+// setConfig sets a setting of the repository section of the config file
+func (r *Repository) setConfig(key, value string) error {
+	var err error
+	switch key {
+	case "id":
+		r.ID = value
+	case "version":
+		r.Version, err = strconv.Atoi(value)
+	case "append_only":
+		// Borg writes 0 or 1, but older versions wrote the Python booleans
+		r.AppendOnly = value == "1" || strings.EqualFold(value, "true")
+	case "storage_quota":
+		r.StorageQuota, err = strconv.ParseInt(value, 10, 64)
+	case "segments_per_dir":
+		r.SegmentsPerDir, err = strconv.Atoi(value)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
+
+// scanData counts the segment files of the data directory, whose names are their segment number
+func (r *Repository) scanData() error {
+	err := filepath.WalkDir(filepath.Join(r.Path, "data"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !isNumber(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// The segment has been removed by a compaction in the meantime
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r.Segments++
+		r.Size += info.Size()
+		r.updateLastWrite(info.ModTime())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot scan the repository data: %w", err)
+	}
+	return nil
+}
+
+// scanTransactions reads the last transaction id from the names of the index and hints files, such as index.42
+func (r *Repository) scanTransactions() error {
+	entries, err := os.ReadDir(r.Path)
+	if err != nil {
+		return fmt.Errorf("cannot read the repository directory: %w", err)
+	}
+	for _, entry := range entries {
+		prefix, suffix, ok := strings.Cut(entry.Name(), ".")
+		if !ok || (prefix != "index" && prefix != "hints") || !isNumber(suffix) {
+			continue
+		}
+		transactionID, err := strconv.ParseInt(suffix, 10, 64)
+		if err != nil {
+			continue
+		}
+		if transactionID > r.TransactionID {
+			r.TransactionID = transactionID
+		}
+		if info, err := entry.Info(); err == nil {
+			r.updateLastWrite(info.ModTime())
+		}
+	}
+	return nil
+}
+
+func (r *Repository) updateLastWrite(t time.Time) {
+	if t.After(r.LastWrite) {
+		r.LastWrite = t
+	}
+}
+
+// isNumber returns true when the string only contains digits
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
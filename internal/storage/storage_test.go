@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testConfig = `[repository]
+version = 1
+segments_per_dir = 1000
+max_segment_size = 524288000
+append_only = 1
+storage_quota = 1073741824
+additional_free_space = 0
+id = 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+key = hqlhbGdvcml0aG2mc2hhMjU2pGRhdGHaAN4=
+`
+
+// writeFile writes a file of the given size with the given modification time, creating its directory
+func writeFile(t *testing.T, path string, size int, modTime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestRepository creates a borg 1.x repository with two segments in the given directory
+func newTestRepository(t *testing.T, path string, modTime time.Time) {
+	t.Helper()
+	writeFile(t, filepath.Join(path, "README"), 10, modTime)
+	if err := os.WriteFile(filepath.Join(path, "config"), []byte(testConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(path, "data", "0", "1"), 100, modTime.Add(-time.Hour))
+	writeFile(t, filepath.Join(path, "data", "0", "5"), 200, modTime.Add(-time.Minute))
+	writeFile(t, filepath.Join(path, "data", "0", "5.beforerecover"), 50, modTime)
+	writeFile(t, filepath.Join(path, "index.5"), 30, modTime)
+	writeFile(t, filepath.Join(path, "hints.5"), 20, modTime)
+	writeFile(t, filepath.Join(path, "integrity.5"), 20, modTime)
+	writeFile(t, filepath.Join(path, "nonce"), 16, modTime.Add(time.Hour))
+}
+
+func TestScan(t *testing.T) {
+	modTime := time.Date(2024, 10, 29, 20, 37, 4, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "laptop")
+	newTestRepository(t, path, modTime)
+
+	got, err := Scan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Repository{
+		Path:           path,
+		ID:             "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Version:        1,
+		AppendOnly:     true,
+		StorageQuota:   1073741824,
+		SegmentsPerDir: 1000,
+		Segments:       2,
+		Size:           300,
+		TransactionID:  5,
+		LastWrite:      modTime,
+	}
+	got.LastWrite = got.LastWrite.UTC()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestScan_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{name: "no config"},
+		{name: "no repository id", config: "[repository]\nversion = 1\n"},
+		{name: "invalid quota", config: "[repository]\nid = 01\nstorage_quota = big\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir()
+			if err := os.Mkdir(filepath.Join(path, "data"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if tt.config != "" {
+				if err := os.WriteFile(filepath.Join(path, "config"), []byte(tt.config), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := Scan(path); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestScan_EmptyRepository(t *testing.T) {
+	path := t.TempDir()
+	if err := os.WriteFile(filepath.Join(path, "config"), []byte("[repository]\nid = 01\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(path, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Scan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Segments != 0 || got.TransactionID != -1 || !got.LastWrite.IsZero() {
+		t.Errorf("Expected an empty repository, got %+v", got)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	root := t.TempDir()
+	modTime := time.Now()
+	newTestRepository(t, filepath.Join(root, "clients", "laptop"), modTime)
+	newTestRepository(t, filepath.Join(root, "clients", "server"), modTime)
+	newTestRepository(t, filepath.Join(root, "archive"), modTime)
+	// Not repositories
+	writeFile(t, filepath.Join(root, "clients", "notes.txt"), 10, modTime)
+	writeFile(t, filepath.Join(root, "clients", "empty", "README"), 10, modTime)
+
+	tests := []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{
+			name:  "directory of repositories",
+			paths: []string{filepath.Join(root, "clients")},
+			want:  []string{filepath.Join(root, "clients", "laptop"), filepath.Join(root, "clients", "server")},
+		},
+		{
+			name:  "repository",
+			paths: []string{filepath.Join(root, "archive")},
+			want:  []string{filepath.Join(root, "archive")},
+		},
+		{
+			name:  "glob",
+			paths: []string{filepath.Join(root, "clients", "l*"), filepath.Join(root, "a*")},
+			want:  []string{filepath.Join(root, "archive"), filepath.Join(root, "clients", "laptop")},
+		},
+		{
+			name:  "duplicates",
+			paths: []string{filepath.Join(root, "clients"), filepath.Join(root, "clients", "*")},
+			want:  []string{filepath.Join(root, "clients", "laptop"), filepath.Join(root, "clients", "server")},
+		},
+		{
+			name:  "missing",
+			paths: []string{filepath.Join(root, "missing")},
+			want:  []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Discover(tt.paths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := Discover([]string{"["}); err == nil {
+		t.Errorf("Expected an error for an invalid glob")
+	}
+}
@@ -0,0 +1,280 @@
+package web
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// backfillJob is the borg info of an archive to run for the backfill
+type backfillJob struct {
+	repo    *repository
+	archive parser.ListOutputArchive
+	// info is the information of the archive, nil when borg info failed
+	info *parser.InfoOutputArchive
+}
+
+// Backfill runs borg info for every archive of the configured repositories, and writes the metrics of the archives
+// with their end time as timestamp to an OpenMetrics file, which can be imported in Prometheus with
+// `promtool tsdb create-blocks-from openmetrics`.
+// It returns the exit code of the backfill subcommand: 1 when an archive could not be collected or the file
+// could not be written, 2 for invalid flags.
+func (app *Application) Backfill(Version string, args []string) int {
+	var cfg config
+	var outputPath, before string
+	var concurrencyPerRepository int
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	app.registerCollectionFlags(fs, &cfg)
+	fs.StringVar(&outputPath, "output", os.Getenv("BACKFILL_OUTPUT"), "path of the OpenMetrics file to write, - for the standard output")
+	fs.StringVar(&before, "before", os.Getenv("BACKFILL_BEFORE"), "only backfill the archives started before this RFC 3339 time, for instance when the exporter started")
+	fs.IntVar(&concurrencyPerRepository, "concurrency-per-repository", app.getIntEnv("BACKFILL_CONCURRENCY_PER_REPOSITORY", 1), "maximum number of borg info run concurrently on the same repository, as borg locks its cache (default 1)")
+	if err := app.parseFlags(fs, args); err != nil {
+		app.logger.Error("Invalid configuration", "error", err)
+		return 2
+	}
+
+	if outputPath == "" {
+		app.logger.Error("The backfill command requires an output path")
+		return 2
+	}
+	var beforeTime time.Time
+	if before != "" {
+		var err error
+		if beforeTime, err = time.Parse(time.RFC3339, before); err != nil {
+			app.logger.Error("Invalid before time, expected RFC 3339", "before", before)
+			return 2
+		}
+	}
+
+	app.logger.Info("Backfilling archives metrics", "version", Version)
+	if _, err := app.setup(&cfg); err != nil {
+		app.logger.Error("Invalid configuration", "error", err)
+		return 2
+	}
+	if len(app.repositories) == 0 {
+		app.logger.Error("No borg repositories defined")
+		return 2
+	}
+
+	var errs []error
+	var jobs []*backfillJob
+	for _, repo := range app.repositories {
+		list, _, err := app.listArchives(context.Background(), repo)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, archive := range list.Archives {
+			if !beforeTime.IsZero() && !archive.Start.Before(beforeTime) {
+				continue
+			}
+			jobs = append(jobs, &backfillJob{repo: repo, archive: archive})
+		}
+	}
+	app.logger.Info("Running borg info for each archive", "archives", len(jobs))
+	errs = append(errs, app.runBackfillJobs(jobs, concurrencyPerRepository)...)
+	app.logErrors("Backfill failed with the following error(s):", errs)
+	exitCode := 0
+	if len(errs) > 0 {
+		exitCode = 1
+	}
+
+	// The metrics of the archives which could be collected are written anyway
+	families, err := app.backfillFamilies(jobs)
+	if err != nil {
+		app.logger.Error("Cannot render the archives metrics", "error", err)
+		return 1
+	}
+	if err := writeOpenMetricsFile(outputPath, families); err != nil {
+		app.logger.Error("Cannot write the OpenMetrics file", "path", outputPath, "error", err)
+		return 1
+	}
+
+	app.logger.Info("Backfilling archives metrics done", "archives", len(jobs), "errors", len(errs))
+	return exitCode
+}
+
+// runBackfillJobs runs borg info for the archives of the jobs, by a bounded pool of workers,
+// with a limit of concurrent commands per repository
+func (app *Application) runBackfillJobs(jobs []*backfillJob, concurrencyPerRepository int) []error {
+	maxConcurrency := max(app.config.maxConcurrency, 1)
+	concurrencyPerRepository = max(concurrencyPerRepository, 1)
+	workers := make(chan struct{}, maxConcurrency)
+	repositoryWorkers := map[*repository]chan struct{}{}
+	for _, job := range jobs {
+		if repositoryWorkers[job.repo] == nil {
+			repositoryWorkers[job.repo] = make(chan struct{}, concurrencyPerRepository)
+		}
+	}
+
+	results := make([]error, len(jobs))
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			repositoryWorker := repositoryWorkers[job.repo]
+			repositoryWorker <- struct{}{}
+			defer func() { <-repositoryWorker }()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			results[i] = app.runBackfillJob(job)
+		}()
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// runBackfillJob runs borg info for the archive of the job
+func (app *Application) runBackfillJob(job *backfillJob) error {
+	repo := job.repo
+	output, _, err := app.runBorg(context.Background(), repo, repo.timeout, repo.commands.InfoArchive(repo.location, job.archive)...)
+	if err != nil {
+		return err
+	}
+	info, err := repo.parser.ParseInfo(output)
+	if err == nil && len(info.Archives) == 0 {
+		err = fmt.Errorf("archive %s not found", job.archive.Name)
+	}
+	if err != nil {
+		return &RepositoryCollectionError{
+			Repository: repo.name(),
+			Category:   ErrorCategoryParse,
+			Msg:        "borg output parsing error",
+			Err:        err,
+		}
+	}
+	job.info = &info.Archives[0]
+	return nil
+}
+
+// archiveCollector renders the metrics of the last backup for an archive, with the end of the archive as timestamp
+type archiveCollector struct {
+	metrics     *models.BorgMetrics
+	labelValues []string
+	archive     *parser.InfoOutputArchive
+}
+
+// Describe implements prometheus.Collector
+func (c *archiveCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.metrics.LastBackupDuration
+	ch <- c.metrics.LastBackupCompressedSize
+	ch <- c.metrics.LastBackupDeduplicatedSize
+	ch <- c.metrics.LastBackupFiles
+	ch <- c.metrics.LastBackupOriginalSize
+	ch <- c.metrics.LastBackupTimestamp
+}
+
+// Collect implements prometheus.Collector
+func (c *archiveCollector) Collect(ch chan<- prometheus.Metric) {
+	archive := c.archive
+	timestamp := archive.End.Time
+	if timestamp.IsZero() {
+		timestamp = archive.Start.Add(time.Duration(archive.Duration * float64(time.Second)))
+	}
+	gauge := func(desc *prometheus.Desc, value float64) {
+		metric := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, c.labelValues...)
+		ch <- prometheus.NewMetricWithTimestamp(timestamp, metric)
+	}
+	gauge(c.metrics.LastBackupDuration, archive.Duration)
+	gauge(c.metrics.LastBackupCompressedSize, float64(archive.Stats.CompressedSize))
+	gauge(c.metrics.LastBackupDeduplicatedSize, float64(archive.Stats.DeduplicatedSize))
+	gauge(c.metrics.LastBackupFiles, float64(archive.Stats.NFiles))
+	gauge(c.metrics.LastBackupOriginalSize, float64(archive.Stats.OriginalSize))
+	gauge(c.metrics.LastBackupTimestamp, float64(archive.Start.Unix()))
+}
+
+// backfillFamilies renders the metrics of the collected archives, sorted by name then by timestamp.
+// A registry only accepts a sample per series, so the archives are gathered one by one and their samples merged.
+func (app *Application) backfillFamilies(jobs []*backfillJob) ([]*dto.MetricFamily, error) {
+	families := map[string]*dto.MetricFamily{}
+	for _, job := range jobs {
+		if job.info == nil {
+			continue
+		}
+		labelValues := []string{job.repo.name()}
+		for _, label := range app.extraLabels {
+			labelValues = append(labelValues, job.repo.labels[label])
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(&archiveCollector{metrics: app.metricsCache.Metrics, labelValues: labelValues, archive: job.info})
+		gathered, err := registry.Gather()
+		if err != nil {
+			return nil, err
+		}
+		for _, family := range gathered {
+			if merged, ok := families[family.GetName()]; ok {
+				merged.Metric = append(merged.Metric, family.Metric...)
+			} else {
+				families[family.GetName()] = family
+			}
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sorted := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		family := families[name]
+		// promtool expects the samples of a series in chronological order
+		sort.SliceStable(family.Metric, func(i, j int) bool {
+			return family.Metric[i].GetTimestampMs() < family.Metric[j].GetTimestampMs()
+		})
+		sorted = append(sorted, family)
+	}
+	return sorted, nil
+}
+
+// writeOpenMetrics writes the metric families in the OpenMetrics format, terminated by # EOF
+func writeOpenMetrics(w io.Writer, families []*dto.MetricFamily) error {
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToOpenMetrics(w, family); err != nil {
+			return err
+		}
+	}
+	_, err := expfmt.FinalizeOpenMetrics(w)
+	return err
+}
+
+// writeOpenMetricsFile writes the metric families to the given path, or to the standard output for -.
+// The file is written to a temporary file then renamed, so that a partially written file is never imported.
+func writeOpenMetricsFile(path string, families []*dto.MetricFamily) error {
+	if path == "-" {
+		return writeOpenMetrics(os.Stdout, families)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeOpenMetrics(tmp, families); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
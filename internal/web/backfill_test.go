@@ -0,0 +1,108 @@
+package web
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+const backfillList = `{"archives": [
+	{"name": "laptop-1", "id": "a1", "start": "2024-10-27T02:00:00+00:00", "end": "2024-10-27T02:10:00+00:00"},
+	{"name": "laptop-2", "id": "a2", "start": "2024-10-28T02:00:00+00:00", "end": "2024-10-28T02:20:00+00:00"},
+	{"name": "laptop-3", "id": "a3", "start": "2024-10-29T02:00:00+00:00", "end": "2024-10-29T02:30:00+00:00"}
+]}`
+
+// backfillInfo returns the output of borg info for an archive, without end time when end is empty
+func backfillInfo(name, start, end, duration, files string) []byte {
+	if end != "" {
+		end = `"end": "` + end + `", `
+	}
+	return []byte(`{"archives": [{"name": "` + name + `", "start": "` + start + `", ` + end + `"duration": ` + duration + `,
+		"stats": {"compressed_size": 500, "deduplicated_size": 50, "nfiles": ` + files + `, "original_size": 1000}}]}`)
+}
+
+func TestBackfill(t *testing.T) {
+	runner := &fakeRunner{responses: map[string][]fakeResponse{
+		"list /backups/laptop":           {{stdout: []byte(backfillList)}},
+		"info /backups/laptop::laptop-2": {{stdout: backfillInfo("laptop-2", "2024-10-28T02:00:00+00:00", "2024-10-28T02:20:00+00:00", "1200", "42")}},
+		"info /backups/laptop::laptop-1": {{stdout: backfillInfo("laptop-1", "2024-10-27T02:00:00+00:00", "", "600", "40")}},
+		"info /backups/laptop::laptop-3": {{err: errors.New("exit status 2")}},
+	}}
+	app := newApplication(io.Discard)
+	app.runner = runner
+	app.borgVersions = map[string]string{"borg": "borg 1.2.8"}
+	output := filepath.Join(t.TempDir(), "backfill.om")
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		wantCode int
+		want     string
+	}{
+		{name: "unknown flag", args: []string{"-unknown"}, wantCode: 2},
+		{name: "missing output", args: []string{"-borg-repositories", "/backups/laptop"}, wantCode: 2},
+		{name: "invalid before", args: []string{"-borg-repositories", "/backups/laptop", "-output", output, "-before", "yesterday"}, wantCode: 2},
+		{
+			name: "environment variables",
+			args: []string{"-borg-repositories", "/backups/laptop"},
+			env: map[string]string{
+				"BACKFILL_OUTPUT":                     output,
+				"BACKFILL_BEFORE":                     "2024-10-29T00:00:00Z",
+				"BACKFILL_CONCURRENCY_PER_REPOSITORY": "2",
+			},
+		},
+		{
+			name: "archives before a time",
+			args: []string{"-borg-repositories", "/backups/laptop", "-output", output, "-before", "2024-10-29T00:00:00Z", "-max-concurrency", "2"},
+			want: `# HELP borg_last_backup_compressed_size_bytes Compressed size of the last backup in bytes
+# TYPE borg_last_backup_compressed_size_bytes gauge
+borg_last_backup_compressed_size_bytes{repository="/backups/laptop"} 500.0 1.729995e+09
+borg_last_backup_compressed_size_bytes{repository="/backups/laptop"} 500.0 1.730082e+09
+# HELP borg_last_backup_deduplicated_size_bytes Deduplicated size of the last backup in bytes
+# TYPE borg_last_backup_deduplicated_size_bytes gauge
+borg_last_backup_deduplicated_size_bytes{repository="/backups/laptop"} 50.0 1.729995e+09
+borg_last_backup_deduplicated_size_bytes{repository="/backups/laptop"} 50.0 1.730082e+09
+# HELP borg_last_backup_duration_seconds Duration of the last backup in seconds
+# TYPE borg_last_backup_duration_seconds gauge
+borg_last_backup_duration_seconds{repository="/backups/laptop"} 600.0 1.729995e+09
+borg_last_backup_duration_seconds{repository="/backups/laptop"} 1200.0 1.730082e+09
+# HELP borg_last_backup_files Number of files in the last backup
+# TYPE borg_last_backup_files gauge
+borg_last_backup_files{repository="/backups/laptop"} 40.0 1.729995e+09
+borg_last_backup_files{repository="/backups/laptop"} 42.0 1.730082e+09
+# HELP borg_last_backup_original_size_bytes Original size of the last backup in bytes
+# TYPE borg_last_backup_original_size_bytes gauge
+borg_last_backup_original_size_bytes{repository="/backups/laptop"} 1000.0 1.729995e+09
+borg_last_backup_original_size_bytes{repository="/backups/laptop"} 1000.0 1.730082e+09
+# HELP borg_last_backup_timestamp Timestamp of the last backup
+# TYPE borg_last_backup_timestamp gauge
+borg_last_backup_timestamp{repository="/backups/laptop"} 1.7299944e+09 1.729995e+09
+borg_last_backup_timestamp{repository="/backups/laptop"} 1.7300808e+09 1.730082e+09
+# EOF
+`,
+		},
+		{
+			name:     "failed archive",
+			args:     []string{"-borg-repositories", "/backups/laptop", "-output", output},
+			wantCode: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			if code := app.Backfill("test", tt.args); code != tt.wantCode {
+				t.Fatalf("Expected exit code %d, got %d", tt.wantCode, code)
+			}
+			if tt.want == "" {
+				return
+			}
+			if got := string(mustReadFile(t, output)); got != tt.want {
+				t.Errorf("Expected\n%s\ngot\n%s", tt.want, got)
+			}
+		})
+	}
+}
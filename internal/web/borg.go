@@ -0,0 +1,94 @@
+package web
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"regexp"
+	"strconv"
+)
+
+// borgCommands builds the arguments of the borg commands run by the exporter,
+// as borg 2.x renamed some commands and passes the repository with -r.
+// The commands log in JSON on their standard error with --log-json, see parser.ParseLogJSON.
+type borgCommands interface {
+	// Info returns the arguments to get the information of the last archive and of the repository
+	Info(repository string) []string
+	// List returns the arguments to list all the archives of the repository
+	List(repository string) []string
+	// InfoArchive returns the arguments to get the information of an archive of the repository
+	InfoArchive(repository string, archive parser.ListOutputArchive) []string
+	// Check returns the arguments to check the repository with the given check options
+	Check(repository string, opts []string) []string
+}
+
+// listFormat requests the keys that are not always present in the JSON output of the archives listing
+const listFormat = "{end}{hostname}{username}"
+
+type borg1Commands struct{}
+
+func (c borg1Commands) Info(repository string) []string {
+	return []string{"info", "--log-json", "--last", "1", "--json", repository}
+}
+
+func (c borg1Commands) List(repository string) []string {
+	return []string{"list", "--log-json", "--json", "--format", listFormat, repository}
+}
+
+func (c borg1Commands) InfoArchive(repository string, archive parser.ListOutputArchive) []string {
+	return []string{"info", "--log-json", "--json", repository + "::" + archive.Name}
+}
+
+func (c borg1Commands) Check(repository string, opts []string) []string {
+	args := append([]string{"check", "--log-json"}, opts...)
+	return append(args, repository)
+}
+
+// borg2Commands builds borg 2.x commands.
+// `borg info` still returns the repository, encryption and cache information along with the archives,
+// so `borg repo-info` is not needed.
+type borg2Commands struct{}
+
+func (c borg2Commands) Info(repository string) []string {
+	return []string{"info", "--log-json", "-r", repository, "--last", "1", "--json"}
+}
+
+func (c borg2Commands) List(repository string) []string {
+	return []string{"repo-list", "--log-json", "-r", repository, "--json", "--format", listFormat}
+}
+
+// InfoArchive selects the archive by its id, as borg 2.x allows several archives with the same name
+func (c borg2Commands) InfoArchive(repository string, archive parser.ListOutputArchive) []string {
+	match := archive.Name
+	if archive.ID != "" {
+		match = "aid:" + archive.ID
+	}
+	return []string{"info", "--log-json", "-r", repository, "--json", match}
+}
+
+func (c borg2Commands) Check(repository string, opts []string) []string {
+	return append([]string{"check", "--log-json", "-r", repository}, opts...)
+}
+
+var borgVersionRegexp = regexp.MustCompile(`(\d+)\.\d+`)
+
+// parseBorgMajorVersion returns the major version from the output of `borg --version`, such as "borg 1.2.8".
+// It returns 0 if the version cannot be determined.
+func parseBorgMajorVersion(version string) int {
+	match := borgVersionRegexp.FindStringSubmatch(version)
+	if match == nil {
+		return 0
+	}
+	major, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0
+	}
+	return major
+}
+
+// newBorgDialect returns the command builder and parser to use for the given borg version.
+// Borg 1.x is used when the version is unknown.
+func newBorgDialect(version string) (borgCommands, parser.BorgParserInterface) {
+	if parseBorgMajorVersion(version) >= 2 {
+		return borg2Commands{}, &parser.Borg2Parser{}
+	}
+	return borg1Commands{}, &parser.BorgParser{}
+}
@@ -0,0 +1,73 @@
+package web
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"reflect"
+	"testing"
+)
+
+func TestParseBorgMajorVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    int
+	}{
+		{version: "borg 1.2.8", want: 1},
+		{version: "borg 1.4.0", want: 1},
+		{version: "borg 2.0.0b14", want: 2},
+		{version: "borg-linux64 2.0.0", want: 2},
+		{version: "", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			if got := parseBorgMajorVersion(tt.version); got != tt.want {
+				t.Errorf("Expected major version %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBorgCommands(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     string
+		wantInfo    []string
+		wantList    []string
+		wantArchive []string
+		wantChk     []string
+	}{
+		{
+			name:        "borg 1.x",
+			version:     "borg 1.2.8",
+			wantInfo:    []string{"info", "--log-json", "--last", "1", "--json", "/backups/repo"},
+			wantList:    []string{"list", "--log-json", "--json", "--format", listFormat, "/backups/repo"},
+			wantArchive: []string{"info", "--log-json", "--json", "/backups/repo::laptop-1"},
+			wantChk:     []string{"check", "--log-json", "--repository-only", "/backups/repo"},
+		},
+		{
+			name:        "borg 2.x",
+			version:     "borg 2.0.0b14",
+			wantInfo:    []string{"info", "--log-json", "-r", "/backups/repo", "--last", "1", "--json"},
+			wantList:    []string{"repo-list", "--log-json", "-r", "/backups/repo", "--json", "--format", listFormat},
+			wantArchive: []string{"info", "--log-json", "-r", "/backups/repo", "--json", "aid:a0ef59ab"},
+			wantChk:     []string{"check", "--log-json", "-r", "/backups/repo", "--repository-only"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, _ := newBorgDialect(tt.version)
+			if got := commands.Info("/backups/repo"); !reflect.DeepEqual(got, tt.wantInfo) {
+				t.Errorf("Expected info args %v, got %v", tt.wantInfo, got)
+			}
+			if got := commands.List("/backups/repo"); !reflect.DeepEqual(got, tt.wantList) {
+				t.Errorf("Expected list args %v, got %v", tt.wantList, got)
+			}
+			archive := parser.ListOutputArchive{Name: "laptop-1", ID: "a0ef59ab"}
+			if got := commands.InfoArchive("/backups/repo", archive); !reflect.DeepEqual(got, tt.wantArchive) {
+				t.Errorf("Expected archive info args %v, got %v", tt.wantArchive, got)
+			}
+			if got := commands.Check("/backups/repo", []string{"--repository-only"}); !reflect.DeepEqual(got, tt.wantChk) {
+				t.Errorf("Expected check args %v, got %v", tt.wantChk, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package web
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"github.com/lefeverd/borg-exporter/internal/storage"
+	"strings"
+)
+
+// localPath returns the path of a local repository, or an empty string for a remote repository
+func (r *repository) localPath() string {
+	if r.ssh != nil || r.host() != "" {
+		return ""
+	}
+	if path, ok := strings.CutPrefix(r.location, "file://"); ok {
+		return path
+	}
+	if strings.Contains(r.location, "://") {
+		return ""
+	}
+	return r.location
+}
+
+// collectCapacity stores the capacity of the filesystem containing the repository, or its mount point,
+// and the storage quota of a local repository in the result.
+// The capacity is optional, so the failures are only logged.
+func (app *Application) collectCapacity(repo *repository, result *repositoryResult) {
+	path := repo.localPath()
+	filesystemPath := repo.mountPoint
+	if filesystemPath == "" {
+		filesystemPath = path
+	}
+
+	if filesystemPath != "" {
+		filesystem, err := storage.StatFilesystem(filesystemPath)
+		if err != nil {
+			app.logger.Warn("Cannot get the capacity of the filesystem", "repository", repo.name(), "path", filesystemPath, "error", err)
+		} else {
+			result.filesystem = &models.FilesystemSnapshot{
+				Size:      float64(filesystem.Size),
+				Free:      float64(filesystem.Free),
+				Available: float64(filesystem.Available),
+			}
+		}
+	}
+
+	if path != "" {
+		// Borg 2 repositories don't have a config file
+		config, err := storage.ReadConfig(path)
+		if err != nil {
+			app.logger.Debug("Cannot read the storage quota of the repository", "repository", repo.name(), "error", err)
+		} else {
+			result.storageQuota = float64(config.StorageQuota)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package web
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepositoryLocalPath(t *testing.T) {
+	tests := []struct {
+		repo *repository
+		want string
+	}{
+		{repo: &repository{location: "/backups/laptop"}, want: "/backups/laptop"},
+		{repo: &repository{location: "file:///backups/laptop"}, want: "/backups/laptop"},
+		{repo: &repository{location: "ssh://backup-host/backups/laptop"}, want: ""},
+		{repo: &repository{location: "backup-host:/backups/laptop"}, want: ""},
+		{repo: &repository{location: "/backups/laptop", ssh: &SSHTarget{Host: "backup-host"}}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repo.location, func(t *testing.T) {
+			if got := tt.repo.localPath(); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCollectCapacity(t *testing.T) {
+	path := t.TempDir()
+	config := "[repository]\nversion = 1\nid = 01\nstorage_quota = 1073741824\n"
+	if err := os.WriteFile(filepath.Join(path, "config"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	app := &Application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	tests := []struct {
+		name           string
+		repo           *repository
+		wantFilesystem bool
+		wantQuota      float64
+	}{
+		{name: "local", repo: &repository{location: path}, wantFilesystem: true, wantQuota: 1073741824},
+		{name: "missing", repo: &repository{location: filepath.Join(path, "missing")}},
+		{name: "remote", repo: &repository{location: "ssh://backup-host/backups/laptop"}},
+		{name: "remote with mount point", repo: &repository{location: "ssh://backup-host/backups/laptop", mountPoint: path}, wantFilesystem: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &repositoryResult{}
+			app.collectCapacity(tt.repo, result)
+			if (result.filesystem != nil) != tt.wantFilesystem {
+				t.Errorf("Expected filesystem %v, got %+v", tt.wantFilesystem, result.filesystem)
+			}
+			if result.storageQuota != tt.wantQuota {
+				t.Errorf("Expected quota %v, got %v", tt.wantQuota, result.storageQuota)
+			}
+		})
+	}
+}
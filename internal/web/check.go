@@ -0,0 +1,119 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported borg check modes
+const (
+	CheckModeRepository = "repository"
+	CheckModeArchives   = "archives"
+	CheckModeVerifyData = "verify-data"
+)
+
+// Check runs `borg check` on the configured borg repositories and refreshes the check metrics.
+// As for Collect, it continues with the remaining repositories in case of error and returns all the errors.
+func (app *Application) Check() []error {
+	args, err := app.checkArgs()
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, repo := range app.repositories {
+		startTime := time.Now()
+		app.logger.Debug("Checking repository", "repository", repo.name(), "mode", app.config.checkMode)
+		// Waits for a running collection of the repository, which would otherwise make the check fail to get the lock
+		unlock := app.repositoryLocks.lock(repo.location)
+		// borg check can take hours, so it gets its own timeout instead of the command timeout
+		_, records, err := app.runBorg(context.Background(), repo, app.config.checkTimeout, repo.commands.Check(repo.location, args)...)
+		unlock()
+		app.logger.Debug("Checking repository done", "repository", repo.name(), "duration", time.Since(startTime), "error", err)
+
+		check := &models.CheckSnapshot{
+			Timestamp: time.Now(),
+			Duration:  time.Since(startTime),
+			Success:   err == nil,
+		}
+		var repositoryCollectionError *RepositoryCollectionError
+		if errors.As(err, &repositoryCollectionError) {
+			check.Problems = countCheckProblems(records)
+			if repositoryCollectionError.Category == ErrorCategoryWarning {
+				// The warnings are reported by borg_check_problems, the check itself succeeded
+				app.logger.Warn("Check finished with warnings", "repository", repo.name(), "problems", check.Problems)
+				check.Success = true
+				err = nil
+			} else {
+				repositoryCollectionError.Msg = "borg check error"
+			}
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		app.metricsCache.Lock()
+		snapshot := repositorySnapshot(app.metricsCache, repo)
+		snapshot.Check = check
+		snapshot.AddLogRecords(records, app.metricsCache.LogRecordsLimit)
+		app.metricsCache.Unlock()
+	}
+	return errs
+}
+
+// checkArgs returns the borg check options corresponding to the configured check mode
+func (app *Application) checkArgs() ([]string, error) {
+	switch app.config.checkMode {
+	case CheckModeRepository:
+		return []string{"--repository-only"}, nil
+	case CheckModeArchives:
+		return []string{"--archives-only"}, nil
+	case CheckModeVerifyData:
+		args := []string{"--verify-data"}
+		// Only verify the data of the most recent archives to keep the check duration reasonable
+		if app.config.checkVerifyDataLast > 0 {
+			args = append(args, "--last", strconv.Itoa(app.config.checkVerifyDataLast))
+		}
+		return args, nil
+	default:
+		return nil, fmt.Errorf("unknown check mode %q", app.config.checkMode)
+	}
+}
+
+// countCheckProblems returns the number of problems reported by borg check in its log records.
+// Borg check logs each problem as a warning or an error,
+// followed by a summary which is not counted.
+func countCheckProblems(records []parser.LogRecord) int {
+	var problems int
+	for _, record := range records {
+		if !record.IsWarning() && !record.IsError() {
+			continue
+		}
+		if strings.Contains(record.Message, "errors found") || strings.Contains(record.Message, "problems found") {
+			continue
+		}
+		problems++
+	}
+	return problems
+}
+
+// CheckLoop executes borg check at every check interval.
+func (app *Application) CheckLoop() {
+	opts := NewTaskSchedulerOpts()
+	opts.CheckInterval = app.config.schedulerCheckInterval
+	scheduler := NewTaskScheduler(app.config.checkInterval, opts)
+	for {
+		scheduler.WaitForNextRun()
+		app.logger.Info("Checking repositories", "mode", app.config.checkMode)
+		app.logErrors("Check failed with the following error(s):", app.Check())
+		app.saveState()
+		app.logger.Info("Checking repositories done")
+		scheduler.UpdateLastRun()
+	}
+}
@@ -0,0 +1,170 @@
+package web
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"testing"
+	"time"
+)
+
+func TestCheckArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		last     int
+		wantArgs []string
+		wantErr  bool
+	}{
+		{
+			name:     "repository only",
+			mode:     CheckModeRepository,
+			wantArgs: []string{"--repository-only"},
+		},
+		{
+			name:     "archives only",
+			mode:     CheckModeArchives,
+			wantArgs: []string{"--archives-only"},
+		},
+		{
+			name:     "verify data of all archives",
+			mode:     CheckModeVerifyData,
+			wantArgs: []string{"--verify-data"},
+		},
+		{
+			name:     "verify data of the last archives",
+			mode:     CheckModeVerifyData,
+			last:     3,
+			wantArgs: []string{"--verify-data", "--last", "3"},
+		},
+		{
+			name:    "unknown mode",
+			mode:    "everything",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Application{config: &config{checkMode: tt.mode, checkVerifyDataLast: tt.last}}
+			args, err := app.checkArgs()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if len(args) != len(tt.wantArgs) {
+				t.Fatalf("Expected args %v, got %v", tt.wantArgs, args)
+			}
+			for i := range args {
+				if args[i] != tt.wantArgs[i] {
+					t.Errorf("Expected args %v, got %v", tt.wantArgs, args)
+				}
+			}
+		})
+	}
+}
+
+func TestCountCheckProblems(t *testing.T) {
+	stdErr := `{"type": "log_message", "time": 1730147824.1, "message": "Starting repository check", "levelname": "INFO", "name": "borg.repository"}
+{"type": "log_message", "time": 1730147824.2, "message": "Index object count mismatch.", "levelname": "ERROR", "name": "borg.repository"}
+{"type": "log_message", "time": 1730147824.3, "message": "committed index: 1675085 objects", "levelname": "ERROR", "name": "borg.repository"}
+{"type": "log_message", "time": 1730147824.4, "message": "rebuilt index:   1675084 objects", "levelname": "ERROR", "name": "borg.repository"}
+{"type": "log_message", "time": 1730147824.5, "message": "Completed repository check, errors found.", "levelname": "ERROR", "name": "borg.repository"}
+`
+	if problems := countCheckProblems(parser.ParseLogJSON([]byte(stdErr))); problems != 3 {
+		t.Errorf("Expected 3 problems, got %d", problems)
+	}
+	if problems := countCheckProblems(nil); problems != 0 {
+		t.Errorf("Expected 0 problems, got %d", problems)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	warning := []byte(`{"type": "log_message", "time": 1730147824.2, "message": "Archive metadata damaged.", "levelname": "WARNING", "name": "borg.archive"}`)
+	failure := []byte(`{"type": "log_message", "time": 1730147824.2, "message": "Index object count mismatch.", "levelname": "ERROR", "name": "borg.repository"}`)
+
+	tests := []struct {
+		name         string
+		response     fakeResponse
+		wantErr      bool
+		wantSuccess  bool
+		wantProblems int
+	}{
+		{
+			name:        "success",
+			response:    fakeResponse{},
+			wantSuccess: true,
+		},
+		{
+			name:         "warning",
+			response:     fakeResponse{stderr: warning, err: exitError(1)},
+			wantSuccess:  true,
+			wantProblems: 1,
+		},
+		{
+			name:         "modern warning",
+			response:     fakeResponse{stderr: warning, err: exitError(100)},
+			wantSuccess:  true,
+			wantProblems: 1,
+		},
+		{
+			name:         "error",
+			response:     fakeResponse{stderr: failure, err: exitError(2)},
+			wantErr:      true,
+			wantProblems: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{responses: map[string][]fakeResponse{
+				"check /backups/laptop": {tt.response},
+			}}
+			app := newTestApplication(runner, "/backups/laptop")
+			app.config.checkMode = CheckModeRepository
+			app.config.checkTimeout = time.Second
+
+			errs := app.Check()
+			if (len(errs) != 0) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, errs)
+			}
+			check := app.metricsCache.Repositories["/backups/laptop"].Check
+			if check.Success != tt.wantSuccess {
+				t.Errorf("Expected success %v, got %v", tt.wantSuccess, check.Success)
+			}
+			if check.Problems != tt.wantProblems {
+				t.Errorf("Expected %d problems, got %d", tt.wantProblems, check.Problems)
+			}
+		})
+	}
+}
+
+func TestCollectSkipsCheckedRepository(t *testing.T) {
+	runner := &fakeRunner{responses: map[string][]fakeResponse{
+		"info /backups/laptop": {{stdout: mustReadFile(t, "../parser/testdata/borg-info.json")}},
+	}}
+	app := newTestApplication(runner, "/backups/laptop")
+
+	// A check of the repository is in progress
+	unlock := app.repositoryLocks.lock("/backups/laptop")
+	if errs := app.Collect(); len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if runner.callCount() != 0 {
+		t.Errorf("Expected borg not to run during the check, got %d calls", runner.callCount())
+	}
+	snapshot, ok := app.metricsCache.Repositories["/backups/laptop"]
+	if !ok {
+		t.Fatal("Expected the skipped collection to be recorded")
+	}
+	if snapshot.CollectSkipped != 1 {
+		t.Errorf("Expected 1 skipped collection, got %v", snapshot.CollectSkipped)
+	}
+	if !snapshot.LastCollectTimestamp.IsZero() {
+		t.Error("Expected no collection to be recorded during the check")
+	}
+
+	unlock()
+	if errs := app.Collect(); len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if runner.callCount() != 1 {
+		t.Errorf("Expected borg to run once the check is done, got %d calls", runner.callCount())
+	}
+}
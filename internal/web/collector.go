@@ -3,152 +3,324 @@ package web
 import (
 	"context"
 	"errors"
-	"os/exec"
+	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"sort"
+	"sync"
 	"time"
 )
 
 // Collect collects the metrics from borg and refreshes them in the cache.
-// It collects metrics from the configured borg repositories.
+// It collects metrics from all the configured borg repositories, see collectRepositories.
+func (app *Application) Collect() []error {
+	return app.collectRepositories(app.repositories)
+}
+
+// collectRepositories collects the metrics of the given borg repositories and refreshes them in the cache.
+// The cache is not locked while borg runs: the metrics of a repository are swapped in atomically once it is collected,
+// so that the previous metrics are still served in the meantime.
 // In case of error, it still tries to collect metrics of the remaining repositories.
 // This is why it returns a slice of error, which can come from different repositories.
-func (app *Application) Collect() []error {
+func (app *Application) collectRepositories(repositories []*repository) []error {
 	app.metricsCache.Lock()
-	defer app.metricsCache.Unlock()
-
 	// Check if collection is already in progress
 	if app.metricsCache.Collecting {
+		app.metricsCache.Unlock()
 		app.logger.Info("Metrics collection already in progress, skipping")
 		return nil
 	}
-
 	app.metricsCache.Collecting = true
+	app.metricsCache.Unlock()
+
 	defer func() {
+		app.metricsCache.Lock()
 		app.metricsCache.Collecting = false
+		app.metricsCache.Unlock()
 	}()
 
 	totalStartTime := time.Now()
 
-	// Reset the metrics
-	app.metricsCache.Metrics.LastBackupDuration.Reset()
-	app.metricsCache.Metrics.LastBackupCompressedSize.Reset()
-	app.metricsCache.Metrics.LastBackupDeduplicatedSize.Reset()
-	app.metricsCache.Metrics.LastBackupFiles.Reset()
-	app.metricsCache.Metrics.LastBackupOriginalSize.Reset()
-	app.metricsCache.Metrics.LastBackupTimestamp.Reset()
-
-	app.metricsCache.Metrics.TotalChunks.Reset()
-	app.metricsCache.Metrics.TotalCompressedSize.Reset()
-	app.metricsCache.Metrics.TotalSize.Reset()
-	app.metricsCache.Metrics.TotalUniqueChunks.Reset()
-	app.metricsCache.Metrics.DeduplicatedCompressedSize.Reset()
-	app.metricsCache.Metrics.DeduplicatedSize.Reset()
-
-	app.metricsCache.Metrics.LastCollectDuration.Reset()
-	app.metricsCache.Metrics.LastCollectError.Reset()
-	app.metricsCache.Metrics.LastCollectTimestamp.Reset()
-	// We don't reset CollectErrors as it is an incrementing errors counter
-
-	app.metricsCache.Metrics.LastArchiveInfo.Reset()
-	app.metricsCache.Metrics.RepositoryInfo.Reset()
-
-	// Create command with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), app.config.commandTimeout)
-	defer cancel()
+	// Repositories are collected concurrently by a bounded pool of workers,
+	// with an optional limit per host to avoid opening too many SSH sessions to the same backup server.
+	maxConcurrency := app.config.maxConcurrency
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+	workers := make(chan struct{}, maxConcurrency)
+	hostWorkers := map[string]chan struct{}{}
+	if app.config.maxConcurrencyPerHost > 0 {
+		for _, repo := range repositories {
+			if host := repo.host(); host != "" && hostWorkers[host] == nil {
+				hostWorkers[host] = make(chan struct{}, app.config.maxConcurrencyPerHost)
+			}
+		}
+	}
+
+	// Each worker only writes its own index, so that the errors are returned in the repositories order
+	results := make([]error, len(repositories))
+	var wg sync.WaitGroup
+	for i, repo := range repositories {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Acquire the host slot first, so that a worker waiting for a busy host doesn't hold a global slot
+			if hostWorker := hostWorkers[repo.host()]; hostWorker != nil {
+				hostWorker <- struct{}{}
+				defer func() { <-hostWorker }()
+			}
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			results[i] = app.collectAndRecord(repo)
+		}()
+	}
+	wg.Wait()
 
 	var errs []error
-	for _, borgRepository := range app.borgRepositories {
-		startTime := time.Now()
-		app.logger.Debug("Collecting metrics", "repository", borgRepository)
-		var args []string
-		if app.config.borgOpts != "" {
-			args = append(args, app.config.borgOpts)
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
 		}
-		args = append(args, "info", "--last", "1", "--json", borgRepository)
-		cmd := exec.CommandContext(ctx, app.config.borgPath, args...)
-		output, err := cmd.Output()
-		app.metricsCache.Metrics.LastCollectDuration.WithLabelValues(borgRepository).Set(time.Since(startTime).Seconds())
-		app.metricsCache.Metrics.LastCollectTimestamp.WithLabelValues(borgRepository).Set(float64(time.Now().Unix()))
-		app.logger.Debug("Collecting metrics done", "repository", borgRepository, "duration", time.Since(startTime), "error", err)
+	}
 
-		if err != nil {
-			app.metricsCache.Metrics.LastCollectError.WithLabelValues(borgRepository).Set(1)
-			app.metricsCache.Metrics.CollectErrors.WithLabelValues(borgRepository).Inc()
-
-			var stdErr string
-			var exitError *exec.ExitError
-			if errors.As(err, &exitError) {
-				// Get stderr directly from the ExitError
-				if len(exitError.Stderr) > 0 {
-					stdErr = string(exitError.Stderr)
-				}
-			}
+	app.logger.Debug("Collecting metrics done for the repositories", "duration", time.Since(totalStartTime).Seconds())
+	return errs
+}
 
-			errs = append(errs, &RepositoryCollectionError{
-				Repository: borgRepository,
-				Msg:        "borg command error",
-				Err:        err,
-				StdErr:     stdErr,
-			})
-			continue
+// repositoryResult holds the borg outputs collected for a repository, before they are applied to the metrics
+type repositoryResult struct {
+	info parser.InfoOutput
+	// list is only set when the archives are collected
+	list *parser.ListOutput
+	// records are the log records of the borg commands which ran, even when the collection failed
+	records []parser.LogRecord
+	// filesystem is the capacity of the filesystem of the repository, nil when unknown
+	filesystem *models.FilesystemSnapshot
+	// storageQuota is the storage quota of the repository, 0 when not set or unknown
+	storageQuota float64
+}
+
+// collectAndRecord collects the metrics of a repository and stores the result in its snapshot.
+// In case of error, the data of the previous successful collection is kept and flagged as stale.
+func (app *Application) collectAndRecord(repo *repository) error {
+	// A running borg check holds the repository lock, so the repository is skipped instead of failing with lock_timeout
+	unlock, ok := app.repositoryLocks.tryLock(repo.location)
+	if !ok {
+		app.logger.Warn("Repository check in progress, skipping the collection and keeping the previous metrics", "repository", repo.name())
+		app.metricsCache.Lock()
+		repositorySnapshot(app.metricsCache, repo).CollectSkipped++
+		app.metricsCache.Unlock()
+		return nil
+	}
+	defer unlock()
+
+	startTime := time.Now()
+	app.logger.Debug("Collecting metrics", "repository", repo.name())
+	result, err := app.collectRepository(context.Background(), repo)
+	duration := time.Since(startTime)
+	app.logger.Debug("Collecting metrics done", "repository", repo.name(), "duration", duration, "error", err)
+
+	recordCollection(app.metricsCache, repo, result, err, duration)
+	if err == nil {
+		app.recordHistory(repo, result)
+	}
+	return err
+}
+
+// repositoryLocks serializes the borg commands holding the lock of a repository, such as borg check and the collections
+type repositoryLocks struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// get returns the lock of a repository location, creating it if needed
+func (l *repositoryLocks) get(location string) *sync.Mutex {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.locks == nil {
+		l.locks = map[string]*sync.Mutex{}
+	}
+	lock, ok := l.locks[location]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[location] = lock
+	}
+	return lock
+}
+
+// lock waits for the lock of a repository location and returns the function releasing it
+func (l *repositoryLocks) lock(location string) func() {
+	lock := l.get(location)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// tryLock acquires the lock of a repository location if it is free, and returns the function releasing it
+func (l *repositoryLocks) tryLock(location string) (func(), bool) {
+	lock := l.get(location)
+	if !lock.TryLock() {
+		return nil, false
+	}
+	return lock.Unlock, true
+}
+
+// recordCollection stores the result of the collection of a repository in its snapshot of the given cache
+func recordCollection(cache *models.MetricsCache, repo *repository, result *repositoryResult, err error, duration time.Duration) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	snapshot := repositorySnapshot(cache, repo)
+	if result != nil {
+		snapshot.AddLogRecords(result.records, cache.LogRecordsLimit)
+	}
+	snapshot.LastCollectDuration = duration
+	snapshot.LastCollectTimestamp = time.Now()
+
+	if err != nil {
+		reason := ErrorCategoryCommand
+		var repositoryCollectionError *RepositoryCollectionError
+		if errors.As(err, &repositoryCollectionError) && repositoryCollectionError.Category != "" {
+			reason = repositoryCollectionError.Category
+		}
+		snapshot.LastCollectError = true
+		snapshot.LastCollectErrorReason = string(reason)
+		if snapshot.CollectErrors == nil {
+			snapshot.CollectErrors = map[string]float64{}
+		}
+		snapshot.CollectErrors[string(reason)]++
+		if reason == ErrorCategoryTimeout {
+			snapshot.CollectTimeouts++
+		}
+		return
+	}
+
+	snapshot.LastCollectError = false
+	snapshot.LastCollectErrorReason = ""
+	snapshot.LastCollectSuccessTimestamp = snapshot.LastCollectTimestamp
+	snapshot.Info = &result.info
+	snapshot.List = result.list
+	snapshot.Filesystem = result.filesystem
+	snapshot.StorageQuota = result.storageQuota
+	// Borg 2 doesn't report the deduplicated compressed size
+	if size := float64(result.info.Cache.Stats.DeduplicatedCompressedSize); size > 0 {
+		snapshot.AddSizeSample(models.SizeSample{Timestamp: snapshot.LastCollectTimestamp, Size: size}, cache.ForecastWindow)
+	}
+	cache.LastUpdate = time.Now()
+}
+
+// repositorySnapshot returns the snapshot of a repository in the given cache, with the policies of its configuration.
+// The caller must hold the write lock.
+func repositorySnapshot(cache *models.MetricsCache, repo *repository) *models.RepositorySnapshot {
+	snapshot := cache.Repository(repo.name(), repo.labels)
+	snapshot.Freshness = repo.freshness
+	snapshot.Retention = repo.retention
+	snapshot.Encryption = repo.encryptionPolicy
+	return snapshot
+}
+
+// collectRepository runs borg for a repository and returns the parsed outputs, without touching the metrics.
+// The result is also returned in case of error, with the log records of the borg commands which ran.
+func (app *Application) collectRepository(ctx context.Context, repo *repository) (*repositoryResult, error) {
+	result := &repositoryResult{}
+	output, records, err := app.runBorg(ctx, repo, repo.timeout, repo.commands.Info(repo.location)...)
+	result.records = append(result.records, records...)
+	if err != nil {
+		return result, err
+	}
+
+	result.info, err = repo.parser.ParseInfo(output)
+	if err != nil {
+		return result, &RepositoryCollectionError{
+			Repository: repo.name(),
+			Category:   ErrorCategoryParse,
+			Msg:        "borg output parsing error",
+			Err:        err,
 		}
+	}
 
-		info, err := app.borgParser.ParseInfo(output)
+	app.collectCapacity(repo, result)
+
+	// The retention is checked against the archives listing
+	if app.config.collectArchives || repo.retention != nil {
+		list, records, err := app.listArchives(ctx, repo)
+		result.records = append(result.records, records...)
 		if err != nil {
-			app.metricsCache.Metrics.LastCollectError.WithLabelValues(borgRepository).Set(1)
-			app.metricsCache.Metrics.CollectErrors.WithLabelValues(borgRepository).Inc()
-			errs = append(errs, &RepositoryCollectionError{
-				Repository: borgRepository,
-				Msg:        "borg output parsing error",
-				Err:        err,
-			})
-			continue
+			return result, err
 		}
+		sort.SliceStable(list.Archives, func(i, j int) bool {
+			return list.Archives[i].Start.Before(list.Archives[j].Start.Time)
+		})
+		result.list = &list
+	}
+	return result, nil
+}
 
-		// Update metrics
-		if len(info.Archives) > 0 {
-			// Set archive metrics
-			latest := info.Archives[len(info.Archives)-1]
-
-			app.metricsCache.Metrics.LastBackupDuration.WithLabelValues(borgRepository).Set(latest.Duration)
-			app.metricsCache.Metrics.LastBackupCompressedSize.WithLabelValues(borgRepository).Set(float64(latest.Stats.CompressedSize))
-			app.metricsCache.Metrics.LastBackupDeduplicatedSize.WithLabelValues(borgRepository).Set(float64(latest.Stats.DeduplicatedSize))
-			app.metricsCache.Metrics.LastBackupFiles.WithLabelValues(borgRepository).Set(float64(latest.Stats.NFiles))
-			app.metricsCache.Metrics.LastBackupOriginalSize.WithLabelValues(borgRepository).Set(float64(latest.Stats.OriginalSize))
-			app.metricsCache.Metrics.LastBackupTimestamp.WithLabelValues(borgRepository).Set(float64(latest.Start.Unix()))
-
-			// Set last archive info metric
-			app.metricsCache.Metrics.LastArchiveInfo.WithLabelValues(
-				borgRepository,
-				latest.Comment,
-				latest.Start.Format(time.RFC3339),
-				latest.End.Format(time.RFC3339),
-				latest.Hostname,
-				latest.ID,
-				latest.Name,
-				latest.Username,
-			).Set(1)
+// listArchives lists all the archives of a repository with `borg list` (`borg repo-list` for borg 2.x)
+func (app *Application) listArchives(ctx context.Context, repo *repository) (parser.ListOutput, []parser.LogRecord, error) {
+	output, records, err := app.runBorg(ctx, repo, repo.timeout, repo.commands.List(repo.location)...)
+	if err != nil {
+		return parser.ListOutput{}, records, err
+	}
+
+	list, err := repo.parser.ParseList(output)
+	if err != nil {
+		return parser.ListOutput{}, records, &RepositoryCollectionError{
+			Repository: repo.name(),
+			Category:   ErrorCategoryParse,
+			Msg:        "borg list output parsing error",
+			Err:        err,
 		}
+	}
+	return list, records, nil
+}
 
-		// Set repository metrics
-		app.metricsCache.Metrics.TotalChunks.WithLabelValues(borgRepository).Set(float64(info.Cache.Stats.TotalChunks))
-		app.metricsCache.Metrics.TotalCompressedSize.WithLabelValues(borgRepository).Set(float64(info.Cache.Stats.TotalCompressedSize))
-		app.metricsCache.Metrics.TotalSize.WithLabelValues(borgRepository).Set(float64(info.Cache.Stats.TotalSize))
-		app.metricsCache.Metrics.TotalUniqueChunks.WithLabelValues(borgRepository).Set(float64(info.Cache.Stats.TotalUniqueChunks))
-		app.metricsCache.Metrics.DeduplicatedCompressedSize.WithLabelValues(borgRepository).Set(float64(info.Cache.Stats.DeduplicatedCompressedSize))
-		app.metricsCache.Metrics.DeduplicatedSize.WithLabelValues(borgRepository).Set(float64(info.Cache.Stats.DeduplicatedSize))
+// runBorg runs a borg command for the given repository and returns its standard output and its log records,
+// which are also logged.
+// Each invocation gets its own deadline, after which the command is killed,
+// on top of the deadline of the given context.
+// In case of error, a RepositoryCollectionError containing the messages of the command
+// and the category of the error is returned.
+func (app *Application) runBorg(ctx context.Context, repo *repository, timeout time.Duration, args ...string) ([]byte, []parser.LogRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-		// Set repository info metric
-		app.metricsCache.Metrics.RepositoryInfo.WithLabelValues(
-			borgRepository,
-			info.Repository.ID,
-			info.Repository.LastModified.Format(time.RFC3339),
-			info.Repository.Location,
-		).Set(1)
+	output, stdErr, err := app.runnerFor(repo).Run(ctx, Command{
+		Path: repo.borgPath,
+		Args: append(append([]string{}, repo.borgArgs...), args...),
+		// Borg 1.4 only returns its specific exit codes, used to classify the errors, when requested.
+		// The variables of the repository come last, so that they can override it.
+		Env: append([]string{"BORG_EXIT_CODES=modern"}, repo.env...),
+	})
+	records := parser.ParseLogJSON(stdErr)
+	app.logBorgRecords(repo, records)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, records, &RepositoryCollectionError{
+				Repository: repo.name(),
+				Category:   ErrorCategoryTimeout,
+				Msg:        fmt.Sprintf("borg command timed out after %s", timeout),
+				Err:        err,
+				StdErr:     logMessages(records),
+			}
+		}
 
-		app.metricsCache.Metrics.LastCollectError.WithLabelValues(borgRepository).Set(0)
-		app.metricsCache.LastUpdate = time.Now()
+		return nil, records, &RepositoryCollectionError{
+			Repository: repo.name(),
+			Category:   classifyBorgError(err, stdErr),
+			Msg:        "borg command error",
+			Err:        err,
+			StdErr:     logMessages(records),
+		}
 	}
+	return output, records, nil
+}
 
-	app.logger.Debug("Collecting metrics done for all repositories", "duration", time.Since(totalStartTime).Seconds())
-	return errs
+// runnerFor returns the runner to use for a repository, running borg through ssh for remote hosts
+func (app *Application) runnerFor(repo *repository) CommandRunner {
+	if repo.ssh != nil {
+		return &SSHRunner{Target: *repo.ssh, Runner: app.runner}
+	}
+	return app.runner
 }
@@ -0,0 +1,416 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResponse is the result returned by the fakeRunner for a command
+type fakeResponse struct {
+	stdout []byte
+	stderr []byte
+	err    error
+	// block makes the command wait for its context to be done, to simulate a timeout
+	block bool
+}
+
+// fakeRunner returns canned responses, selected by the borg command and its last argument,
+// such as "info /backups/laptop" for `borg info --last 1 --json /backups/laptop`
+type fakeRunner struct {
+	sync.Mutex
+	responses map[string][]fakeResponse
+	calls     []Command
+}
+
+func (r *fakeRunner) Run(ctx context.Context, command Command) ([]byte, []byte, error) {
+	r.Lock()
+	r.calls = append(r.calls, command)
+	var response *fakeResponse
+	key := command.Args[0] + " " + command.Args[len(command.Args)-1]
+	if responses := r.responses[key]; len(responses) > 0 {
+		response = &responses[0]
+		// The last response is repeated
+		if len(responses) > 1 {
+			r.responses[key] = responses[1:]
+		}
+	}
+	r.Unlock()
+
+	if response == nil {
+		return nil, nil, errors.New("unexpected command")
+	}
+	if response.block {
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	}
+	return response.stdout, response.stderr, response.err
+}
+
+func (r *fakeRunner) callCount() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.calls)
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newTestApplication(runner CommandRunner, locations ...string) *Application {
+	app := &Application{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		config: &config{
+			maxConcurrency:         2,
+			metricsRefreshInterval: time.Minute,
+			archiveSeriesLimit:     30,
+		},
+		runner:       runner,
+		retryDelay:   time.Millisecond,
+		metricsCache: models.NewMetricsCache(models.NewBorgMetrics("borg 1.2.8", nil)),
+	}
+	for _, location := range locations {
+		app.repositories = append(app.repositories, &repository{
+			location:        location,
+			borgPath:        "borg",
+			timeout:         time.Second,
+			refreshInterval: time.Minute,
+			commands:        borg1Commands{},
+			parser:          &parser.BorgParser{},
+		})
+	}
+	return app
+}
+
+// blockingRunner blocks the borg commands until they are released, recording the maximum number of
+// commands running at once, overall and per host of the repository
+type blockingRunner struct {
+	sync.Mutex
+	info       []byte
+	release    chan struct{}
+	running    int
+	maxRunning int
+	hosts      map[string]int
+	maxHosts   map[string]int
+}
+
+func (r *blockingRunner) Run(ctx context.Context, command Command) ([]byte, []byte, error) {
+	host := (&repository{location: command.Args[len(command.Args)-1]}).host()
+	r.Lock()
+	r.running++
+	r.maxRunning = max(r.maxRunning, r.running)
+	r.hosts[host]++
+	r.maxHosts[host] = max(r.maxHosts[host], r.hosts[host])
+	r.Unlock()
+
+	<-r.release
+
+	r.Lock()
+	r.running--
+	r.hosts[host]--
+	r.Unlock()
+	return r.info, nil, nil
+}
+
+func (r *blockingRunner) runningCount() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.running
+}
+
+func TestCollectConcurrency(t *testing.T) {
+	runner := &blockingRunner{
+		info:     mustReadFile(t, "../parser/testdata/borg-info.json"),
+		release:  make(chan struct{}),
+		hosts:    map[string]int{},
+		maxHosts: map[string]int{},
+	}
+	locations := []string{
+		"backup1:/backups/laptop", "backup1:/backups/server", "backup1:/backups/desktop",
+		"ssh://backup2/backups/laptop", "ssh://backup2/backups/server",
+		"/backups/laptop", "/backups/server",
+	}
+	app := newTestApplication(runner, locations...)
+	app.config.maxConcurrency = 3
+	app.config.maxConcurrencyPerHost = 1
+
+	done := make(chan []error)
+	go func() { done <- app.Collect() }()
+
+	// Release the commands one at a time, once the workers had the opportunity to start as many as allowed
+	for range locations {
+		deadline := time.Now().Add(time.Second)
+		for runner.runningCount() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		runner.release <- struct{}{}
+	}
+	if errs := <-done; len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+
+	if runner.maxRunning != 3 {
+		t.Errorf("Expected up to 3 commands running at once, got %d", runner.maxRunning)
+	}
+	for host, maxRunning := range runner.maxHosts {
+		// The local repositories are only limited by the overall concurrency
+		if host != "" && maxRunning != 1 {
+			t.Errorf("Expected up to 1 command running at once on host %s, got %d", host, maxRunning)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	info := mustReadFile(t, "../parser/testdata/borg-info.json")
+	list := mustReadFile(t, "../parser/testdata/borg-list.json")
+
+	tests := []struct {
+		name             string
+		responses        map[string][]fakeResponse
+		collectArchives  bool
+		retention        *models.RetentionPolicy
+		timeout          time.Duration
+		wantCategories   []ErrorCategory
+		wantInfo         map[string]bool
+		wantTimeouts     map[string]float64
+		wantArchiveCount int
+	}{
+		{
+			name: "success",
+			responses: map[string][]fakeResponse{
+				"info /backups/laptop": {{stdout: info}},
+			},
+			wantInfo: map[string]bool{"/backups/laptop": true},
+		},
+		{
+			name: "success with archives",
+			responses: map[string][]fakeResponse{
+				"info /backups/laptop": {{stdout: info}},
+				"list /backups/laptop": {{stdout: list}},
+			},
+			collectArchives:  true,
+			wantInfo:         map[string]bool{"/backups/laptop": true},
+			wantArchiveCount: 2,
+		},
+		{
+			name: "archives listed for the retention",
+			responses: map[string][]fakeResponse{
+				"info /backups/laptop": {{stdout: info}},
+				"list /backups/laptop": {{stdout: list}},
+			},
+			retention:        &models.RetentionPolicy{KeepDaily: 7},
+			wantInfo:         map[string]bool{"/backups/laptop": true},
+			wantArchiveCount: 2,
+		},
+		{
+			name: "borg failure",
+			responses: map[string][]fakeResponse{
+				"info /backups/laptop": {{stderr: []byte("Failed to create/acquire the lock"), err: errors.New("exit status 2")}},
+			},
+			wantCategories: []ErrorCategory{ErrorCategoryLockTimeout},
+			wantInfo:       map[string]bool{"/backups/laptop": false},
+		},
+		{
+			name: "parse failure",
+			responses: map[string][]fakeResponse{
+				"info /backups/laptop": {{stdout: []byte("not json")}},
+			},
+			wantCategories: []ErrorCategory{ErrorCategoryParse},
+			wantInfo:       map[string]bool{"/backups/laptop": false},
+		},
+		{
+			name: "timeout",
+			responses: map[string][]fakeResponse{
+				"info /backups/laptop": {{block: true}},
+			},
+			timeout:        10 * time.Millisecond,
+			wantCategories: []ErrorCategory{ErrorCategoryTimeout},
+			wantInfo:       map[string]bool{"/backups/laptop": false},
+			wantTimeouts:   map[string]float64{"/backups/laptop": 1},
+		},
+		{
+			name: "partial multi-repository failure",
+			responses: map[string][]fakeResponse{
+				"info /backups/laptop": {{stdout: info}},
+				"info /backups/server": {{err: errors.New("exit status 2")}},
+				"info /backups/nas":    {{stdout: info}},
+			},
+			wantCategories: []ErrorCategory{ErrorCategoryCommand},
+			wantInfo:       map[string]bool{"/backups/laptop": true, "/backups/server": false, "/backups/nas": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var locations []string
+			for location := range tt.wantInfo {
+				locations = append(locations, location)
+			}
+			app := newTestApplication(&fakeRunner{responses: tt.responses}, locations...)
+			app.config.collectArchives = tt.collectArchives
+			if tt.timeout > 0 {
+				app.repositories[0].timeout = tt.timeout
+			}
+			app.repositories[0].retention = tt.retention
+
+			errs := app.Collect()
+
+			if len(errs) != len(tt.wantCategories) {
+				t.Fatalf("Expected %d errors, got %v", len(tt.wantCategories), errs)
+			}
+			for i, err := range errs {
+				var repositoryCollectionError *RepositoryCollectionError
+				if !errors.As(err, &repositoryCollectionError) {
+					t.Fatalf("Expected a RepositoryCollectionError, got %v", err)
+				}
+				if repositoryCollectionError.Category != tt.wantCategories[i] {
+					t.Errorf("Expected category %s, got %s", tt.wantCategories[i], repositoryCollectionError.Category)
+				}
+			}
+
+			for location, wantInfo := range tt.wantInfo {
+				snapshot := app.metricsCache.Repositories[location]
+				if snapshot == nil {
+					t.Fatalf("Expected a snapshot for %s", location)
+				}
+				if (snapshot.Info != nil) != wantInfo {
+					t.Errorf("%s: expected info %v, got %v", location, wantInfo, snapshot.Info != nil)
+				}
+				if snapshot.LastCollectError == wantInfo {
+					t.Errorf("%s: unexpected last collect error %v", location, snapshot.LastCollectError)
+				}
+				if snapshot.CollectTimeouts != tt.wantTimeouts[location] {
+					t.Errorf("%s: expected %v timeouts, got %v", location, tt.wantTimeouts[location], snapshot.CollectTimeouts)
+				}
+				if tt.wantArchiveCount > 0 && (snapshot.List == nil || len(snapshot.List.Archives) != tt.wantArchiveCount) {
+					t.Errorf("%s: expected %d archives, got %v", location, tt.wantArchiveCount, snapshot.List)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectKeepsPreviousMetricsOnFailure(t *testing.T) {
+	runner := &fakeRunner{responses: map[string][]fakeResponse{
+		"info /backups/laptop": {
+			{stdout: mustReadFile(t, "../parser/testdata/borg-info.json")},
+			{err: errors.New("exit status 2")},
+		},
+	}}
+	app := newTestApplication(runner, "/backups/laptop")
+
+	if errs := app.Collect(); len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	if errs := app.Collect(); len(errs) != 1 {
+		t.Fatalf("Expected one error, got %v", errs)
+	}
+
+	snapshot := app.metricsCache.Repositories["/backups/laptop"]
+	if snapshot.Info == nil || !snapshot.Stale() {
+		t.Error("Expected the previous info to be kept and flagged as stale")
+	}
+	if snapshot.CollectErrors["command"] != 1 || snapshot.LastCollectErrorReason != "command" {
+		t.Errorf("Expected 1 command collect error, got %v", snapshot.CollectErrors)
+	}
+}
+
+func TestCollectRecordsSizeHistory(t *testing.T) {
+	runner := &fakeRunner{responses: map[string][]fakeResponse{
+		"info /backups/laptop": {{stdout: mustReadFile(t, "../parser/testdata/borg-info.json")}},
+	}}
+	app := newTestApplication(runner, "/backups/laptop")
+	app.metricsCache.ForecastWindow = 24 * time.Hour
+
+	for i := 0; i < 2; i++ {
+		if errs := app.Collect(); len(errs) != 0 {
+			t.Fatalf("Unexpected errors: %v", errs)
+		}
+	}
+
+	snapshot := app.metricsCache.Repositories["/backups/laptop"]
+	if len(snapshot.SizeHistory) != 2 {
+		t.Fatalf("Expected 2 size samples, got %v", snapshot.SizeHistory)
+	}
+	if size := float64(snapshot.Info.Cache.Stats.DeduplicatedCompressedSize); snapshot.SizeHistory[1].Size != size {
+		t.Errorf("Expected the deduplicated compressed size %v, got %v", size, snapshot.SizeHistory[1].Size)
+	}
+}
+
+func TestCollectWrapper(t *testing.T) {
+	info := mustReadFile(t, "../parser/testdata/borg-info.json")
+
+	t.Run("no retry for short refresh intervals", func(t *testing.T) {
+		runner := &fakeRunner{responses: map[string][]fakeResponse{
+			"info /backups/laptop": {{err: errors.New("exit status 2")}},
+		}}
+		app := newTestApplication(runner, "/backups/laptop")
+		// The refresh interval of the repository prevails over the global one
+		app.config.metricsRefreshInterval = time.Hour
+
+		app.CollectWrapper()
+
+		if runner.callCount() != 1 {
+			t.Errorf("Expected 1 call, got %d", runner.callCount())
+		}
+	})
+
+	t.Run("retry until success", func(t *testing.T) {
+		runner := &fakeRunner{responses: map[string][]fakeResponse{
+			"info /backups/laptop": {{err: errors.New("exit status 2")}, {stdout: info}},
+		}}
+		app := newTestApplication(runner, "/backups/laptop")
+		app.repositories[0].refreshInterval = time.Hour
+
+		app.CollectWrapper()
+
+		if runner.callCount() != 2 {
+			t.Errorf("Expected 2 calls, got %d", runner.callCount())
+		}
+		if app.metricsCache.Repositories["/backups/laptop"].LastCollectError {
+			t.Error("Expected the last collection to succeed")
+		}
+	})
+
+	t.Run("retry only the repositories with long refresh intervals", func(t *testing.T) {
+		runner := &fakeRunner{responses: map[string][]fakeResponse{
+			"info /backups/laptop": {{err: errors.New("exit status 2")}},
+			"info /backups/server": {{err: errors.New("exit status 2")}, {stdout: info}},
+		}}
+		app := newTestApplication(runner, "/backups/laptop", "/backups/server")
+		app.repositories[1].refreshInterval = time.Hour
+
+		app.CollectWrapper()
+
+		if runner.callCount() != 3 {
+			t.Errorf("Expected 3 calls, got %d", runner.callCount())
+		}
+	})
+
+	t.Run("retry limit", func(t *testing.T) {
+		runner := &fakeRunner{responses: map[string][]fakeResponse{
+			"info /backups/laptop": {{err: errors.New("exit status 2")}},
+		}}
+		app := newTestApplication(runner, "/backups/laptop")
+		app.repositories[0].refreshInterval = time.Hour
+
+		app.CollectWrapper()
+
+		if runner.callCount() != 6 {
+			t.Errorf("Expected 6 calls, got %d", runner.callCount())
+		}
+	})
+}
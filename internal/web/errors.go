@@ -1,11 +1,45 @@
 package web
 
-import "fmt"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrorCategory categorizes the errors encountered while collecting the metrics of a repository.
+// It is exposed as the reason label of the collection error metrics.
+type ErrorCategory string
+
+const (
+	// ErrorCategoryCommand is used when the borg command failed for another reason
+	ErrorCategoryCommand ErrorCategory = "command"
+	// ErrorCategoryTimeout is used when the borg command did not finish before its deadline
+	ErrorCategoryTimeout ErrorCategory = "timeout"
+	// ErrorCategoryParse is used when the output of the borg command could not be parsed
+	ErrorCategoryParse ErrorCategory = "parse"
+	// ErrorCategoryLockTimeout is used when the repository lock could not be acquired
+	ErrorCategoryLockTimeout ErrorCategory = "lock_timeout"
+	// ErrorCategoryPassphrase is used when the passphrase is missing or wrong, or the key is invalid
+	ErrorCategoryPassphrase ErrorCategory = "passphrase"
+	// ErrorCategoryRepositoryNotFound is used when the repository does not exist or is not a valid repository
+	ErrorCategoryRepositoryNotFound ErrorCategory = "repository_not_found"
+	// ErrorCategoryConnectionClosed is used when the connection to the remote repository was closed
+	ErrorCategoryConnectionClosed ErrorCategory = "connection_closed"
+	// ErrorCategorySSHAuth is used when ssh could not authenticate to the remote host
+	ErrorCategorySSHAuth ErrorCategory = "ssh_auth"
+	// ErrorCategoryCache is used when the borg cache is inconsistent with the repository
+	ErrorCategoryCache ErrorCategory = "cache"
+	// ErrorCategoryWarning is used when borg exited with a warning
+	ErrorCategoryWarning ErrorCategory = "warning"
+)
 
 // RepositoryCollectionError is used in case of error during the metrics collection
 // for a borg repository
 type RepositoryCollectionError struct {
 	Repository string
+	Category   ErrorCategory
 	Msg        string
 	Err        error
 	StdErr     string
@@ -22,3 +56,146 @@ func (e *RepositoryCollectionError) Error() string {
 func (e *RepositoryCollectionError) Unwrap() error {
 	return e.Err
 }
+
+// exitCodeCategories maps the specific exit codes of borg >= 1.4 (with BORG_EXIT_CODES=modern, the default of borg 2)
+// to their category. 2 is the generic error code of all borg versions, which needs the standard error to be classified.
+var exitCodeCategories = map[int]ErrorCategory{
+	1: ErrorCategoryWarning,
+	// Repository.DoesNotExist, Repository.InvalidRepository, Repository.ParentPathDoesNotExist
+	13: ErrorCategoryRepositoryNotFound,
+	15: ErrorCategoryRepositoryNotFound,
+	18: ErrorCategoryRepositoryNotFound,
+	// KeyfileInvalidError, KeyfileMismatchError, KeyfileNotFoundError, NotABorgKeyFile, RepoKeyNotFoundError
+	40: ErrorCategoryPassphrase,
+	41: ErrorCategoryPassphrase,
+	42: ErrorCategoryPassphrase,
+	43: ErrorCategoryPassphrase,
+	44: ErrorCategoryPassphrase,
+	// NoPassphraseFailure, PasscommandFailure, PassphraseWrong, PasswordRetriesExceeded
+	50: ErrorCategoryPassphrase,
+	51: ErrorCategoryPassphrase,
+	52: ErrorCategoryPassphrase,
+	53: ErrorCategoryPassphrase,
+	// Cache.CacheInitAbortedError, Cache.EncryptionMethodMismatch, Cache.RepositoryAccessAborted,
+	// Cache.RepositoryIDNotUnique, Cache.RepositoryReplay
+	60: ErrorCategoryCache,
+	61: ErrorCategoryCache,
+	62: ErrorCategoryCache,
+	63: ErrorCategoryCache,
+	64: ErrorCategoryCache,
+	// LockError, LockErrorT, LockFailed, LockTimeout
+	70: ErrorCategoryLockTimeout,
+	71: ErrorCategoryLockTimeout,
+	72: ErrorCategoryLockTimeout,
+	73: ErrorCategoryLockTimeout,
+	// ConnectionClosed, ConnectionClosedWithHint, ConnectionBrokenWithHint
+	80: ErrorCategoryConnectionClosed,
+	81: ErrorCategoryConnectionClosed,
+	87: ErrorCategoryConnectionClosed,
+	// ssh exits with 255 when it cannot connect, before borg runs on the remote host
+	255: ErrorCategoryConnectionClosed,
+}
+
+// msgidCategories maps the message IDs of the borg --log-json errors to their category
+var msgidCategories = map[string]ErrorCategory{
+	"Repository.DoesNotExist":           ErrorCategoryRepositoryNotFound,
+	"Repository.InvalidRepository":      ErrorCategoryRepositoryNotFound,
+	"Repository.ParentPathDoesNotExist": ErrorCategoryRepositoryNotFound,
+	"KeyfileInvalidError":               ErrorCategoryPassphrase,
+	"KeyfileMismatchError":              ErrorCategoryPassphrase,
+	"KeyfileNotFoundError":              ErrorCategoryPassphrase,
+	"NotABorgKeyFile":                   ErrorCategoryPassphrase,
+	"RepoKeyNotFoundError":              ErrorCategoryPassphrase,
+	"NoPassphraseFailure":               ErrorCategoryPassphrase,
+	"PasscommandFailure":                ErrorCategoryPassphrase,
+	"PassphraseWrong":                   ErrorCategoryPassphrase,
+	"PasswordRetriesExceeded":           ErrorCategoryPassphrase,
+	"Cache.CacheInitAbortedError":       ErrorCategoryCache,
+	"Cache.EncryptionMethodMismatch":    ErrorCategoryCache,
+	"Cache.RepositoryAccessAborted":     ErrorCategoryCache,
+	"Cache.RepositoryIDNotUnique":       ErrorCategoryCache,
+	"Cache.RepositoryReplay":            ErrorCategoryCache,
+	"LockError":                         ErrorCategoryLockTimeout,
+	"LockErrorT":                        ErrorCategoryLockTimeout,
+	"LockFailed":                        ErrorCategoryLockTimeout,
+	"LockTimeout":                       ErrorCategoryLockTimeout,
+	"ConnectionClosed":                  ErrorCategoryConnectionClosed,
+	"ConnectionClosedWithHint":          ErrorCategoryConnectionClosed,
+	"ConnectionBrokenWithHint":          ErrorCategoryConnectionClosed,
+}
+
+// stdErrPatterns classifies the errors from the messages of borg and ssh, for the borg versions
+// returning the generic exit code. They are tried in order, ssh authentication failures first
+// as borg reports them as a closed connection.
+var stdErrPatterns = []struct {
+	pattern  *regexp.Regexp
+	category ErrorCategory
+}{
+	{regexp.MustCompile(`Permission denied \(|Host key verification failed|Too many authentication failures`), ErrorCategorySSHAuth},
+	{regexp.MustCompile(`Failed to create/acquire the lock|lock.*(timeout|timed out)`), ErrorCategoryLockTimeout},
+	{regexp.MustCompile(`(?i)passphrase|passcommand|key file .*(not found|invalid)|No key file`), ErrorCategoryPassphrase},
+	{regexp.MustCompile(`Repository .* does not exist|is not a valid repository|parent path .* does not exist`), ErrorCategoryRepositoryNotFound},
+	{regexp.MustCompile(`(?i)connection closed|connection reset|broken pipe|Could not resolve hostname|Connection refused|Connection timed out`), ErrorCategoryConnectionClosed},
+	{regexp.MustCompile(`(?i)cache .*(newer|inconsistent|initialization aborted)|security dir|previously located at|encryption method mismatch`), ErrorCategoryCache},
+}
+
+// logJSONMessage is the subset of a borg --log-json line used to classify the errors
+type logJSONMessage struct {
+	MsgID string `json:"msgid"`
+}
+
+// classifyBorgError returns the category of a failed borg command from its exit code, the message IDs of its
+// --log-json output, then the messages of its standard error, falling back to ErrorCategoryCommand.
+func classifyBorgError(err error, stdErr []byte) ErrorCategory {
+	category := classifySpecificError(err, stdErr)
+	if category == "" {
+		category = classifyStdErr(stdErr)
+	}
+	switch category {
+	case "":
+		return ErrorCategoryCommand
+	case ErrorCategoryConnectionClosed:
+		// Borg and ssh report an authentication failure as a closed connection
+		if classifyStdErr(stdErr) == ErrorCategorySSHAuth {
+			return ErrorCategorySSHAuth
+		}
+	}
+	return category
+}
+
+// classifySpecificError returns the category of a failed borg command from its specific exit code
+// or from the message IDs of its --log-json output, or an empty category
+func classifySpecificError(err error, stdErr []byte) ErrorCategory {
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		if category, ok := exitCodeCategories[code]; ok {
+			return category
+		}
+		// The modern warning exit codes, such as a file changed while it was backed up
+		if code >= 100 && code <= 127 {
+			return ErrorCategoryWarning
+		}
+	}
+
+	for _, line := range strings.Split(string(stdErr), "\n") {
+		var message logJSONMessage
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &message) != nil {
+			continue
+		}
+		if category, ok := msgidCategories[message.MsgID]; ok {
+			return category
+		}
+	}
+	return ""
+}
+
+// classifyStdErr returns the category of the first pattern matching the standard error, or an empty category
+func classifyStdErr(stdErr []byte) ErrorCategory {
+	for _, p := range stdErrPatterns {
+		if p.pattern.Match(stdErr) {
+			return p.category
+		}
+	}
+	return ""
+}
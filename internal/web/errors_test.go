@@ -0,0 +1,75 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+)
+
+// exitError is an error with an exit code, as *exec.ExitError
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+func (e exitError) ExitCode() int { return int(e) }
+
+func TestClassifyBorgError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		stdErr string
+		want   ErrorCategory
+	}{
+		{name: "warning", err: exitError(1), want: ErrorCategoryWarning},
+		{name: "modern warning", err: exitError(107), want: ErrorCategoryWarning},
+		{name: "modern lock timeout", err: exitError(73), want: ErrorCategoryLockTimeout},
+		{name: "modern wrong passphrase", err: exitError(52), want: ErrorCategoryPassphrase},
+		{name: "modern repository not found", err: exitError(13), want: ErrorCategoryRepositoryNotFound},
+		{name: "modern cache", err: exitError(64), want: ErrorCategoryCache},
+		{
+			name:   "modern connection closed by an ssh authentication failure",
+			err:    exitError(80),
+			stdErr: "borg@backup: Permission denied (publickey).\nConnection closed by remote host\n",
+			want:   ErrorCategorySSHAuth,
+		},
+		{name: "ssh connection failure", err: exitError(255), stdErr: "ssh: Could not resolve hostname backup\n", want: ErrorCategoryConnectionClosed},
+		{
+			name:   "log json message id",
+			err:    exitError(2),
+			stdErr: `{"type": "log_message", "levelname": "ERROR", "name": "borg.archiver", "message": "Failed to create/acquire the lock", "msgid": "LockTimeout"}` + "\n",
+			want:   ErrorCategoryLockTimeout,
+		},
+		{
+			name:   "legacy wrong passphrase",
+			err:    exitError(2),
+			stdErr: "passphrase supplied in BORG_PASSPHRASE, by BORG_PASSCOMMAND or via BORG_PASSPHRASE_FD is incorrect.\n",
+			want:   ErrorCategoryPassphrase,
+		},
+		{name: "legacy repository not found", err: exitError(2), stdErr: "Repository /backups/laptop does not exist.\n", want: ErrorCategoryRepositoryNotFound},
+		{name: "legacy connection closed", err: exitError(2), stdErr: "Connection closed by remote host. Is borg working on the server?\n", want: ErrorCategoryConnectionClosed},
+		{
+			name:   "legacy cache",
+			err:    exitError(2),
+			stdErr: "Cache, or information obtained from the security directory is newer than repository - this is either an attack or unsafe (multiple repos with same ID)\n",
+			want:   ErrorCategoryCache,
+		},
+		{name: "unknown error", err: exitError(2), stdErr: "Something went wrong\n", want: ErrorCategoryCommand},
+		{name: "wrapped exit error", err: fmt.Errorf("running borg: %w", exitError(73)), want: ErrorCategoryLockTimeout},
+		{name: "command not run", err: errors.New("exec: \"borg\": executable file not found in $PATH"), want: ErrorCategoryCommand},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyBorgError(tt.err, []byte(tt.stdErr)); got != tt.want {
+				t.Errorf("Expected category %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestClassifyBorgErrorExitError(t *testing.T) {
+	err := exec.Command("sh", "-c", "exit 73").Run()
+	if got := classifyBorgError(err, nil); got != ErrorCategoryLockTimeout {
+		t.Errorf("Expected category %s, got %s", ErrorCategoryLockTimeout, got)
+	}
+}
@@ -0,0 +1,101 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/history"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordHistory appends the result of a successful collection to the history file, when configured
+func (app *Application) recordHistory(repo *repository, result *repositoryResult) {
+	if app.history == nil {
+		return
+	}
+	record := history.NewRecord(time.Now(), repo.name(), &result.info, result.list)
+	if err := app.history.Append(record); err != nil {
+		app.logger.Error("Cannot record the history", "repository", repo.name(), "error", err)
+	}
+}
+
+// parseHistoryTime parses a time of the history endpoints, given as RFC 3339 or as a unix timestamp.
+// An empty string is the zero time, which doesn't filter the records.
+func parseHistoryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or a unix timestamp", s)
+	}
+	return t, nil
+}
+
+// parseHistoryQuery parses the repository, from and to parameters of the history endpoints
+func parseHistoryQuery(values url.Values) (history.Query, error) {
+	query := history.Query{Repository: values.Get("repository")}
+	var err error
+	if query.From, err = parseHistoryTime(values.Get("from")); err != nil {
+		return query, err
+	}
+	if query.To, err = parseHistoryTime(values.Get("to")); err != nil {
+		return query, err
+	}
+	return query, nil
+}
+
+// HistoryHandler returns the history records of a time range in JSON,
+// optionally of a single repository with the repository parameter.
+func (app *Application) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	app.writeJSON(w, app.history.Query(query))
+}
+
+// HistoryAggregateHandler aggregates a field of the history records of a time range by repository, in JSON.
+// The field parameter is required, and the step parameter is the duration of the buckets, such as 24h.
+func (app *Application) HistoryAggregateHandler(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query, err := parseHistoryQuery(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	field := values.Get("field")
+	if field == "" {
+		http.Error(w, "missing field parameter, one of "+strings.Join(history.Fields(), ", "), http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if s := values.Get("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid step %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	series, err := history.Aggregate(app.history.Query(query), field, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	app.writeJSON(w, series)
+}
+
+// writeJSON writes the JSON response of an endpoint
+func (app *Application) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		app.logger.Error("Cannot write the response", "error", err)
+	}
+}
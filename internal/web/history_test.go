@@ -0,0 +1,71 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/lefeverd/borg-exporter/internal/history"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHistoryHandlers(t *testing.T) {
+	info := mustReadFile(t, "../parser/testdata/borg-info.json")
+	runner := &fakeRunner{responses: map[string][]fakeResponse{
+		"info /backups/laptop": {{stdout: info}},
+		"info /backups/server": {{stdout: info}, {err: errors.New("exit status 2")}},
+	}}
+	app := newTestApplication(runner, "/backups/laptop", "/backups/server")
+	store, err := history.Open(filepath.Join(t.TempDir(), "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	app.history = store
+
+	start := time.Now().Add(-time.Second).Unix()
+	app.Collect()
+	// The failed collection of the server is not recorded
+	app.Collect()
+
+	tests := []struct {
+		name        string
+		path        string
+		handler     http.HandlerFunc
+		wantStatus  int
+		wantResults int
+	}{
+		{name: "all records", path: "/history", handler: app.HistoryHandler, wantStatus: http.StatusOK, wantResults: 3},
+		{name: "repository", path: "/history?repository=/backups/laptop", handler: app.HistoryHandler, wantStatus: http.StatusOK, wantResults: 2},
+		{name: "time range", path: "/history?from=2024-10-29T00:00:00Z&to=" + url.QueryEscape(time.Unix(start, 0).Format(time.RFC3339)), handler: app.HistoryHandler, wantStatus: http.StatusOK, wantResults: 0},
+		{name: "unix time", path: "/history?from=" + strconv.FormatInt(start, 10), handler: app.HistoryHandler, wantStatus: http.StatusOK, wantResults: 3},
+		{name: "invalid time", path: "/history?from=yesterday", handler: app.HistoryHandler, wantStatus: http.StatusBadRequest},
+		{name: "aggregate", path: "/history/aggregate?field=deduplicated_compressed_size&step=24h", handler: app.HistoryAggregateHandler, wantStatus: http.StatusOK, wantResults: 2},
+		{name: "missing field", path: "/history/aggregate", handler: app.HistoryAggregateHandler, wantStatus: http.StatusBadRequest},
+		{name: "unknown field", path: "/history/aggregate?field=unknown", handler: app.HistoryAggregateHandler, wantStatus: http.StatusBadRequest},
+		{name: "invalid step", path: "/history/aggregate?field=total_size&step=daily", handler: app.HistoryAggregateHandler, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			tt.handler(recorder, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, recorder.Code, recorder.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var results []json.RawMessage
+			if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != tt.wantResults {
+				t.Errorf("Expected %d results, got %s", tt.wantResults, recorder.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package web
+
+import (
+	"context"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// logBorgRecords logs the log records of a borg command with their level
+func (app *Application) logBorgRecords(repo *repository, records []parser.LogRecord) {
+	for _, record := range records {
+		app.logger.Log(context.Background(), borgLogLevel(record.Level), record.Message,
+			"repository", repo.name(), "logger", record.Name, "msgid", record.MsgID)
+	}
+}
+
+// borgLogLevel returns the slog level of a borg log level, WARNING when it is unknown
+func borgLogLevel(level string) slog.Level {
+	switch level {
+	case parser.LevelDebug:
+		return slog.LevelDebug
+	case parser.LevelInfo:
+		return slog.LevelInfo
+	case parser.LevelError, parser.LevelCritical:
+		return slog.LevelError
+	default:
+		return slog.LevelWarn
+	}
+}
+
+// logMessages returns the messages of the given records, one per line
+func logMessages(records []parser.LogRecord) string {
+	var messages strings.Builder
+	for _, record := range records {
+		messages.WriteString(record.Message)
+		messages.WriteString("\n")
+	}
+	return messages.String()
+}
+
+// repositoryLogs is the response of the logs endpoint for a repository
+type repositoryLogs struct {
+	Repository string             `json:"repository"`
+	Warnings   float64            `json:"warnings"`
+	Errors     float64            `json:"errors"`
+	Records    []parser.LogRecord `json:"records"`
+}
+
+// LogsHandler returns the last borg log records of the collected repositories in JSON,
+// or of a single repository with the repository parameter.
+func (app *Application) LogsHandler(w http.ResponseWriter, r *http.Request) {
+	repository := r.URL.Query().Get("repository")
+
+	app.metricsCache.RLock()
+	logs := []repositoryLogs{}
+	for name, snapshot := range app.metricsCache.Repositories {
+		if repository != "" && name != repository {
+			continue
+		}
+		logs = append(logs, repositoryLogs{
+			Repository: name,
+			Warnings:   snapshot.LogWarnings,
+			Errors:     snapshot.LogErrors,
+			Records:    append([]parser.LogRecord{}, snapshot.LogRecords...),
+		})
+	}
+	app.metricsCache.RUnlock()
+
+	if repository != "" && len(logs) == 0 {
+		http.Error(w, "unknown repository", http.StatusNotFound)
+		return
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Repository < logs[j].Repository })
+
+	app.writeJSON(w, logs)
+}
@@ -0,0 +1,97 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLogsHandler(t *testing.T) {
+	info := mustReadFile(t, "../parser/testdata/borg-info.json")
+	warning := `{"type": "log_message", "time": 1730147824.5, "message": "Cache is outdated", "levelname": "WARNING", "name": "borg.cache"}` + "\n"
+	lock := `{"type": "log_message", "time": 1730147825.0, "message": "Failed to create/acquire the lock", "levelname": "ERROR", "name": "borg.archiver", "msgid": "LockTimeout"}` + "\n"
+	runner := &fakeRunner{responses: map[string][]fakeResponse{
+		"info /backups/laptop": {{stdout: info, stderr: []byte(warning)}, {stdout: info, stderr: []byte(warning)}},
+		"info /backups/server": {{stderr: []byte(lock), err: exitError(2)}},
+	}}
+	app := newTestApplication(runner, "/backups/laptop", "/backups/server")
+	app.metricsCache.LogRecordsLimit = 1
+	app.Collect()
+	app.Collect()
+
+	expected := `
+# HELP borg_log_messages_total Number of messages logged by borg, by level (warning or error)
+# TYPE borg_log_messages_total counter
+borg_log_messages_total{level="error",repository="/backups/laptop"} 0
+borg_log_messages_total{level="error",repository="/backups/server"} 2
+borg_log_messages_total{level="warning",repository="/backups/laptop"} 2
+borg_log_messages_total{level="warning",repository="/backups/server"} 0
+`
+	if err := testutil.CollectAndCompare(app.metricsCache, strings.NewReader(expected), "borg_log_messages_total"); err != nil {
+		t.Error(err)
+	}
+	if reason := app.metricsCache.Repositories["/backups/server"].LastCollectErrorReason; reason != string(ErrorCategoryLockTimeout) {
+		t.Errorf("Expected the lock timeout to be classified from the message id, got %q", reason)
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		want       []repositoryLogs
+	}{
+		{
+			name:       "all repositories",
+			wantStatus: http.StatusOK,
+			want: []repositoryLogs{
+				{Repository: "/backups/laptop", Warnings: 2, Records: parser.ParseLogJSON([]byte(warning))},
+				{Repository: "/backups/server", Errors: 2, Records: parser.ParseLogJSON([]byte(lock))},
+			},
+		},
+		{
+			name:       "single repository",
+			query:      "?repository=/backups/server",
+			wantStatus: http.StatusOK,
+			want: []repositoryLogs{
+				{Repository: "/backups/server", Errors: 2, Records: parser.ParseLogJSON([]byte(lock))},
+			},
+		},
+		{
+			name:       "unknown repository",
+			query:      "?repository=/backups/nas",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			app.LogsHandler(recorder, httptest.NewRequest(http.MethodGet, "/logs"+tt.query, nil))
+
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, recorder.Code, recorder.Body.String())
+			}
+			if tt.want == nil {
+				return
+			}
+			var got []repositoryLogs
+			if err := json.Unmarshal(recorder.Body.Bytes(), &got); err != nil {
+				t.Fatalf("Invalid response: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSetupNegativeLogRecordsLimit(t *testing.T) {
+	app := newTestApplication(&fakeRunner{})
+	if _, err := app.setup(&config{logRecordsLimit: -1, borgRepositories: "/backups/laptop"}); err == nil {
+		t.Error("Expected an error for a negative log records limit")
+	}
+}
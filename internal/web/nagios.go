@@ -0,0 +1,275 @@
+package web
+
+import (
+	"flag"
+	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pluginStatus is the status of a Nagios plugin, which is also its exit code
+type pluginStatus int
+
+const (
+	statusOK       pluginStatus = 0
+	statusWarning  pluginStatus = 1
+	statusCritical pluginStatus = 2
+	statusUnknown  pluginStatus = 3
+)
+
+func (s pluginStatus) String() string {
+	switch s {
+	case statusOK:
+		return "OK"
+	case statusWarning:
+		return "WARNING"
+	case statusCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// severity orders the statuses from the least to the most severe, CRITICAL being more severe than UNKNOWN
+func (s pluginStatus) severity() int {
+	switch s {
+	case statusOK:
+		return 0
+	case statusWarning:
+		return 1
+	case statusUnknown:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// thresholds holds the warning and critical thresholds of a repository, zero values being disabled
+type thresholds struct {
+	MaxAge          durationThreshold
+	MinFiles        countThreshold
+	MinOriginalSize countThreshold
+	MaxDuration     durationThreshold
+}
+
+type durationThreshold struct {
+	Warning  time.Duration
+	Critical time.Duration
+}
+
+type countThreshold struct {
+	Warning  int64
+	Critical int64
+}
+
+// fileThresholds represents the thresholds of a repository in the configuration file.
+// The thresholds which are not set are nil and take the value of the flags, 0 disabling a threshold.
+type fileThresholds struct {
+	MaxAge          fileDurationThreshold `yaml:"max_age"`
+	MinFiles        fileCountThreshold    `yaml:"min_files"`
+	MinOriginalSize fileCountThreshold    `yaml:"min_original_size"`
+	MaxDuration     fileDurationThreshold `yaml:"max_duration"`
+}
+
+type fileDurationThreshold struct {
+	Warning  *time.Duration `yaml:"warning"`
+	Critical *time.Duration `yaml:"critical"`
+}
+
+type fileCountThreshold struct {
+	Warning  *int64 `yaml:"warning"`
+	Critical *int64 `yaml:"critical"`
+}
+
+// withDefaults returns the thresholds, using the given defaults for the thresholds which are not set
+func (t fileThresholds) withDefaults(defaults thresholds) thresholds {
+	orDuration := func(value *time.Duration, fallback time.Duration) time.Duration {
+		if value == nil {
+			return fallback
+		}
+		return *value
+	}
+	orCount := func(value *int64, fallback int64) int64 {
+		if value == nil {
+			return fallback
+		}
+		return *value
+	}
+	return thresholds{
+		MaxAge: durationThreshold{
+			Warning:  orDuration(t.MaxAge.Warning, defaults.MaxAge.Warning),
+			Critical: orDuration(t.MaxAge.Critical, defaults.MaxAge.Critical),
+		},
+		MinFiles: countThreshold{
+			Warning:  orCount(t.MinFiles.Warning, defaults.MinFiles.Warning),
+			Critical: orCount(t.MinFiles.Critical, defaults.MinFiles.Critical),
+		},
+		MinOriginalSize: countThreshold{
+			Warning:  orCount(t.MinOriginalSize.Warning, defaults.MinOriginalSize.Warning),
+			Critical: orCount(t.MinOriginalSize.Critical, defaults.MinOriginalSize.Critical),
+		},
+		MaxDuration: durationThreshold{
+			Warning:  orDuration(t.MaxDuration.Warning, defaults.MaxDuration.Warning),
+			Critical: orDuration(t.MaxDuration.Critical, defaults.MaxDuration.Critical),
+		},
+	}
+}
+
+// repositoryCheckResult is the result of the evaluation of the thresholds of a repository
+type repositoryCheckResult struct {
+	status   pluginStatus
+	messages []string
+	perfdata []string
+}
+
+// raise sets the status of the result when the given status is more severe, and records its message
+func (r *repositoryCheckResult) raise(status pluginStatus, message string) {
+	if status.severity() > r.status.severity() {
+		r.status = status
+	}
+	r.messages = append(r.messages, message)
+}
+
+// NagiosCheck collects the metrics of the configured repositories once, evaluates their thresholds
+// and prints the result in the Nagios plugin format, with perfdata.
+// The logs must not be written to the standard output, which is reserved to the plugin output.
+// It returns the exit code of the check subcommand, which is the status of the most severe repository,
+// or UNKNOWN for invalid flags, as the other exit codes would be read as a backup problem.
+func (app *Application) NagiosCheck(out io.Writer, args []string) int {
+	var cfg config
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	app.registerCollectionFlags(fs, &cfg)
+	fs.DurationVar(&cfg.thresholds.MaxAge.Warning, "warning-max-age", app.getDurationEnv("THRESHOLD_WARNING_MAX_AGE", 26*time.Hour), "warning when the last backup is older (default 26h)")
+	fs.DurationVar(&cfg.thresholds.MaxAge.Critical, "critical-max-age", app.getDurationEnv("THRESHOLD_CRITICAL_MAX_AGE", 50*time.Hour), "critical when the last backup is older (default 50h)")
+	fs.Int64Var(&cfg.thresholds.MinFiles.Warning, "warning-min-files", int64(app.getIntEnv("THRESHOLD_WARNING_MIN_FILES", 0)), "warning when the last backup has less files, 0 to disable (default 0)")
+	fs.Int64Var(&cfg.thresholds.MinFiles.Critical, "critical-min-files", int64(app.getIntEnv("THRESHOLD_CRITICAL_MIN_FILES", 0)), "critical when the last backup has less files, 0 to disable (default 0)")
+	fs.Int64Var(&cfg.thresholds.MinOriginalSize.Warning, "warning-min-original-size", int64(app.getIntEnv("THRESHOLD_WARNING_MIN_ORIGINAL_SIZE", 0)), "warning when the original size of the last backup is smaller, in bytes, 0 to disable (default 0)")
+	fs.Int64Var(&cfg.thresholds.MinOriginalSize.Critical, "critical-min-original-size", int64(app.getIntEnv("THRESHOLD_CRITICAL_MIN_ORIGINAL_SIZE", 0)), "critical when the original size of the last backup is smaller, in bytes, 0 to disable (default 0)")
+	fs.DurationVar(&cfg.thresholds.MaxDuration.Warning, "warning-max-duration", app.getDurationEnv("THRESHOLD_WARNING_MAX_DURATION", 0), "warning when the last backup took longer, 0 to disable (default 0)")
+	fs.DurationVar(&cfg.thresholds.MaxDuration.Critical, "critical-max-duration", app.getDurationEnv("THRESHOLD_CRITICAL_MAX_DURATION", 0), "critical when the last backup took longer, 0 to disable (default 0)")
+	if err := app.parseFlags(fs, args); err != nil {
+		fmt.Fprintf(out, "BORG UNKNOWN - invalid configuration: %s\n", err)
+		return int(statusUnknown)
+	}
+
+	if _, err := app.setup(&cfg); err != nil {
+		fmt.Fprintf(out, "BORG UNKNOWN - invalid configuration: %s\n", err)
+		return int(statusUnknown)
+	}
+	if len(app.repositories) == 0 {
+		fmt.Fprintln(out, "BORG UNKNOWN - no borg repositories defined")
+		return int(statusUnknown)
+	}
+
+	errs := app.Collect()
+	app.logErrors("Collection failed with the following error(s):", errs)
+
+	now := time.Now()
+	status := statusOK
+	var problems, details, perfdataItems []string
+	app.metricsCache.RLock()
+	for _, repo := range app.repositories {
+		result := evaluateThresholds(app.metricsCache.Repositories[repo.name()], repo.thresholds, now)
+		if result.status.severity() > status.severity() {
+			status = result.status
+		}
+		summary := fmt.Sprintf("%s: %s", repo.name(), strings.Join(result.messages, ", "))
+		if result.status != statusOK {
+			problems = append(problems, summary)
+		}
+		details = append(details, fmt.Sprintf("[%s] %s", result.status, summary))
+		perfdataItems = append(perfdataItems, result.perfdata...)
+	}
+	app.metricsCache.RUnlock()
+
+	summary := fmt.Sprintf("%d repositories OK", len(app.repositories))
+	if len(problems) > 0 {
+		summary = strings.Join(problems, "; ")
+	}
+	if len(perfdataItems) > 0 {
+		summary += " | " + strings.Join(perfdataItems, " ")
+	}
+	fmt.Fprintf(out, "BORG %s - %s\n", status, summary)
+	fmt.Fprintln(out, strings.Join(details, "\n"))
+	return int(status)
+}
+
+// evaluateThresholds evaluates the thresholds of a repository against the last backup of its snapshot
+func evaluateThresholds(snapshot *models.RepositorySnapshot, t thresholds, now time.Time) repositoryCheckResult {
+	result := repositoryCheckResult{}
+	if snapshot == nil || snapshot.LastCollectError || snapshot.Info == nil {
+		message := "cannot collect the repository"
+		if snapshot != nil && snapshot.LastCollectErrorReason != "" {
+			message += " (" + snapshot.LastCollectErrorReason + ")"
+		}
+		result.raise(statusUnknown, message)
+		return result
+	}
+	if len(snapshot.Info.Archives) == 0 {
+		result.raise(statusCritical, "no backup")
+		return result
+	}
+
+	name := snapshot.Repository
+	latest := snapshot.Info.Archives[len(snapshot.Info.Archives)-1]
+	age := now.Sub(latest.Start.Time)
+	duration := time.Duration(latest.Duration * float64(time.Second))
+
+	checkMax := func(label string, value, warning, critical time.Duration) {
+		switch {
+		case critical > 0 && value > critical:
+			result.raise(statusCritical, fmt.Sprintf("%s %s > %s", label, value.Round(time.Second), critical))
+		case warning > 0 && value > warning:
+			result.raise(statusWarning, fmt.Sprintf("%s %s > %s", label, value.Round(time.Second), warning))
+		default:
+			result.messages = append(result.messages, fmt.Sprintf("%s %s", label, value.Round(time.Second)))
+		}
+	}
+	checkMin := func(label string, value, warning, critical int64) {
+		switch {
+		case critical > 0 && value < critical:
+			result.raise(statusCritical, fmt.Sprintf("%s %d < %d", label, value, critical))
+		case warning > 0 && value < warning:
+			result.raise(statusWarning, fmt.Sprintf("%s %d < %d", label, value, warning))
+		default:
+			result.messages = append(result.messages, fmt.Sprintf("%s %d", label, value))
+		}
+	}
+	checkMax("age", age, t.MaxAge.Warning, t.MaxAge.Critical)
+	checkMin("files", latest.Stats.NFiles, t.MinFiles.Warning, t.MinFiles.Critical)
+	checkMin("original size", latest.Stats.OriginalSize, t.MinOriginalSize.Warning, t.MinOriginalSize.Critical)
+	checkMax("duration", duration, t.MaxDuration.Warning, t.MaxDuration.Critical)
+
+	result.perfdata = []string{
+		perfdata(name+" age", age.Seconds(), "s", maxRange(t.MaxAge.Warning.Seconds()), maxRange(t.MaxAge.Critical.Seconds())),
+		perfdata(name+" files", float64(latest.Stats.NFiles), "", minRange(t.MinFiles.Warning), minRange(t.MinFiles.Critical)),
+		perfdata(name+" original size", float64(latest.Stats.OriginalSize), "B", minRange(t.MinOriginalSize.Warning), minRange(t.MinOriginalSize.Critical)),
+		perfdata(name+" duration", duration.Seconds(), "s", maxRange(t.MaxDuration.Warning.Seconds()), maxRange(t.MaxDuration.Critical.Seconds())),
+	}
+	return result
+}
+
+// perfdata formats a Nagios performance data item: 'label'=value[UOM];[warn];[crit];[min];[max]
+func perfdata(label string, value float64, uom string, warning, critical string) string {
+	label = strings.ReplaceAll(label, "'", "''")
+	return fmt.Sprintf("'%s'=%s%s;%s;%s;0;", label, strconv.FormatFloat(value, 'f', -1, 64), uom, warning, critical)
+}
+
+// maxRange returns the Nagios range alerting above the given value, empty when disabled
+func maxRange(value float64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// minRange returns the Nagios range alerting below the given value, empty when disabled
+func minRange(value int64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatInt(value, 10) + ":"
+}
@@ -0,0 +1,222 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluateThresholds(t *testing.T) {
+	now := time.Date(2024, 10, 29, 20, 0, 0, 0, time.UTC)
+	snapshot := func(start time.Time, nfiles int64, duration float64) *models.RepositorySnapshot {
+		return &models.RepositorySnapshot{
+			Repository: "laptop",
+			Info: &parser.InfoOutput{Archives: []parser.InfoOutputArchive{{
+				Start:    parser.BorgTime{Time: start},
+				Duration: duration,
+				Stats:    parser.InfoOutputArchiveStats{NFiles: nfiles, OriginalSize: 1000},
+			}}},
+		}
+	}
+	thresholdsFor := func(warningAge, criticalAge time.Duration, warningFiles, criticalFiles int64) thresholds {
+		return thresholds{
+			MaxAge:   durationThreshold{Warning: warningAge, Critical: criticalAge},
+			MinFiles: countThreshold{Warning: warningFiles, Critical: criticalFiles},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		snapshot     *models.RepositorySnapshot
+		thresholds   thresholds
+		wantStatus   pluginStatus
+		wantMessage  string
+		wantPerfdata string
+	}{
+		{
+			name:         "ok",
+			snapshot:     snapshot(now.Add(-2*time.Hour), 100, 60),
+			thresholds:   thresholdsFor(26*time.Hour, 50*time.Hour, 10, 1),
+			wantStatus:   statusOK,
+			wantMessage:  "age 2h0m0s",
+			wantPerfdata: "'laptop age'=7200s;93600;180000;0;",
+		},
+		{
+			name:        "warning age",
+			snapshot:    snapshot(now.Add(-30*time.Hour), 100, 60),
+			thresholds:  thresholdsFor(26*time.Hour, 50*time.Hour, 10, 1),
+			wantStatus:  statusWarning,
+			wantMessage: "age 30h0m0s > 26h0m0s",
+		},
+		{
+			name:         "critical files",
+			snapshot:     snapshot(now.Add(-2*time.Hour), 5, 60),
+			thresholds:   thresholdsFor(26*time.Hour, 50*time.Hour, 100, 10),
+			wantStatus:   statusCritical,
+			wantMessage:  "files 5 < 10",
+			wantPerfdata: "'laptop files'=5;100:;10:;0;",
+		},
+		{
+			name:         "disabled thresholds",
+			snapshot:     snapshot(now.Add(-100*time.Hour), 0, 60),
+			wantStatus:   statusOK,
+			wantPerfdata: "'laptop files'=0;;;0;",
+		},
+		{
+			name:        "collection error",
+			snapshot:    &models.RepositorySnapshot{Repository: "laptop", LastCollectError: true, LastCollectErrorReason: "passphrase"},
+			wantStatus:  statusUnknown,
+			wantMessage: "cannot collect the repository (passphrase)",
+		},
+		{
+			name:        "no backup",
+			snapshot:    &models.RepositorySnapshot{Repository: "laptop", Info: &parser.InfoOutput{}},
+			wantStatus:  statusCritical,
+			wantMessage: "no backup",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := evaluateThresholds(tt.snapshot, tt.thresholds, now)
+			if result.status != tt.wantStatus {
+				t.Errorf("Expected status %s, got %s (%v)", tt.wantStatus, result.status, result.messages)
+			}
+			if tt.wantMessage != "" && !strings.Contains(strings.Join(result.messages, ", "), tt.wantMessage) {
+				t.Errorf("Expected message %q, got %v", tt.wantMessage, result.messages)
+			}
+			if tt.wantPerfdata != "" && !strings.Contains(strings.Join(result.perfdata, " "), tt.wantPerfdata) {
+				t.Errorf("Expected perfdata %q, got %v", tt.wantPerfdata, result.perfdata)
+			}
+		})
+	}
+}
+
+func TestThresholdsWithDefaults(t *testing.T) {
+	defaults := thresholds{
+		MaxAge:   durationThreshold{Warning: 26 * time.Hour, Critical: 50 * time.Hour},
+		MinFiles: countThreshold{Warning: 10},
+	}
+	critical := 8 * 24 * time.Hour
+	var disabled int64
+	got := fileThresholds{
+		MaxAge:   fileDurationThreshold{Critical: &critical},
+		MinFiles: fileCountThreshold{Warning: &disabled},
+	}.withDefaults(defaults)
+
+	want := thresholds{
+		MaxAge: durationThreshold{Warning: 26 * time.Hour, Critical: 8 * 24 * time.Hour},
+	}
+	if got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestNagiosCheck(t *testing.T) {
+	info := mustReadFile(t, "../parser/testdata/borg-info.json")
+
+	tests := []struct {
+		name         string
+		args         []string
+		serverErr    error
+		wantExitCode int
+		wantOutput   string
+	}{
+		{
+			name:         "ok",
+			args:         []string{"-critical-max-age", "0", "-warning-max-age", "0"},
+			wantExitCode: 0,
+			wantOutput:   "BORG OK - 2 repositories OK | ",
+		},
+		{
+			name:         "critical",
+			args:         []string{"-critical-max-age", "0", "-warning-max-age", "0", "-critical-min-files", "20000000"},
+			wantExitCode: 2,
+			wantOutput:   "BORG CRITICAL - /backups/laptop: age",
+		},
+		{
+			name:         "unknown",
+			args:         []string{"-critical-max-age", "0", "-warning-max-age", "0"},
+			serverErr:    errors.New("exit status 2"),
+			wantExitCode: 3,
+			wantOutput:   "BORG UNKNOWN - /backups/server: cannot collect the repository",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{responses: map[string][]fakeResponse{
+				"--version --version":  {{stdout: []byte("borg 1.2.8\n")}},
+				"info /backups/laptop": {{stdout: info}},
+				"info /backups/server": {{stdout: info}},
+			}}
+			if tt.serverErr != nil {
+				runner.responses["info /backups/server"] = []fakeResponse{{err: tt.serverErr}}
+			}
+			app := newTestApplication(runner)
+			var out bytes.Buffer
+
+			exitCode := app.NagiosCheck(&out, append([]string{"-borg-repositories", "/backups/laptop,/backups/server"}, tt.args...))
+
+			if exitCode != tt.wantExitCode {
+				t.Errorf("Expected exit code %d, got %d", tt.wantExitCode, exitCode)
+			}
+			if !strings.HasPrefix(out.String(), tt.wantOutput) {
+				t.Errorf("Expected output starting with %q, got:\n%s", tt.wantOutput, out.String())
+			}
+			if !strings.Contains(out.String(), "'/backups/laptop files'=13079758;") {
+				t.Errorf("Expected the perfdata of the repository, got:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestNagiosCheckErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		env        map[string]string
+		serverErr  error
+		wantOutput string
+	}{
+		{
+			name:       "unknown flag",
+			args:       []string{"-warning-max-ag", "1h"},
+			wantOutput: "BORG UNKNOWN - invalid configuration: flag provided but not defined: -warning-max-ag\n",
+		},
+		{
+			name:       "invalid environment variable",
+			env:        map[string]string{"THRESHOLD_WARNING_MAX_AGE": "1 day"},
+			wantOutput: "BORG UNKNOWN - invalid configuration: cannot parse duration of THRESHOLD_WARNING_MAX_AGE: ",
+		},
+		{
+			name:       "no perfdata",
+			serverErr:  errors.New("exit status 2"),
+			wantOutput: "BORG UNKNOWN - /backups/server: cannot collect the repository (command)\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			runner := &fakeRunner{responses: map[string][]fakeResponse{
+				"--version --version":  {{stdout: []byte("borg 1.2.8\n")}},
+				"info /backups/server": {{err: tt.serverErr}},
+			}}
+			app := newTestApplication(runner)
+			var out bytes.Buffer
+
+			exitCode := app.NagiosCheck(&out, append([]string{"-borg-repositories", "/backups/server"}, tt.args...))
+
+			if exitCode != int(statusUnknown) {
+				t.Errorf("Expected exit code %d, got %d", statusUnknown, exitCode)
+			}
+			if !strings.HasPrefix(out.String(), tt.wantOutput) {
+				t.Errorf("Expected output starting with %q, got:\n%s", tt.wantOutput, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeTimeoutOffset is subtracted from the Prometheus scrape timeout, to leave time to send the response
+const probeTimeoutOffset = 500 * time.Millisecond
+
+// probeResult holds the metrics of the last probe of a target.
+// It is locked while the target is probed, so that concurrent probes of the same target run borg only once.
+type probeResult struct {
+	sync.Mutex
+	registry *prometheus.Registry
+	expiry   time.Time
+}
+
+// probeCache holds the results of the probes by target, to avoid running borg on every scrape
+type probeCache struct {
+	sync.Mutex
+	results map[string]*probeResult
+}
+
+// result returns the result of a target, creating it if needed.
+// The expired results of the other targets are removed, unless they are being probed.
+func (c *probeCache) result(target string) *probeResult {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.results == nil {
+		c.results = map[string]*probeResult{}
+	}
+	now := time.Now()
+	for name, result := range c.results {
+		if name == target || !result.TryLock() {
+			continue
+		}
+		if now.After(result.expiry) {
+			delete(c.results, name)
+		}
+		result.Unlock()
+	}
+
+	result, ok := c.results[target]
+	if !ok {
+		result = &probeResult{}
+		c.results[target] = result
+	}
+	return result
+}
+
+// ProbeHandler collects the metrics of the repository given by the target parameter, in the style of the blackbox exporter.
+// The target is either the name of a configured repository, collected with its settings,
+// or, with PROBE_ANY_TARGET, a repository location, collected with the settings of the flags and environment variables.
+// The metrics are reused during PROBE_CACHE_TTL.
+// While the repository is locked by borg check or by a collection, the probe fails with 503 Service Unavailable.
+func (app *Application) ProbeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if err := app.validateProbeTarget(target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := app.probes.result(target)
+	result.Lock()
+	if result.registry == nil || time.Now().After(result.expiry) {
+		registry, err := app.probe(target, app.probeTimeout(r))
+		if err != nil {
+			result.Unlock()
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		result.registry = registry
+		result.expiry = time.Now().Add(app.config.probeCacheTTL)
+	}
+	registry := result.registry
+	result.Unlock()
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probe collects the metrics of a target and returns a registry containing only its metrics.
+// Errors are not returned but exposed by the collection metrics, as for the collected repositories.
+// An error is only returned when the repository is busy, as running borg would wait for the repository lock.
+func (app *Application) probe(target string, timeout time.Duration) (*prometheus.Registry, error) {
+	repo := app.probeRepository(target)
+	unlock, ok := app.repositoryLocks.tryLock(repo.location)
+	if !ok {
+		app.logger.Warn("Repository busy, a check or a collection is in progress, skipping the probe", "repository", repo.name())
+		return nil, fmt.Errorf("repository %q is busy, a check or a collection is in progress", repo.name())
+	}
+	defer unlock()
+	borgVersion := app.setBorgDialect(repo)
+
+	// The context bounds the whole probe, on top of the timeout of each borg command
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	startTime := time.Now()
+	app.logger.Debug("Probing repository", "repository", repo.name(), "timeout", timeout)
+	result, err := app.collectRepository(ctx, repo)
+	duration := time.Since(startTime)
+	app.logger.Debug("Probing repository done", "repository", repo.name(), "duration", duration, "error", err)
+	if err != nil {
+		app.logErrors("Probe failed with the following error(s):", []error{err})
+	}
+
+	metrics := models.NewBorgMetrics(borgVersion, extraLabelNames([]*repository{repo}))
+	metrics.ArchiveMetrics = app.config.collectArchives
+	metrics.ArchiveSeriesLimit = app.config.archiveSeriesLimit
+	cache := models.NewMetricsCache(metrics)
+	cache.LogRecordsLimit = app.config.logRecordsLimit
+	recordCollection(cache, repo, result, err, duration)
+
+	registry := prometheus.NewRegistry()
+	cache.Register(registry)
+	return registry, nil
+}
+
+// probeRepository returns the repository corresponding to a probe target,
+// matching the name or the location of the configured repositories first.
+// A copy is returned, so that the configured repository is not modified.
+func (app *Application) probeRepository(target string) *repository {
+	if repo := app.findRepository(target); repo != nil {
+		probed := *repo
+		return &probed
+	}
+	return newDefaultRepository(app.config, target)
+}
+
+// validateProbeTarget returns an error when the target is not a configured repository, unless any target is accepted.
+// As the target is passed to borg, an option such as --rsh is always rejected.
+func (app *Application) validateProbeTarget(target string) error {
+	if app.findRepository(target) != nil {
+		return nil
+	}
+	if !app.config.probeAnyTarget {
+		return fmt.Errorf("target %q is not a configured repository", target)
+	}
+	if strings.HasPrefix(target, "-") {
+		return fmt.Errorf("invalid target %q", target)
+	}
+	return nil
+}
+
+// findRepository returns the configured repository with the given name or location, nil when there is none
+func (app *Application) findRepository(target string) *repository {
+	for _, repo := range app.repositories {
+		if repo.name() == target || repo.location == target {
+			return repo
+		}
+	}
+	return nil
+}
+
+// probeTimeout returns the timeout of a probe, PROBE_TIMEOUT reduced to the Prometheus scrape timeout when shorter
+func (app *Application) probeTimeout(r *http.Request) time.Duration {
+	timeout := app.config.probeTimeout
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return timeout
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		app.logger.Warn("Cannot parse the scrape timeout", "value", header, "error", err)
+		return timeout
+	}
+	scrapeTimeout := time.Duration(seconds*float64(time.Second)) - probeTimeoutOffset
+	if scrapeTimeout > 0 && scrapeTimeout < timeout {
+		return scrapeTimeout
+	}
+	return timeout
+}
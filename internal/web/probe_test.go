@@ -0,0 +1,198 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeHandler(t *testing.T) {
+	info := mustReadFile(t, "../parser/testdata/borg-info.json")
+	runner := &fakeRunner{responses: map[string][]fakeResponse{
+		"--version --version":  {{stdout: []byte("borg 1.2.8\n")}},
+		"info /backups/laptop": {{stdout: info}},
+		"info /backups/server": {{stdout: info}},
+	}}
+	app := newTestApplication(runner, "/backups/laptop")
+	app.repositories[0].alias = "laptop"
+	app.config.borgPath = "/usr/local/bin/borg"
+	app.config.commandTimeout = time.Second
+	app.config.probeTimeout = time.Second
+	app.config.probeCacheTTL = time.Minute
+	app.config.probeAnyTarget = true
+	// Detected at startup for the configured repositories
+	app.borgVersions = map[string]string{"borg": "borg 1.2.8"}
+
+	probe := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		app.ProbeHandler(recorder, httptest.NewRequest(http.MethodGet, "/probe?target="+target, nil))
+		return recorder
+	}
+
+	tests := []struct {
+		name       string
+		target     string
+		wantSeries string
+		wantCalls  int
+	}{
+		{
+			name:       "configured repository",
+			target:     "laptop",
+			wantSeries: `borg_last_collect_error{reason="",repository="laptop"} 0`,
+			wantCalls:  1,
+		},
+		{
+			name:       "cached result",
+			target:     "laptop",
+			wantSeries: `borg_last_collect_error{reason="",repository="laptop"} 0`,
+			wantCalls:  1,
+		},
+		{
+			name:       "repository location",
+			target:     "/backups/server",
+			wantSeries: `borg_last_collect_error{reason="",repository="/backups/server"} 0`,
+			// the version of the default borg binary is detected first
+			wantCalls: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := probe(tt.target)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", recorder.Code)
+			}
+			body := recorder.Body.String()
+			if !strings.Contains(body, tt.wantSeries) {
+				t.Errorf("Expected %s in:\n%s", tt.wantSeries, body)
+			}
+			if strings.Contains(body, `repository="/backups/laptop"`) && tt.target != "/backups/laptop" {
+				t.Errorf("Unexpected metrics of another repository in:\n%s", body)
+			}
+			if runner.callCount() != tt.wantCalls {
+				t.Errorf("Expected %d calls, got %d", tt.wantCalls, runner.callCount())
+			}
+		})
+	}
+
+	if recorder := probe(""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without target, got %d", recorder.Code)
+	}
+}
+
+func TestProbeHandlerBusyRepository(t *testing.T) {
+	runner := &fakeRunner{responses: map[string][]fakeResponse{
+		"info /backups/laptop": {{stdout: mustReadFile(t, "../parser/testdata/borg-info.json")}},
+	}}
+	app := newTestApplication(runner, "/backups/laptop")
+	app.config.probeTimeout = time.Second
+	app.config.probeCacheTTL = time.Minute
+	app.borgVersions = map[string]string{"borg": "borg 1.2.8"}
+
+	probe := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		app.ProbeHandler(recorder, httptest.NewRequest(http.MethodGet, "/probe?target=/backups/laptop", nil))
+		return recorder
+	}
+
+	// A check of the repository is in progress
+	unlock := app.repositoryLocks.lock("/backups/laptop")
+	recorder := probe()
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 during the check, got %d", recorder.Code)
+	}
+	if runner.callCount() != 0 {
+		t.Errorf("Expected borg not to run during the check, got %d calls", runner.callCount())
+	}
+
+	// The busy result is not cached
+	unlock()
+	if recorder := probe(); recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200 once the check is done, got %d", recorder.Code)
+	}
+	if runner.callCount() != 1 {
+		t.Errorf("Expected borg to run once the check is done, got %d calls", runner.callCount())
+	}
+}
+
+func TestProbeHandlerTargets(t *testing.T) {
+	runner := &fakeRunner{responses: map[string][]fakeResponse{
+		"info /backups/laptop": {{stdout: mustReadFile(t, "../parser/testdata/borg-info.json")}},
+	}}
+
+	tests := []struct {
+		name           string
+		target         string
+		probeAnyTarget bool
+		wantStatus     int
+	}{
+		{
+			name:       "configured repository",
+			target:     "/backups/laptop",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "repository location",
+			target:     "ssh://backup/backups/server",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "borg option",
+			target:     "--rsh=x",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "borg option with any target",
+			target:         "--rsh=x",
+			probeAnyTarget: true,
+			wantStatus:     http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(runner, "/backups/laptop")
+			app.config.probeTimeout = time.Second
+			app.config.probeAnyTarget = tt.probeAnyTarget
+			app.borgVersions = map[string]string{"borg": "borg 1.2.8"}
+
+			recorder := httptest.NewRecorder()
+			app.ProbeHandler(recorder, httptest.NewRequest(http.MethodPost, "/probe?target="+url.QueryEscape(tt.target), nil))
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, recorder.Code)
+			}
+		})
+	}
+	for _, call := range runner.calls {
+		if call.Args[len(call.Args)-1] != "/backups/laptop" {
+			t.Errorf("Unexpected borg command %v", call.Args)
+		}
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{name: "no scrape timeout", want: time.Minute},
+		{name: "shorter scrape timeout", header: "10", want: 9500 * time.Millisecond},
+		{name: "longer scrape timeout", header: "120", want: time.Minute},
+		{name: "invalid scrape timeout", header: "abc", want: time.Minute},
+	}
+	app := newTestApplication(nil)
+	app.config.probeTimeout = time.Minute
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/probe?target=laptop", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tt.header)
+			}
+			if got := app.probeTimeout(r); got != tt.want {
+				t.Errorf("Expected timeout %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package web
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// pushTimeout is the timeout of the requests to the Pushgateway
+const pushTimeout = 30 * time.Second
+
+// pushRepositoryLabel is the grouping label of the repository when each repository is pushed in its own group
+const pushRepositoryLabel = "borg_repository"
+
+// newPushers returns the pushers sending the metrics of the given registry to the Pushgateway.
+// The metrics of all the repositories are pushed in a single group,
+// or in a group per repository when pushPerRepository is set.
+// As the pushed metrics already have a repository label, the group of a repository is labeled by borg_repository,
+// and the metrics which are not related to a repository, such as the storage metrics, are pushed in their own group.
+func (app *Application) newPushers(registry prometheus.Gatherer) ([]*push.Pusher, error) {
+	grouping, err := parseGroupingLabels(app.config.pushGroupingLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	newPusher := func() *push.Pusher {
+		pusher := push.New(app.config.pushgatewayURL, app.config.pushJob).
+			Client(&http.Client{Timeout: pushTimeout})
+		names := make([]string, 0, len(grouping))
+		for name := range grouping {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			pusher = pusher.Grouping(name, grouping[name])
+		}
+		return pusher
+	}
+
+	if !app.config.pushPerRepository {
+		return []*push.Pusher{newPusher().Gatherer(registry)}, nil
+	}
+	if _, ok := grouping[pushRepositoryLabel]; ok {
+		return nil, fmt.Errorf("grouping label %q is set for each repository", pushRepositoryLabel)
+	}
+	var pushers []*push.Pusher
+	for _, repo := range app.repositories {
+		pushers = append(pushers, newPusher().
+			Grouping(pushRepositoryLabel, repo.name()).
+			Collector(app.metricsCache.RepositoryCollector(repo.name())))
+	}
+	global := newPusher().Collector(app.metricsCache.GlobalCollector())
+	if app.storage != nil {
+		global = global.Collector(app.storage)
+	}
+	return append(pushers, global), nil
+}
+
+// parseGroupingLabels parses a comma-separated list of name=value grouping labels
+func parseGroupingLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	if s == "" {
+		return labels, nil
+	}
+	for _, label := range strings.Split(s, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(label), "=")
+		if !found || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid grouping label %q, expected name=value", label)
+		}
+		if name == "job" {
+			return nil, fmt.Errorf("grouping label %q is set by the job name", name)
+		}
+		if name == "repository" || reservedLabels[name] {
+			return nil, fmt.Errorf("grouping label %q is already used by the metrics", name)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// Push pushes the metrics to the Pushgateway, replacing the metrics previously pushed in the same group
+func (app *Application) Push() []error {
+	var errs []error
+	for _, pusher := range app.pushers {
+		if err := pusher.Push(); err != nil {
+			errs = append(errs, fmt.Errorf("cannot push metrics to the Pushgateway: %w", err))
+		}
+	}
+	return errs
+}
+
+// DeletePushed deletes the metrics pushed to the Pushgateway
+func (app *Application) DeletePushed() []error {
+	var errs []error
+	for _, pusher := range app.pushers {
+		if err := pusher.Delete(); err != nil {
+			errs = append(errs, fmt.Errorf("cannot delete metrics from the Pushgateway: %w", err))
+		}
+	}
+	return errs
+}
+
+// deletePushedOnShutdown waits for SIGINT or SIGTERM, then deletes the pushed metrics and exits,
+// so that the Pushgateway doesn't keep exposing the metrics of a host which is gone.
+func (app *Application) deletePushedOnShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+
+	app.logger.Info("Deleting the metrics from the Pushgateway", "signal", sig.String())
+	errs := app.DeletePushed()
+	app.logErrors("Delete failed with the following error(s):", errs)
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
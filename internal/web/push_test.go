@@ -0,0 +1,146 @@
+package web
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePushgateway records the requests sent to the Pushgateway
+type fakePushgateway struct {
+	sync.Mutex
+	requests []string
+	bodies   []string
+}
+
+func (p *fakePushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	p.Lock()
+	p.requests = append(p.requests, r.Method+" "+normalizeGroupingPath(r.URL.Path))
+	p.bodies = append(p.bodies, string(body))
+	p.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// normalizeGroupingPath sorts the grouping labels of a Pushgateway path, as their order is not deterministic
+func normalizeGroupingPath(path string) string {
+	components := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+	var labels []string
+	for i := 0; i+1 < len(components); i += 2 {
+		labels = append(labels, components[i]+"/"+components[i+1])
+	}
+	// The job is always first
+	if len(labels) > 1 {
+		sort.Strings(labels[1:])
+	}
+	return "/metrics/" + strings.Join(labels, "/")
+}
+
+func TestPush(t *testing.T) {
+	info := mustReadFile(t, "../parser/testdata/borg-info.json")
+
+	tests := []struct {
+		name              string
+		pushPerRepository bool
+		wantPushes        []string
+		wantDeletes       []string
+	}{
+		{
+			name:        "single group",
+			wantPushes:  []string{"PUT /metrics/job/borg/instance/laptop"},
+			wantDeletes: []string{"DELETE /metrics/job/borg/instance/laptop"},
+		},
+		{
+			name:              "group per repository",
+			pushPerRepository: true,
+			wantPushes: []string{
+				"PUT /metrics/job/borg/borg_repository@base64/L2JhY2t1cHMvbGFwdG9w/instance/laptop",
+				"PUT /metrics/job/borg/borg_repository@base64/L2JhY2t1cHMvc2VydmVy/instance/laptop",
+				"PUT /metrics/job/borg/instance/laptop",
+			},
+			wantDeletes: []string{
+				"DELETE /metrics/job/borg/borg_repository@base64/L2JhY2t1cHMvbGFwdG9w/instance/laptop",
+				"DELETE /metrics/job/borg/borg_repository@base64/L2JhY2t1cHMvc2VydmVy/instance/laptop",
+				"DELETE /metrics/job/borg/instance/laptop",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pushgateway := &fakePushgateway{}
+			server := httptest.NewServer(pushgateway)
+			defer server.Close()
+
+			runner := &fakeRunner{responses: map[string][]fakeResponse{
+				"info /backups/laptop": {{stdout: info}},
+				"info /backups/server": {{err: errors.New("exit status 2")}},
+			}}
+			app := newTestApplication(runner, "/backups/laptop", "/backups/server")
+			app.config.pushgatewayURL = server.URL
+			app.config.pushJob = "borg"
+			app.config.pushGroupingLabels = "instance=laptop"
+			app.config.pushPerRepository = tt.pushPerRepository
+			registry := prometheus.NewRegistry()
+			app.metricsCache.Register(registry)
+			var err error
+			app.pushers, err = app.newPushers(registry)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			app.CollectWrapper()
+
+			if !reflect.DeepEqual(pushgateway.requests, tt.wantPushes) {
+				t.Fatalf("Expected pushes %v, got %v", tt.wantPushes, pushgateway.requests)
+			}
+			if !strings.Contains(pushgateway.bodies[0], "borg_last_collect_error") {
+				t.Errorf("Expected the collection metrics to be pushed, got:\n%s", pushgateway.bodies[0])
+			}
+			if last := pushgateway.bodies[len(pushgateway.bodies)-1]; !strings.Contains(last, "borg_system_info") {
+				t.Errorf("Expected the global metrics to be pushed, got:\n%s", last)
+			}
+
+			pushgateway.requests = nil
+			if errs := app.DeletePushed(); len(errs) != 0 {
+				t.Fatalf("Unexpected errors: %v", errs)
+			}
+			if !reflect.DeepEqual(pushgateway.requests, tt.wantDeletes) {
+				t.Errorf("Expected deletes %v, got %v", tt.wantDeletes, pushgateway.requests)
+			}
+		})
+	}
+}
+
+func TestParseGroupingLabels(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{input: "", want: map[string]string{}},
+		{input: "instance=laptop", want: map[string]string{"instance": "laptop"}},
+		{input: "instance=laptop, site=home", want: map[string]string{"instance": "laptop", "site": "home"}},
+		{input: "instance", wantErr: true},
+		{input: "instance=", wantErr: true},
+		{input: "job=borg", wantErr: true},
+		{input: "repository=laptop", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseGroupingLabels(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
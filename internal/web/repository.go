@@ -0,0 +1,354 @@
+package web
+
+import (
+	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// repository holds the settings used to collect the metrics of a borg repository
+type repository struct {
+	// alias is used as the repository label, the location is used when empty
+	alias           string
+	location        string
+	borgPath        string
+	borgArgs        []string
+	env             []string
+	timeout         time.Duration
+	refreshInterval time.Duration
+	labels          map[string]string
+	// ssh is set when borg runs on a remote host
+	ssh *SSHTarget
+	// thresholds are evaluated by the check command
+	thresholds thresholds
+	// freshness is nil when no maximum backup age is expected
+	freshness *models.FreshnessPolicy
+	// retention is nil when the retention of the archives is not checked
+	retention *models.RetentionPolicy
+	// encryptionPolicy is empty when the encryption mode is not checked
+	encryptionPolicy models.EncryptionPolicy
+	// mountPoint is the path whose filesystem capacity is exposed, the location of a local repository when empty
+	mountPoint string
+
+	// commands and parser depend on the version of the borg binary of the repository
+	commands borgCommands
+	parser   parser.BorgParserInterface
+}
+
+// name returns the value of the repository label
+func (r *repository) name() string {
+	if r.alias != "" {
+		return r.alias
+	}
+	return r.location
+}
+
+// host returns the host of a remote repository, or an empty string for a local repository.
+// Both ssh://[user@]host[:port]/path and the scp-like [user@]host:path syntaxes are supported.
+// When borg runs on a remote host over ssh, the ssh host is returned.
+func (r *repository) host() string {
+	if r.ssh != nil {
+		return r.ssh.Host
+	}
+	location := r.location
+	if strings.HasPrefix(location, "ssh://") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	if strings.HasPrefix(location, "/") || strings.Contains(location, "://") {
+		return ""
+	}
+	hostPart, _, found := strings.Cut(location, ":")
+	if !found || strings.Contains(hostPart, "/") {
+		return ""
+	}
+	if _, host, ok := strings.Cut(hostPart, "@"); ok {
+		return host
+	}
+	return hostPart
+}
+
+// versionKey identifies the borg binary of the repository, remote hosts having their own borg binary
+func (r *repository) versionKey() string {
+	if r.ssh != nil {
+		return r.ssh.destination() + ":" + r.borgPath
+	}
+	return r.borgPath
+}
+
+// fileConfig represents the YAML configuration file
+type fileConfig struct {
+	Repositories []fileRepositoryConfig `yaml:"repositories"`
+}
+
+// fileRepositoryConfig represents a repository in the YAML configuration file.
+// Empty values are replaced by the values of the flags and environment variables.
+type fileRepositoryConfig struct {
+	Location        string            `yaml:"location"`
+	Alias           string            `yaml:"alias"`
+	BorgPath        string            `yaml:"borg_path"`
+	BorgArgs        []string          `yaml:"borg_args"`
+	Env             map[string]string `yaml:"env"`
+	Timeout         time.Duration     `yaml:"timeout"`
+	RefreshInterval time.Duration     `yaml:"refresh_interval"`
+	Labels          map[string]string `yaml:"labels"`
+	SSH             *SSHTarget        `yaml:"ssh"`
+	Thresholds      fileThresholds    `yaml:"thresholds"`
+	Freshness       *fileFreshness    `yaml:"freshness"`
+	Retention       *fileRetention    `yaml:"retention"`
+	// EncryptionPolicy is authenticated or encrypted, see models.EncryptionPolicy
+	EncryptionPolicy models.EncryptionPolicy `yaml:"encryption_policy"`
+	// MountPoint is a local path on the filesystem of the repository, for instance when it is mounted from the backup server
+	MountPoint string `yaml:"mount_point"`
+}
+
+// fileRetention represents the expected retention policy of a repository in the YAML configuration file,
+// using the same options as borg prune
+type fileRetention struct {
+	KeepDaily   int    `yaml:"keep_daily"`
+	KeepWeekly  int    `yaml:"keep_weekly"`
+	KeepMonthly int    `yaml:"keep_monthly"`
+	KeepYearly  int    `yaml:"keep_yearly"`
+	Glob        string `yaml:"glob"`
+}
+
+// fileFreshness represents the freshness policy of a repository in the YAML configuration file
+type fileFreshness struct {
+	MaxAge time.Duration `yaml:"max_age"`
+	// DailyBefore is a time of day formatted as 15:04
+	DailyBefore        string                  `yaml:"daily_before"`
+	Timezone           string                  `yaml:"timezone"`
+	MaintenanceWindows []fileMaintenanceWindow `yaml:"maintenance_windows"`
+}
+
+type fileMaintenanceWindow struct {
+	Start time.Time `yaml:"start"`
+	End   time.Time `yaml:"end"`
+}
+
+// reservedLabels cannot be used as extra labels, as they are already used by the metrics
+var reservedLabels = map[string]bool{
+	"repository": true, "archive": true, "comment": true, "start_time": true, "end_time": true, "hostname": true,
+	"id": true, "name": true, "username": true, "last_modified": true, "location": true, "borg_version": true,
+	"rule": true, "reason": true, "level": true, "mode": true, "key_type": true, "chunker_params": true, "compression": true,
+}
+
+// loadConfigFile reads and parses the YAML configuration file
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg fileConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse config file %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// newDefaultRepository returns a repository using the settings of the flags and environment variables
+func newDefaultRepository(cfg *config, location string) *repository {
+	borgArgs := []string{}
+	if cfg.borgOpts != "" {
+		borgArgs = append(borgArgs, cfg.borgOpts)
+	}
+	return &repository{
+		location:         location,
+		borgPath:         cfg.borgPath,
+		borgArgs:         borgArgs,
+		timeout:          cfg.commandTimeout,
+		refreshInterval:  cfg.metricsRefreshInterval,
+		thresholds:       cfg.thresholds,
+		freshness:        defaultFreshness(cfg),
+		encryptionPolicy: cfg.encryptionPolicy,
+	}
+}
+
+// defaultFreshness returns the freshness policy defined by the flags and environment variables
+func defaultFreshness(cfg *config) *models.FreshnessPolicy {
+	if cfg.freshnessMaxAge == 0 {
+		return nil
+	}
+	return &models.FreshnessPolicy{MaxAge: cfg.freshnessMaxAge}
+}
+
+// buildFreshness returns the freshness policy of a repository of the configuration file
+func buildFreshness(cfg *config, f *fileFreshness) (*models.FreshnessPolicy, error) {
+	if f == nil {
+		return defaultFreshness(cfg), nil
+	}
+
+	policy := &models.FreshnessPolicy{MaxAge: f.MaxAge}
+	if f.DailyBefore != "" {
+		dailyBefore, err := time.Parse("15:04", f.DailyBefore)
+		if err != nil {
+			return nil, fmt.Errorf("invalid daily_before %q, expected HH:MM", f.DailyBefore)
+		}
+		policy.Daily = true
+		policy.DailyBefore = time.Duration(dailyBefore.Hour())*time.Hour + time.Duration(dailyBefore.Minute())*time.Minute
+	}
+	if policy.MaxAge == 0 && !policy.Daily {
+		policy.MaxAge = cfg.freshnessMaxAge
+	}
+	if policy.MaxAge == 0 && !policy.Daily {
+		return nil, fmt.Errorf("freshness requires max_age or daily_before")
+	}
+	if f.Timezone != "" {
+		location, err := time.LoadLocation(f.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %w", f.Timezone, err)
+		}
+		policy.Location = location
+	}
+	for _, window := range f.MaintenanceWindows {
+		if !window.End.After(window.Start) {
+			return nil, fmt.Errorf("maintenance window ending at %s before its start", window.End.Format(time.RFC3339))
+		}
+		policy.MaintenanceWindows = append(policy.MaintenanceWindows, models.MaintenanceWindow{Start: window.Start, End: window.End})
+	}
+	return policy, nil
+}
+
+// buildRepositories returns the repositories to collect, from the BORG_REPOSITORIES list and the configuration file.
+// Flags and environment variables are used as defaults, which are overridden by the configuration file.
+// A repository defined in both is only collected once, with the settings of the configuration file.
+func buildRepositories(cfg *config, fileCfg *fileConfig) ([]*repository, error) {
+	if err := cfg.encryptionPolicy.Validate(); err != nil {
+		return nil, err
+	}
+	defaultBorgArgs := newDefaultRepository(cfg, "").borgArgs
+
+	var fileRepositories []fileRepositoryConfig
+	if fileCfg != nil {
+		fileRepositories = fileCfg.Repositories
+	}
+	inFile := map[string]bool{}
+	for _, r := range fileRepositories {
+		inFile[r.Location] = true
+	}
+
+	var repositories []*repository
+	if cfg.borgRepositories != "" {
+		for _, location := range strings.Split(cfg.borgRepositories, ",") {
+			if inFile[location] {
+				continue
+			}
+			repositories = append(repositories, newDefaultRepository(cfg, location))
+		}
+	}
+
+	for _, r := range fileRepositories {
+		if r.Location == "" {
+			return nil, fmt.Errorf("repository without location in config file")
+		}
+		repo := &repository{
+			alias:            r.Alias,
+			location:         r.Location,
+			borgPath:         r.BorgPath,
+			borgArgs:         r.BorgArgs,
+			timeout:          r.Timeout,
+			refreshInterval:  r.RefreshInterval,
+			labels:           r.Labels,
+			ssh:              r.SSH,
+			thresholds:       r.Thresholds.withDefaults(cfg.thresholds),
+			encryptionPolicy: r.EncryptionPolicy,
+			mountPoint:       r.MountPoint,
+		}
+		if repo.borgPath == "" {
+			repo.borgPath = cfg.borgPath
+		}
+		if repo.borgArgs == nil {
+			repo.borgArgs = defaultBorgArgs
+		}
+		if repo.timeout == 0 {
+			repo.timeout = cfg.commandTimeout
+		}
+		if repo.refreshInterval == 0 {
+			repo.refreshInterval = cfg.metricsRefreshInterval
+		}
+		if repo.encryptionPolicy == "" {
+			repo.encryptionPolicy = cfg.encryptionPolicy
+		} else if err := repo.encryptionPolicy.Validate(); err != nil {
+			return nil, fmt.Errorf("repository %s: %w", repo.name(), err)
+		}
+		for key, value := range r.Env {
+			repo.env = append(repo.env, key+"="+value)
+		}
+		sort.Strings(repo.env)
+		freshness, err := buildFreshness(cfg, r.Freshness)
+		if err != nil {
+			return nil, fmt.Errorf("repository %s: %w", repo.name(), err)
+		}
+		repo.freshness = freshness
+		if r.Retention != nil {
+			repo.retention = &models.RetentionPolicy{
+				KeepDaily:   r.Retention.KeepDaily,
+				KeepWeekly:  r.Retention.KeepWeekly,
+				KeepMonthly: r.Retention.KeepMonthly,
+				KeepYearly:  r.Retention.KeepYearly,
+				Glob:        r.Retention.Glob,
+			}
+			if err := repo.retention.Validate(); err != nil {
+				return nil, fmt.Errorf("repository %s: %w", repo.name(), err)
+			}
+		}
+		for label := range r.Labels {
+			if !model.LabelName(label).IsValid() {
+				return nil, fmt.Errorf("repository %s: invalid label name %q", repo.name(), label)
+			}
+			if reservedLabels[label] {
+				return nil, fmt.Errorf("repository %s: label %q is reserved", repo.name(), label)
+			}
+		}
+		if repo.ssh != nil {
+			if repo.ssh.Host == "" {
+				return nil, fmt.Errorf("repository %s: ssh host is required", repo.name())
+			}
+			// Label the metrics with the host running borg, unless a host label is already defined
+			if _, ok := repo.labels["host"]; !ok {
+				labels := map[string]string{"host": repo.ssh.Host}
+				for key, value := range repo.labels {
+					labels[key] = value
+				}
+				repo.labels = labels
+			}
+		}
+		repositories = append(repositories, repo)
+	}
+
+	names := map[string]bool{}
+	for _, repo := range repositories {
+		if names[repo.name()] {
+			return nil, fmt.Errorf("repository %s is defined more than once", repo.name())
+		}
+		names[repo.name()] = true
+	}
+	return repositories, nil
+}
+
+// extraLabelNames returns the sorted union of the extra label names of all the repositories
+func extraLabelNames(repositories []*repository) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, repo := range repositories {
+		for label := range repo.labels {
+			if !seen[label] {
+				seen[label] = true
+				names = append(names, label)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
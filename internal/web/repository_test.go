@@ -0,0 +1,276 @@
+package web
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testConfigFile = `
+repositories:
+  - location: ssh://backup-host/backups/laptop
+    alias: laptop
+    borg_path: /usr/local/bin/borg2
+    borg_args: ["--remote-path", "borg2"]
+    env:
+      BORG_PASSCOMMAND: cat /etc/borg/passphrase
+      BORG_RSH: ssh -i /etc/borg/id_ed25519
+    timeout: 10m
+    refresh_interval: 1h
+    labels:
+      team: infra
+    thresholds:
+      max_age:
+        critical: 192h
+      min_files:
+        warning: 1000
+    encryption_policy: encrypted
+    mount_point: /mnt/backup-host
+  - location: /backups/server
+`
+
+func TestLoadConfigFileAndBuildRepositories(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(testConfigFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fileCfg, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cfg := &config{
+		borgRepositories:       "/backups/server,/backups/other",
+		borgPath:               "borg",
+		borgOpts:               "--lock-wait=60",
+		commandTimeout:         2 * time.Minute,
+		metricsRefreshInterval: 4 * time.Hour,
+		thresholds:             thresholds{MaxAge: durationThreshold{Warning: 26 * time.Hour, Critical: 50 * time.Hour}},
+		encryptionPolicy:       models.EncryptionPolicyAuthenticated,
+	}
+	repositories, err := buildRepositories(cfg, fileCfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(repositories) != 3 {
+		t.Fatalf("Expected 3 repositories, got %d", len(repositories))
+	}
+
+	other := repositories[0]
+	if other.name() != "/backups/other" || other.borgPath != "borg" || other.timeout != 2*time.Minute ||
+		!reflect.DeepEqual(other.borgArgs, []string{"--lock-wait=60"}) {
+		t.Errorf("Unexpected defaults for repository from flags: %+v", other)
+	}
+
+	laptop := repositories[1]
+	if laptop.name() != "laptop" {
+		t.Errorf("Expected alias to be used as name, got %s", laptop.name())
+	}
+	if laptop.borgPath != "/usr/local/bin/borg2" || laptop.timeout != 10*time.Minute || laptop.refreshInterval != time.Hour {
+		t.Errorf("Config file settings not applied: %+v", laptop)
+	}
+	if !reflect.DeepEqual(laptop.borgArgs, []string{"--remote-path", "borg2"}) {
+		t.Errorf("Unexpected borg args %v", laptop.borgArgs)
+	}
+	wantEnv := []string{"BORG_PASSCOMMAND=cat /etc/borg/passphrase", "BORG_RSH=ssh -i /etc/borg/id_ed25519"}
+	if !reflect.DeepEqual(laptop.env, wantEnv) {
+		t.Errorf("Expected env %v, got %v", wantEnv, laptop.env)
+	}
+
+	wantThresholds := thresholds{
+		MaxAge:   durationThreshold{Warning: 26 * time.Hour, Critical: 192 * time.Hour},
+		MinFiles: countThreshold{Warning: 1000},
+	}
+	if laptop.thresholds != wantThresholds {
+		t.Errorf("Expected thresholds %+v, got %+v", wantThresholds, laptop.thresholds)
+	}
+	if laptop.mountPoint != "/mnt/backup-host" {
+		t.Errorf("Expected mount point /mnt/backup-host, got %q", laptop.mountPoint)
+	}
+	if laptop.encryptionPolicy != models.EncryptionPolicyEncrypted || other.encryptionPolicy != models.EncryptionPolicyAuthenticated {
+		t.Errorf("Expected encryption policies encrypted and authenticated, got %s and %s", laptop.encryptionPolicy, other.encryptionPolicy)
+	}
+
+	// Defined in both, the config file settings win
+	server := repositories[2]
+	if server.name() != "/backups/server" || server.timeout != 2*time.Minute || server.refreshInterval != 4*time.Hour {
+		t.Errorf("Unexpected defaults for repository from config file: %+v", server)
+	}
+
+	if labels := extraLabelNames(repositories); !reflect.DeepEqual(labels, []string{"team"}) {
+		t.Errorf("Expected extra labels [team], got %v", labels)
+	}
+}
+
+func TestBuildRepositoriesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fileCfg *fileConfig
+	}{
+		{
+			name:    "missing location",
+			fileCfg: &fileConfig{Repositories: []fileRepositoryConfig{{Alias: "laptop"}}},
+		},
+		{
+			name: "reserved label",
+			fileCfg: &fileConfig{Repositories: []fileRepositoryConfig{
+				{Location: "/backups/laptop", Labels: map[string]string{"hostname": "laptop"}},
+			}},
+		},
+		{
+			name: "invalid label name",
+			fileCfg: &fileConfig{Repositories: []fileRepositoryConfig{
+				{Location: "/backups/laptop", Labels: map[string]string{"my-label": "laptop"}},
+			}},
+		},
+		{
+			name: "label name starting with a digit",
+			fileCfg: &fileConfig{Repositories: []fileRepositoryConfig{
+				{Location: "/backups/laptop", Labels: map[string]string{"1team": "infra"}},
+			}},
+		},
+		{
+			name: "retention without keep",
+			fileCfg: &fileConfig{Repositories: []fileRepositoryConfig{
+				{Location: "/backups/laptop", Retention: &fileRetention{Glob: "laptop-*"}},
+			}},
+		},
+		{
+			name: "ssh without host",
+			fileCfg: &fileConfig{Repositories: []fileRepositoryConfig{
+				{Location: "/backups/laptop", SSH: &SSHTarget{User: "borg"}},
+			}},
+		},
+		{
+			name: "unknown encryption policy",
+			fileCfg: &fileConfig{Repositories: []fileRepositoryConfig{
+				{Location: "/backups/laptop", EncryptionPolicy: "paranoid"},
+			}},
+		},
+		{
+			name: "duplicated name",
+			fileCfg: &fileConfig{Repositories: []fileRepositoryConfig{
+				{Location: "/backups/laptop", Alias: "laptop"},
+				{Location: "/backups/other-laptop", Alias: "laptop"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := buildRepositories(&config{}, tt.fileCfg); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestBuildRepositoriesSSH(t *testing.T) {
+	fileCfg := &fileConfig{Repositories: []fileRepositoryConfig{
+		{Location: "/backups/laptop", SSH: &SSHTarget{Host: "backup-host", User: "borg"}},
+		{Location: "/backups/server", SSH: &SSHTarget{Host: "backup-host"}, Labels: map[string]string{"host": "nas"}},
+	}}
+	repositories, err := buildRepositories(&config{borgPath: "borg"}, fileCfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	laptop := repositories[0]
+	if !reflect.DeepEqual(laptop.labels, map[string]string{"host": "backup-host"}) {
+		t.Errorf("Expected the ssh host label, got %v", laptop.labels)
+	}
+	if laptop.host() != "backup-host" {
+		t.Errorf("Expected the ssh host to be used as host, got %q", laptop.host())
+	}
+	server := repositories[1]
+	if !reflect.DeepEqual(server.labels, map[string]string{"host": "nas"}) {
+		t.Errorf("Expected the configured host label to be kept, got %v", server.labels)
+	}
+	if labels := extraLabelNames(repositories); !reflect.DeepEqual(labels, []string{"host"}) {
+		t.Errorf("Expected extra labels [host], got %v", labels)
+	}
+}
+
+func TestRepositoryHost(t *testing.T) {
+	tests := []struct {
+		location string
+		want     string
+	}{
+		{location: "ssh://backup-host/backups/laptop", want: "backup-host"},
+		{location: "ssh://borg@backup-host:2222/./laptop", want: "backup-host"},
+		{location: "borg@backup-host:backups/laptop", want: "backup-host"},
+		{location: "backup-host:/backups/laptop", want: "backup-host"},
+		{location: "/backups/laptop", want: ""},
+		{location: "file:///backups/laptop", want: ""},
+		{location: "backups/laptop", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			repo := &repository{location: tt.location}
+			if got := repo.host(); got != tt.want {
+				t.Errorf("Expected host %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBuildFreshness(t *testing.T) {
+	cfg := &config{freshnessMaxAge: 26 * time.Hour}
+	start := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		freshness *fileFreshness
+		want      *models.FreshnessPolicy
+		wantErr   bool
+	}{
+		{
+			name: "default",
+			want: &models.FreshnessPolicy{MaxAge: 26 * time.Hour},
+		},
+		{
+			name:      "daily",
+			freshness: &fileFreshness{DailyBefore: "06:30"},
+			want:      &models.FreshnessPolicy{Daily: true, DailyBefore: 6*time.Hour + 30*time.Minute},
+		},
+		{
+			name: "maintenance window",
+			freshness: &fileFreshness{
+				MaxAge:             8 * 24 * time.Hour,
+				MaintenanceWindows: []fileMaintenanceWindow{{Start: start, End: start.Add(48 * time.Hour)}},
+			},
+			want: &models.FreshnessPolicy{
+				MaxAge:             8 * 24 * time.Hour,
+				MaintenanceWindows: []models.MaintenanceWindow{{Start: start, End: start.Add(48 * time.Hour)}},
+			},
+		},
+		{
+			name:      "invalid daily",
+			freshness: &fileFreshness{DailyBefore: "6am"},
+			wantErr:   true,
+		},
+		{
+			name:      "invalid timezone",
+			freshness: &fileFreshness{DailyBefore: "06:00", Timezone: "Nowhere/Unknown"},
+			wantErr:   true,
+		},
+		{
+			name:      "invalid maintenance window",
+			freshness: &fileFreshness{MaintenanceWindows: []fileMaintenanceWindow{{Start: start, End: start}}},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildFreshness(cfg, tt.freshness)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Command describes a borg invocation
+type Command struct {
+	// Path is the path of the borg binary
+	Path string
+	Args []string
+	// Env holds additional environment variables, in the KEY=VALUE form
+	Env []string
+}
+
+// CommandRunner runs borg commands.
+// It returns the standard output and the standard error of the command,
+// and an error if the command could not be run or exited with a non-zero status.
+type CommandRunner interface {
+	Run(ctx context.Context, command Command) (stdout []byte, stderr []byte, err error)
+}
+
+// LocalRunner runs the commands on the local host
+type LocalRunner struct {
+	// WaitDelay is the time given to the command to release its output once killed,
+	// as child processes such as ssh can keep it open.
+	WaitDelay time.Duration
+}
+
+// NewLocalRunner returns a LocalRunner with default values
+func NewLocalRunner() *LocalRunner {
+	return &LocalRunner{
+		WaitDelay: 5 * time.Second,
+	}
+}
+
+func (r *LocalRunner) Run(ctx context.Context, command Command) ([]byte, []byte, error) {
+	cmd := exec.CommandContext(ctx, command.Path, command.Args...)
+	cmd.WaitDelay = r.WaitDelay
+	if len(command.Env) > 0 {
+		cmd.Env = append(os.Environ(), command.Env...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
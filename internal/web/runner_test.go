@@ -0,0 +1,58 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestRunBorgTimeout(t *testing.T) {
+	app := &Application{runner: NewLocalRunner(), logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	repo := &repository{location: "/backups/laptop", borgPath: "sleep"}
+
+	_, _, err := app.runBorg(context.Background(), repo, 50*time.Millisecond, "5")
+
+	var repositoryCollectionError *RepositoryCollectionError
+	if !errors.As(err, &repositoryCollectionError) {
+		t.Fatalf("Expected a RepositoryCollectionError, got %v", err)
+	}
+	if repositoryCollectionError.Category != ErrorCategoryTimeout {
+		t.Errorf("Expected category %s, got %s", ErrorCategoryTimeout, repositoryCollectionError.Category)
+	}
+}
+
+func TestRunBorgCommandError(t *testing.T) {
+	app := &Application{runner: NewLocalRunner(), logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	repo := &repository{location: "/backups/laptop", borgPath: "sh"}
+
+	_, _, err := app.runBorg(context.Background(), repo, time.Second, "-c", "echo 'Repository /backups/laptop does not exist.' >&2; exit 2")
+
+	var repositoryCollectionError *RepositoryCollectionError
+	if !errors.As(err, &repositoryCollectionError) {
+		t.Fatalf("Expected a RepositoryCollectionError, got %v", err)
+	}
+	if repositoryCollectionError.Category != ErrorCategoryRepositoryNotFound {
+		t.Errorf("Expected category %s, got %s", ErrorCategoryRepositoryNotFound, repositoryCollectionError.Category)
+	}
+	if repositoryCollectionError.StdErr != "Repository /backups/laptop does not exist.\n" {
+		t.Errorf("Unexpected stderr %q", repositoryCollectionError.StdErr)
+	}
+}
+
+func TestLocalRunnerEnv(t *testing.T) {
+	runner := NewLocalRunner()
+	stdout, _, err := runner.Run(context.Background(), Command{
+		Path: "sh",
+		Args: []string{"-c", "echo $BORG_BASE_DIR"},
+		Env:  []string{"BORG_BASE_DIR=/var/lib/borg"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(stdout) != "/var/lib/borg\n" {
+		t.Errorf("Expected environment variable to be set, got %q", stdout)
+	}
+}
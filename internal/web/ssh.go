@@ -0,0 +1,84 @@
+package web
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SSHTarget describes how to reach a remote host with ssh
+type SSHTarget struct {
+	Host         string   `yaml:"host"`
+	User         string   `yaml:"user"`
+	Port         int      `yaml:"port"`
+	IdentityFile string   `yaml:"identity_file"`
+	Options      []string `yaml:"options"`
+	// Command is the ssh binary, ssh by default
+	Command string `yaml:"command"`
+}
+
+// destination returns the ssh destination, in the [user@]host form
+func (t *SSHTarget) destination() string {
+	if t.User != "" {
+		return t.User + "@" + t.Host
+	}
+	return t.Host
+}
+
+// SSHRunner runs the borg commands on a remote host through ssh, so that borg uses the keys and the cache
+// of the remote host. The ssh command itself is run by the wrapped runner, which handles the timeout and stderr.
+type SSHRunner struct {
+	Target SSHTarget
+	Runner CommandRunner
+}
+
+func (r *SSHRunner) Run(ctx context.Context, command Command) ([]byte, []byte, error) {
+	return r.Runner.Run(ctx, r.sshCommand(command))
+}
+
+// sshCommand returns the local ssh command running the given command on the remote host.
+// The environment variables of the command are set on the remote host, as ssh doesn't forward them.
+func (r *SSHRunner) sshCommand(command Command) Command {
+	sshPath := r.Target.Command
+	if sshPath == "" {
+		sshPath = "ssh"
+	}
+
+	// BatchMode prevents ssh from waiting for a password or a host key confirmation
+	args := []string{"-o", "BatchMode=yes"}
+	if r.Target.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(r.Target.Port))
+	}
+	if r.Target.IdentityFile != "" {
+		args = append(args, "-i", r.Target.IdentityFile)
+	}
+	for _, option := range r.Target.Options {
+		args = append(args, "-o", option)
+	}
+
+	var remote []string
+	if len(command.Env) > 0 {
+		remote = append(remote, "env")
+		for _, env := range command.Env {
+			remote = append(remote, shellQuote(env))
+		}
+	}
+	remote = append(remote, shellQuote(command.Path))
+	for _, arg := range command.Args {
+		remote = append(remote, shellQuote(arg))
+	}
+
+	args = append(args, r.Target.destination(), "--", strings.Join(remote, " "))
+	return Command{Path: sshPath, Args: args}
+}
+
+var shellSafeRegexp = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes a string for the POSIX shell which runs the remote command
+func shellQuote(s string) string {
+	if shellSafeRegexp.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,78 @@
+package web
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSSHRunner_sshCommand(t *testing.T) {
+	runner := &SSHRunner{Target: SSHTarget{
+		Host:         "client1",
+		User:         "backup",
+		Port:         2222,
+		IdentityFile: "/etc/borg-exporter/id_ed25519",
+		Options:      []string{"StrictHostKeyChecking=accept-new"},
+	}}
+
+	command := runner.sshCommand(Command{
+		Path: "borg",
+		Args: []string{"info", "--last", "1", "--json", "ssh://backup-host/backups/client 1"},
+		Env:  []string{"BORG_PASSCOMMAND=cat /root/.borg-passphrase"},
+	})
+
+	if command.Path != "ssh" {
+		t.Errorf("Expected ssh command, got %s", command.Path)
+	}
+	wantArgs := []string{
+		"-o", "BatchMode=yes", "-p", "2222", "-i", "/etc/borg-exporter/id_ed25519", "-o", "StrictHostKeyChecking=accept-new",
+		"backup@client1", "--",
+		"env 'BORG_PASSCOMMAND=cat /root/.borg-passphrase' borg info --last 1 --json 'ssh://backup-host/backups/client 1'",
+	}
+	if !reflect.DeepEqual(command.Args, wantArgs) {
+		t.Errorf("Expected args %q, got %q", wantArgs, command.Args)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"borg":              "borg",
+		"/backups/laptop":   "/backups/laptop",
+		"two words":         "'two words'",
+		"it's":              `'it'\''s'`,
+		"$HOME":             "'$HOME'",
+		"BORG_RSH=ssh -i k": "'BORG_RSH=ssh -i k'",
+	}
+	for s, want := range tests {
+		if got := shellQuote(s); got != want {
+			t.Errorf("shellQuote(%q): expected %s, got %s", s, want, got)
+		}
+	}
+}
+
+// TestSSHRunner_Run uses a stand-in for ssh, which runs the remote command locally with sh
+func TestSSHRunner_Run(t *testing.T) {
+	fakeSSH := filepath.Join(t.TempDir(), "fake-ssh")
+	script := "#!/bin/sh\nwhile [ \"$1\" != \"--\" ]; do shift; done\nshift\nexec sh -c \"$1\"\n"
+	if err := os.WriteFile(fakeSSH, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := &SSHRunner{
+		Target: SSHTarget{Host: "client1", Command: fakeSSH},
+		Runner: NewLocalRunner(),
+	}
+	stdout, _, err := runner.Run(context.Background(), Command{
+		Path: "sh",
+		Args: []string{"-c", `echo "$BORG_BASE_DIR" "$0"`, "it's quoted"},
+		Env:  []string{"BORG_BASE_DIR=/var/lib/borg"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(stdout) != "/var/lib/borg it's quoted\n" {
+		t.Errorf("Unexpected output %q", stdout)
+	}
+}
@@ -0,0 +1,43 @@
+package web
+
+// restoreState loads the metrics saved by a previous run from the state file, when configured,
+// so that they are served before the initial collection is done.
+// The snapshots of the repositories removed from the configuration are dropped.
+func (app *Application) restoreState() {
+	if app.config.stateFile == "" {
+		return
+	}
+	if err := app.metricsCache.LoadState(app.config.stateFile); err != nil {
+		// The state is only an optimization, the metrics are collected again anyway
+		app.logger.Error("Cannot restore the metrics from the state file", "path", app.config.stateFile, "error", err)
+		return
+	}
+
+	app.metricsCache.Lock()
+	defer app.metricsCache.Unlock()
+	names := make([]string, 0, len(app.repositories))
+	for _, repo := range app.repositories {
+		names = append(names, repo.name())
+	}
+	app.metricsCache.RetainRepositories(names)
+	restored := 0
+	for _, repo := range app.repositories {
+		if _, ok := app.metricsCache.Repositories[repo.name()]; !ok {
+			continue
+		}
+		// The policies are not saved, they come from the configuration
+		repositorySnapshot(app.metricsCache, repo)
+		restored++
+	}
+	app.logger.Info("Restored the metrics from the state file", "path", app.config.stateFile, "repositories", restored)
+}
+
+// saveState saves the collected metrics to the state file, when configured
+func (app *Application) saveState() {
+	if app.config.stateFile == "" {
+		return
+	}
+	if err := app.metricsCache.SaveState(app.config.stateFile); err != nil {
+		app.logger.Error("Cannot save the metrics to the state file", "path", app.config.stateFile, "error", err)
+	}
+}
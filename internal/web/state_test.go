@@ -0,0 +1,44 @@
+package web
+
+import (
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreState(t *testing.T) {
+	info := mustReadFile(t, "../parser/testdata/borg-info.json")
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	// A first run collects and saves both repositories
+	runner := &fakeRunner{responses: map[string][]fakeResponse{
+		"info /backups/laptop": {{stdout: info}},
+		"info /backups/server": {{stdout: info}},
+	}}
+	app := newTestApplication(runner, "/backups/laptop", "/backups/server")
+	app.config.stateFile = stateFile
+	app.CollectWrapper()
+	collected := app.metricsCache.Repositories["/backups/laptop"].LastCollectTimestamp
+
+	// The server repository has been removed from the configuration of the second run
+	app = newTestApplication(&fakeRunner{}, "/backups/laptop")
+	app.config.stateFile = stateFile
+	app.repositories[0].labels = map[string]string{"team": "infra"}
+	app.repositories[0].freshness = &models.FreshnessPolicy{MaxAge: time.Hour}
+	app.restoreState()
+
+	if len(app.metricsCache.Repositories) != 1 {
+		t.Fatalf("Expected only the laptop repository to be restored, got %v", app.metricsCache.Repositories)
+	}
+	snapshot := app.metricsCache.Repositories["/backups/laptop"]
+	if snapshot == nil || snapshot.Info == nil {
+		t.Fatalf("Expected the info of the laptop repository to be restored, got %+v", snapshot)
+	}
+	if !snapshot.LastCollectTimestamp.Equal(collected) {
+		t.Errorf("Expected the original collection timestamp %s, got %s", collected, snapshot.LastCollectTimestamp)
+	}
+	if snapshot.Labels["team"] != "infra" || snapshot.Freshness == nil {
+		t.Errorf("Expected the configuration of the repository to be applied, got labels %v and freshness %v", snapshot.Labels, snapshot.Freshness)
+	}
+}
@@ -0,0 +1,20 @@
+package web
+
+import "time"
+
+// StorageLoop scans the repositories of the storage paths at every storage refresh interval.
+// Scanning only reads the repository directories, so it runs independently of the borg collections.
+func (app *Application) StorageLoop() {
+	for {
+		app.refreshStorage()
+		time.Sleep(app.config.storageRefreshInterval)
+	}
+}
+
+// refreshStorage scans the repositories of the storage paths and logs any errors
+func (app *Application) refreshStorage() {
+	start := time.Now()
+	errs := app.storage.Refresh()
+	app.logErrors("Storage scan failed with the following error(s):", errs)
+	app.logger.Debug("Storage scan done", "repositories", len(app.storage.Repositories()), "duration", time.Since(start).String())
+}
@@ -0,0 +1,66 @@
+package web
+
+import (
+	"flag"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+)
+
+// CollectOnce collects the metrics of the configured repositories once, for instance from a systemd timer after the backup,
+// then writes them to a file for the node_exporter textfile collector and/or pushes them to the Pushgateway.
+// It returns the exit code of the collect subcommand: 1 when a repository could not be collected or the metrics
+// could not be written, 2 for invalid flags.
+func (app *Application) CollectOnce(Version string, args []string) int {
+	var cfg config
+	var textfilePath string
+	fs := flag.NewFlagSet("collect", flag.ExitOnError)
+	app.registerCollectionFlags(fs, &cfg)
+	fs.StringVar(&textfilePath, "textfile", os.Getenv("TEXTFILE_PATH"), "path of the file written for the node_exporter textfile collector, ending with .prom")
+	if err := app.parseFlags(fs, args); err != nil {
+		app.logger.Error("Invalid configuration", "error", err)
+		return 2
+	}
+
+	if textfilePath == "" && cfg.pushgatewayURL == "" {
+		app.logger.Error("The collect command requires a textfile path or a Pushgateway URL")
+		return 2
+	}
+
+	app.logger.Info("Collecting metrics", "version", Version)
+	reg, err := app.setup(&cfg)
+	if err != nil {
+		app.logger.Error("Invalid configuration", "error", err)
+		return 2
+	}
+	if len(app.repositories) == 0 && app.storage == nil {
+		app.logger.Error("No borg repositories defined")
+		return 2
+	}
+
+	errs := app.Collect()
+	if app.storage != nil {
+		errs = append(errs, app.storage.Refresh()...)
+	}
+	app.logErrors("Collection failed with the following error(s):", errs)
+	exitCode := 0
+	if len(errs) > 0 {
+		exitCode = 1
+	}
+
+	// The metrics are written even when a repository failed, as they expose the failure
+	if textfilePath != "" {
+		// The file is written to a temporary file and renamed,
+		// so that node_exporter never reads a partially written file
+		if err := prometheus.WriteToTextfile(textfilePath, reg); err != nil {
+			app.logger.Error("Cannot write the textfile", "path", textfilePath, "error", err)
+			exitCode = 1
+		}
+	}
+	if pushErrs := app.Push(); len(pushErrs) > 0 {
+		app.logErrors("Push failed with the following error(s):", pushErrs)
+		exitCode = 1
+	}
+
+	app.logger.Info("Collecting metrics done", "errors", len(errs))
+	return exitCode
+}
@@ -0,0 +1,81 @@
+package web
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCollectOnce(t *testing.T) {
+	info := mustReadFile(t, "../parser/testdata/borg-info.json")
+
+	tests := []struct {
+		name         string
+		responses    map[string][]fakeResponse
+		wantExitCode int
+		wantSeries   []string
+	}{
+		{
+			name: "success",
+			responses: map[string][]fakeResponse{
+				"info /backups/laptop": {{stdout: info}},
+				"info /backups/server": {{stdout: info}},
+			},
+			wantSeries: []string{
+				`borg_last_collect_error{reason="",repository="/backups/laptop"} 0`,
+				`borg_last_collect_error{reason="",repository="/backups/server"} 0`,
+			},
+		},
+		{
+			name: "failed repository",
+			responses: map[string][]fakeResponse{
+				"info /backups/laptop": {{stdout: info}},
+				"info /backups/server": {{err: errors.New("exit status 2"), stderr: []byte("passphrase supplied in BORG_PASSPHRASE or by BORG_PASSCOMMAND is incorrect.\n")}},
+			},
+			wantExitCode: 1,
+			wantSeries: []string{
+				`borg_last_collect_error{reason="",repository="/backups/laptop"} 0`,
+				`borg_last_collect_error{reason="passphrase",repository="/backups/server"} 1`,
+				`borg_collect_errors{reason="passphrase",repository="/backups/server"} 1`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.responses["--version --version"] = []fakeResponse{{stdout: []byte("borg 1.2.8\n")}}
+			app := newTestApplication(&fakeRunner{responses: tt.responses})
+			path := filepath.Join(t.TempDir(), "borg.prom")
+
+			exitCode := app.CollectOnce("test", []string{
+				"-borg-repositories", "/backups/laptop,/backups/server",
+				"-textfile", path,
+			})
+
+			if exitCode != tt.wantExitCode {
+				t.Errorf("Expected exit code %d, got %d", tt.wantExitCode, exitCode)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Expected the textfile to be written: %v", err)
+			}
+			for _, series := range tt.wantSeries {
+				if !strings.Contains(string(content), series) {
+					t.Errorf("Expected %s in:\n%s", series, content)
+				}
+			}
+			entries, _ := os.ReadDir(filepath.Dir(path))
+			if len(entries) != 1 {
+				t.Errorf("Expected only the textfile in the directory, got %d files", len(entries))
+			}
+		})
+	}
+}
+
+func TestCollectOnceWithoutOutput(t *testing.T) {
+	app := newTestApplication(&fakeRunner{})
+	if exitCode := app.CollectOnce("test", []string{"-borg-repositories", "/backups/laptop"}); exitCode != 2 {
+		t.Errorf("Expected exit code 2, got %d", exitCode)
+	}
+}
@@ -5,16 +5,20 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/history"
 	"github.com/lefeverd/borg-exporter/internal/models"
-	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/lefeverd/borg-exporter/internal/storage"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"io"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,43 +31,175 @@ type config struct {
 	borgRepositories       string
 	borgPath               string
 	borgOpts               string
+	configFile             string
+	maxConcurrency         int
+	maxConcurrencyPerHost  int
+	collectArchives        bool
+	archiveSeriesLimit     int
+	checkInterval          time.Duration
+	checkTimeout           time.Duration
+	checkMode              string
+	checkVerifyDataLast    int
+	probeTimeout           time.Duration
+	probeCacheTTL          time.Duration
+	probeAnyTarget         bool
+	thresholds             thresholds
+	freshnessMaxAge        time.Duration
+	encryptionPolicy       models.EncryptionPolicy
+	pushgatewayURL         string
+	pushJob                string
+	pushGroupingLabels     string
+	pushPerRepository      bool
+	pushDeleteOnShutdown   bool
+	stateFile              string
+	historyFile            string
+	storagePaths           string
+	forecastWindow         time.Duration
+	storageRefreshInterval time.Duration
+	wrapEndpoints          bool
+	logRecordsLimit        int
 	logLevel               string
 }
 
 type Application struct {
-	logger           *slog.Logger
-	logLevel         *slog.LevelVar
-	config           *config
-	borgRepositories []string
-	metricsCache     *models.MetricsCache
-	borgParser       parser.BorgParserInterface
+	logger       *slog.Logger
+	logLevel     *slog.LevelVar
+	config       *config
+	repositories []*repository
+	extraLabels  []string
+	metricsCache *models.MetricsCache
+	runner       CommandRunner
+	retryDelay   time.Duration
+	probes       probeCache
+	// repositoryLocks prevents collecting a repository while it is checked
+	repositoryLocks repositoryLocks
+	pushers         []*push.Pusher
+	// history records the statistics of every collection, nil when no history file is configured
+	history *history.Store
+	// storage scans the repositories on the backup server, nil when no storage path is configured
+	storage *storage.Collector
+
+	// envErrors holds the errors of the environment variables which could not be parsed, see parseFlags
+	envErrors []error
+
+	// borgVersions holds the detected borg versions, see setBorgDialect
+	borgVersions     map[string]string
+	borgVersionsLock sync.Mutex
 }
 
+// Execute runs the subcommand given as first argument, or serve when the first argument is a flag
 func Execute(Version string) {
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		newApplication(os.Stdout).Serve(Version, args)
+	case "collect":
+		os.Exit(newApplication(os.Stdout).CollectOnce(Version, args))
+	case "backfill":
+		// The standard output can be used for the OpenMetrics output
+		os.Exit(newApplication(os.Stderr).Backfill(Version, args))
+	case "wrap":
+		// The standard output of borg create is passed through
+		os.Exit(newApplication(os.Stderr).Wrap(os.Stdout, os.Stderr, args))
+	case "check":
+		// The standard output is reserved to the plugin output
+		os.Exit(newApplication(os.Stderr).NagiosCheck(os.Stdout, args))
+	case "version":
+		fmt.Println(Version)
+	case "help":
+		printUsage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		printUsage()
+		os.Exit(2)
+	}
+}
+
+// printUsage prints the list of subcommands
+func printUsage() {
+	fmt.Fprintf(os.Stderr, `Usage: borg-exporter [command] [flags]
+
+Commands:
+  serve     collect the metrics periodically and expose them over HTTP (default)
+  collect   collect the metrics once and write them to a textfile or push them
+  check     collect the metrics once and evaluate thresholds, as a Nagios/Icinga plugin
+  backfill  write the metrics of every archive to an OpenMetrics file, to import the history in Prometheus
+  wrap      run borg create and report its progress and result to a running exporter
+  version   print the version
+
+Run borg-exporter <command> -h for the flags of a command.
+`)
+}
+
+func newApplication(logOutput io.Writer) *Application {
 	logLevel := &slog.LevelVar{} // INFO
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	logger := slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{
 		Level: logLevel,
 	}))
-	app := &Application{
-		logger:   logger,
-		logLevel: logLevel,
+	return &Application{
+		logger:     logger,
+		logLevel:   logLevel,
+		runner:     NewLocalRunner(),
+		retryDelay: time.Minute,
 	}
+}
 
+// registerCollectionFlags registers the flags configuring the repositories and their collection
+func (app *Application) registerCollectionFlags(fs *flag.FlagSet, cfg *config) {
+	fs.DurationVar(&cfg.metricsRefreshInterval, "metrics-refresh-interval", app.getDurationEnv("METRICS_REFRESH_INTERVAL", 4*time.Hour), "metrics refresh interval (default 4h)")
+	fs.DurationVar(&cfg.commandTimeout, "command-timeout", app.getDurationEnv("COMMAND_TIMEOUT", 120*time.Second), "borg command timeout (default 120s)")
+	fs.StringVar(&cfg.borgRepositories, "borg-repositories", os.Getenv("BORG_REPOSITORIES"), "comma-separated list of borg repositories")
+	fs.StringVar(&cfg.borgPath, "borg-path", app.getEnv("BORG_PATH", "borg"), "path to the borg binary (default borg)")
+	fs.StringVar(&cfg.borgOpts, "borg-opts", app.getEnv("BORG_OPTS", ""), "borg options")
+	fs.StringVar(&cfg.configFile, "config-file", os.Getenv("CONFIG_FILE"), "path to the YAML configuration file defining the repositories")
+	fs.IntVar(&cfg.maxConcurrency, "max-concurrency", app.getIntEnv("MAX_CONCURRENCY", 1), "maximum number of repositories collected concurrently (default 1)")
+	fs.IntVar(&cfg.maxConcurrencyPerHost, "max-concurrency-per-host", app.getIntEnv("MAX_CONCURRENCY_PER_HOST", 0), "maximum number of repositories of the same host collected concurrently, 0 for no limit (default 0)")
+	fs.BoolVar(&cfg.collectArchives, "collect-archives", app.getBoolEnv("COLLECT_ARCHIVES", false), "collect metrics for every archive with borg list")
+	fs.IntVar(&cfg.archiveSeriesLimit, "archive-series-limit", app.getIntEnv("ARCHIVE_SERIES_LIMIT", 30), "maximum number of most recent archives exposed as labeled series (default 30)")
+	fs.DurationVar(&cfg.freshnessMaxAge, "freshness-max-age", app.getDurationEnv("FRESHNESS_MAX_AGE", 0), "maximum expected age of the last backup of the repositories, 0 to disable (default 0)")
+	fs.StringVar((*string)(&cfg.encryptionPolicy), "encryption-policy", os.Getenv("ENCRYPTION_POLICY"), "flag the repositories whose encryption mode is not authenticated or not encrypted, disabled when empty")
+	fs.StringVar(&cfg.pushgatewayURL, "pushgateway-url", os.Getenv("PUSHGATEWAY_URL"), "URL of the Pushgateway to push the metrics to after each collection, disabled when empty")
+	fs.StringVar(&cfg.pushJob, "push-job", app.getEnv("PUSH_JOB", "borg"), "job name of the pushed metrics (default borg)")
+	fs.StringVar(&cfg.pushGroupingLabels, "push-grouping-labels", app.getEnv("PUSH_GROUPING_LABELS", "instance="+hostname()), "comma-separated list of name=value grouping labels of the pushed metrics (default instance=<hostname>)")
+	fs.BoolVar(&cfg.pushPerRepository, "push-per-repository", app.getBoolEnv("PUSH_PER_REPOSITORY", false), "push the metrics of each repository in its own group, labeled by repository")
+	fs.StringVar(&cfg.storagePaths, "storage-paths", os.Getenv("STORAGE_PATHS"), "comma-separated list of repositories or directories of repositories to inspect on the backup server, possibly as globs, disabled when empty")
+	fs.StringVar(&cfg.logLevel, "log-level", os.Getenv("LOG_LEVEL"), "log level")
+}
+
+// Serve collects the metrics at their refresh interval and exposes them over HTTP, until the process is stopped
+func (app *Application) Serve(Version string, args []string) {
 	// Parse configuration
 	var cfg config
-	flag.StringVar(&cfg.listenAddress, "listen-address", app.getEnv("LISTEN_ADDRESS", ":9099"), "http service address")
-	flag.StringVar(&cfg.metricsPath, "metrics-path", app.getEnv("METRICS_PATH", "/metrics"), "metrics endpoint path")
-	flag.DurationVar(&cfg.metricsRefreshInterval, "metrics-refresh-interval", app.getDurationEnv("METRICS_REFRESH_INTERVAL", 4*time.Hour), "metrics refresh interval (default 4h)")
-	flag.DurationVar(&cfg.schedulerCheckInterval, "scheduler-check-interval", app.getDurationEnv("SCHEDULER_CHECK_INTERVAL", 20*time.Second), "scheduler check interval (default 20s)")
-	flag.DurationVar(&cfg.commandTimeout, "command-timeout", app.getDurationEnv("COMMAND_TIMEOUT", 120*time.Second), "borg command timeout (default 120s)")
-	flag.StringVar(&cfg.borgRepositories, "borg-repositories", os.Getenv("BORG_REPOSITORIES"), "comma-separated list of borg repositories")
-	flag.StringVar(&cfg.borgPath, "borg-path", app.getEnv("BORG_PATH", "borg"), "path to the borg binary (default borg)")
-	flag.StringVar(&cfg.borgOpts, "borg-opts", app.getEnv("BORG_OPTS", ""), "borg options")
-	flag.StringVar(&cfg.logLevel, "log-level", os.Getenv("LOG_LEVEL"), "log level")
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	app.registerCollectionFlags(fs, &cfg)
+	fs.StringVar(&cfg.listenAddress, "listen-address", app.getEnv("LISTEN_ADDRESS", ":9099"), "http service address")
+	fs.StringVar(&cfg.metricsPath, "metrics-path", app.getEnv("METRICS_PATH", "/metrics"), "metrics endpoint path")
+	fs.DurationVar(&cfg.schedulerCheckInterval, "scheduler-check-interval", app.getDurationEnv("SCHEDULER_CHECK_INTERVAL", 20*time.Second), "scheduler check interval (default 20s)")
+	fs.DurationVar(&cfg.checkInterval, "check-interval", app.getDurationEnv("CHECK_INTERVAL", 0), "borg check interval, 0 to disable (default 0)")
+	fs.DurationVar(&cfg.checkTimeout, "check-timeout", app.getDurationEnv("CHECK_TIMEOUT", 6*time.Hour), "borg check timeout (default 6h)")
+	fs.StringVar(&cfg.checkMode, "check-mode", app.getEnv("CHECK_MODE", CheckModeRepository), "borg check mode: repository, archives or verify-data (default repository)")
+	fs.IntVar(&cfg.checkVerifyDataLast, "check-verify-data-last", app.getIntEnv("CHECK_VERIFY_DATA_LAST", 0), "only verify the data of the last N archives in verify-data mode, 0 for all (default 0)")
+	fs.DurationVar(&cfg.probeTimeout, "probe-timeout", app.getDurationEnv("PROBE_TIMEOUT", 120*time.Second), "timeout of the probe endpoint, reduced to the Prometheus scrape timeout (default 120s)")
+	fs.DurationVar(&cfg.probeCacheTTL, "probe-cache-ttl", app.getDurationEnv("PROBE_CACHE_TTL", 5*time.Minute), "duration during which the result of a probe is reused, 0 to disable (default 5m)")
+	fs.BoolVar(&cfg.probeAnyTarget, "probe-any-target", app.getBoolEnv("PROBE_ANY_TARGET", false), "accept probe targets which are not configured repositories, collected with the default settings")
+	fs.BoolVar(&cfg.pushDeleteOnShutdown, "push-delete-on-shutdown", app.getBoolEnv("PUSH_DELETE_ON_SHUTDOWN", false), "delete the pushed metrics from the Pushgateway on shutdown")
+	fs.IntVar(&cfg.logRecordsLimit, "log-records-limit", app.getIntEnv("LOG_RECORDS_LIMIT", 100), "number of borg log records kept for each repository for the logs endpoint (default 100)")
+	fs.StringVar(&cfg.stateFile, "state-file", os.Getenv("STATE_FILE"), "path of the file persisting the collected metrics across restarts, disabled when empty")
+	fs.StringVar(&cfg.historyFile, "history-file", os.Getenv("HISTORY_FILE"), "path of the file recording the statistics of every collection for the history endpoints, disabled when empty")
+	fs.DurationVar(&cfg.forecastWindow, "forecast-window", app.getDurationEnv("FORECAST_WINDOW", 30*24*time.Hour), "duration of the size history used to forecast when the repositories are full, 0 to disable (default 720h)")
+	fs.BoolVar(&cfg.wrapEndpoints, "wrap-endpoints", app.getBoolEnv("WRAP_ENDPOINTS", false), "accept the progress and the result of the backups reported by the wrap command")
+	fs.DurationVar(&cfg.storageRefreshInterval, "storage-refresh-interval", app.getDurationEnv("STORAGE_REFRESH_INTERVAL", 5*time.Minute), "interval between two scans of the storage paths (default 5m)")
 
 	var version bool
-	flag.BoolVar(&version, "version", false, "prints the version")
-	flag.Parse()
+	fs.BoolVar(&version, "version", false, "prints the version")
+	if err := app.parseFlags(fs, args); err != nil {
+		app.logger.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
 
 	if version {
 		fmt.Println(Version)
@@ -71,43 +207,162 @@ func Execute(Version string) {
 	}
 
 	app.logger.Info("Starting borg-exporter", "version", Version)
-	app.config = &cfg
-
-	if cfg.borgRepositories == "" {
-		app.logger.Error("No borg repositories defined")
+	reg, err := app.setup(&cfg)
+	if err != nil {
+		app.logger.Error("Invalid configuration", "error", err)
 		os.Exit(1)
 	}
-	app.borgRepositories = strings.Split(cfg.borgRepositories, ",")
-
-	app.setLogLevel()
-
-	// Setup our app by injecting our dependencies
-	app.metricsCache = &models.MetricsCache{
-		Metrics: models.NewBorgMetrics(app.getBorgVersion()),
+	if len(app.repositories) == 0 && app.storage == nil {
+		if cfg.probeAnyTarget {
+			app.logger.Info("No borg repositories defined, metrics are only collected by the probe endpoint")
+		} else {
+			app.logger.Warn("No borg repositories defined, set PROBE_ANY_TARGET to collect them with the probe endpoint")
+		}
+	}
+	if cfg.pushgatewayURL != "" && cfg.pushDeleteOnShutdown {
+		go app.deletePushedOnShutdown()
+	}
+	app.restoreState()
+	if cfg.historyFile != "" {
+		app.history, err = history.Open(cfg.historyFile)
+		if err != nil {
+			app.logger.Error("Invalid configuration", "error", err)
+			os.Exit(1)
+		}
+		app.logger.Info("Recording the history of the collections", "path", cfg.historyFile)
 	}
-	app.borgParser = &parser.BorgParser{}
 
-	// Create non-global registry and register our metrics
-	reg := prometheus.NewRegistry()
-	app.metricsCache.Metrics.Register(reg)
+	// The initial metrics collection runs in the background, so that the restored metrics are served right away
+	go func() {
+		app.logger.Info("Starting initial metrics collection")
+		app.CollectWrapper()
+		app.logger.Info("Initial metrics collection done")
 
-	// Trigger an initial metrics collection before starting the web server
-	app.logger.Info("Starting initial metrics collection")
-	app.CollectWrapper()
-	app.logger.Info("Initial metrics collection done")
+		app.logger.Info("Start metrics collection routine", "refresh interval", app.config.metricsRefreshInterval.String())
+		app.CollectLoop()
+	}()
 
-	app.logger.Info("Start metrics collection routine", "refresh interval", app.config.metricsRefreshInterval.String())
-	go app.CollectLoop()
+	if app.storage != nil {
+		app.logger.Info("Start storage scan routine", "refresh interval", app.config.storageRefreshInterval.String(), "paths", app.storage.Paths)
+		go app.StorageLoop()
+	}
+
+	if app.config.checkInterval > 0 {
+		if _, err := app.checkArgs(); err != nil {
+			app.logger.Error("Invalid check configuration", "error", err)
+			os.Exit(1)
+		}
+		app.logger.Info("Start borg check routine", "check interval", app.config.checkInterval.String(), "mode", app.config.checkMode)
+		go app.CheckLoop()
+	}
 
 	// Create our endpoints and start the web server
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	http.HandleFunc("/probe", app.ProbeHandler)
+	http.HandleFunc("/logs", app.LogsHandler)
+	if app.history != nil {
+		http.HandleFunc("/history", app.HistoryHandler)
+		http.HandleFunc("/history/aggregate", app.HistoryAggregateHandler)
+	}
+	if cfg.wrapEndpoints {
+		http.HandleFunc("/wrap/progress", app.WrapProgressHandler)
+		http.HandleFunc("/wrap/result", app.WrapResultHandler)
+	}
 	log.Printf("Starting borgmatic exporter on %s", cfg.listenAddress)
 	log.Fatal(http.ListenAndServe(cfg.listenAddress, nil))
 }
 
+// setup builds the repositories from the configuration, detects their borg version
+// and returns the registry exposing the metrics cache.
+func (app *Application) setup(cfg *config) (*prometheus.Registry, error) {
+	app.config = cfg
+
+	app.setLogLevel()
+
+	if cfg.logRecordsLimit < 0 {
+		return nil, fmt.Errorf("invalid log records limit %d, expected 0 or more", cfg.logRecordsLimit)
+	}
+
+	var fileCfg *fileConfig
+	if cfg.configFile != "" {
+		var err error
+		fileCfg, err = loadConfigFile(cfg.configFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load config file: %w", err)
+		}
+	}
+
+	repositories, err := buildRepositories(cfg, fileCfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repositories configuration: %w", err)
+	}
+	app.repositories = repositories
+	app.extraLabels = extraLabelNames(repositories)
+
+	// Setup our app by injecting our dependencies.
+	// The commands and the parser depend on the major version of the borg binary used for each repository.
+	for _, repo := range app.repositories {
+		app.setBorgDialect(repo)
+	}
+	// The system info reports the default borg binary, or the one of the first repository when it is not used
+	systemRepository := newDefaultRepository(cfg, "")
+	if _, ok := app.borgVersions[systemRepository.versionKey()]; !ok && len(app.repositories) > 0 {
+		systemRepository = app.repositories[0]
+	}
+	systemBorgVersion := app.setBorgDialect(systemRepository)
+	metrics := models.NewBorgMetrics(systemBorgVersion, app.extraLabels)
+	metrics.ArchiveMetrics = cfg.collectArchives
+	metrics.ArchiveSeriesLimit = cfg.archiveSeriesLimit
+	app.metricsCache = models.NewMetricsCache(metrics)
+	app.metricsCache.LogRecordsLimit = cfg.logRecordsLimit
+	app.metricsCache.ForecastWindow = cfg.forecastWindow
+
+	// Create non-global registry and register our metrics
+	reg := prometheus.NewRegistry()
+	app.metricsCache.Register(reg)
+
+	if cfg.storagePaths != "" {
+		var paths []string
+		for _, path := range strings.Split(cfg.storagePaths, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				paths = append(paths, path)
+			}
+		}
+		app.storage = storage.NewCollector(paths)
+		reg.MustRegister(app.storage)
+	}
+
+	if cfg.pushgatewayURL != "" {
+		app.pushers, err = app.newPushers(reg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid push configuration: %w", err)
+		}
+		app.logger.Info("Pushing the metrics after each collection", "pushgateway", cfg.pushgatewayURL, "job", cfg.pushJob)
+	}
+	return reg, nil
+}
+
+// hostname returns the hostname of the machine, or unknown when it cannot be determined
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
+
+// parseFlags parses the flags of a command, and returns the error of the flags or of the environment variables
+// used as their defaults
+func (app *Application) parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return errors.Join(app.envErrors...)
+}
+
 func (app *Application) getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
@@ -119,14 +374,38 @@ func (app *Application) getDurationEnv(key string, fallback time.Duration) time.
 	if value, ok := os.LookupEnv(key); ok {
 		duration, err := time.ParseDuration(value)
 		if err != nil {
-			app.logger.Error("Cannot parse duration for config item", "item", key, "error", err)
-			os.Exit(1)
+			app.envErrors = append(app.envErrors, fmt.Errorf("cannot parse duration of %s: %w", key, err))
+			return fallback
 		}
 		return duration
 	}
 	return fallback
 }
 
+func (app *Application) getBoolEnv(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			app.envErrors = append(app.envErrors, fmt.Errorf("cannot parse boolean of %s: %w", key, err))
+			return fallback
+		}
+		return b
+	}
+	return fallback
+}
+
+func (app *Application) getIntEnv(key string, fallback int) int {
+	if value, ok := os.LookupEnv(key); ok {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			app.envErrors = append(app.envErrors, fmt.Errorf("cannot parse integer of %s: %w", key, err))
+			return fallback
+		}
+		return i
+	}
+	return fallback
+}
+
 func (app *Application) setLogLevel() {
 	if app.config.logLevel == "" {
 		return
@@ -144,64 +423,104 @@ func (app *Application) setLogLevel() {
 	}
 }
 
-func (app *Application) getBorgVersion() string {
+// setBorgDialect sets the commands and the parser of a repository depending on the version of its borg binary,
+// and returns the version. The version is only detected once per borg binary.
+func (app *Application) setBorgDialect(repo *repository) string {
+	app.borgVersionsLock.Lock()
+	defer app.borgVersionsLock.Unlock()
+
+	if app.borgVersions == nil {
+		app.borgVersions = map[string]string{}
+	}
+	key := repo.versionKey()
+	version, ok := app.borgVersions[key]
+	if !ok {
+		version = app.getBorgVersion(app.runnerFor(repo), repo.borgPath)
+		app.borgVersions[key] = version
+		app.logger.Info("Detected borg version", "borg path", key, "version", version)
+	}
+	repo.commands, repo.parser = newBorgDialect(version)
+	return version
+}
+
+func (app *Application) getBorgVersion(runner CommandRunner, borgPath string) string {
 	// Create command with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), app.config.commandTimeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, "borg", "--version")
-	output, err := cmd.Output()
+	output, _, err := runner.Run(ctx, Command{Path: borgPath, Args: []string{"--version"}})
 	if err != nil {
-		app.logger.Error("Could not get borg version")
+		app.logger.Error("Could not get borg version", "borg path", borgPath)
 		return ""
 	}
 	return strings.TrimSpace(string(output))
 }
 
-// CollectLoop executes the metrics collection at every refresh interval.
+// CollectLoop executes the metrics collection of each repository at its refresh interval.
 func (app *Application) CollectLoop() {
 	opts := NewTaskSchedulerOpts()
 	opts.CheckInterval = app.config.schedulerCheckInterval
-	scheduler := NewTaskScheduler(app.config.metricsRefreshInterval, opts)
+	schedulers := make([]*TaskScheduler, len(app.repositories))
+	for i, repo := range app.repositories {
+		schedulers[i] = NewTaskScheduler(repo.refreshInterval, opts)
+	}
 	for {
-		if scheduler.ShouldRun() {
-			app.logger.Info("Refreshing metrics")
-			app.CollectWrapper()
+		var due []*repository
+		var dueSchedulers []*TaskScheduler
+		for i, scheduler := range schedulers {
+			if scheduler.ShouldRun() {
+				due = append(due, app.repositories[i])
+				dueSchedulers = append(dueSchedulers, scheduler)
+			}
+		}
+		if len(due) > 0 {
+			app.logger.Info("Refreshing metrics", "repositories", len(due))
+			app.collectWrapper(due)
 			app.logger.Info("Refreshing metrics done")
-			scheduler.UpdateLastRun()
+			for _, scheduler := range dueSchedulers {
+				scheduler.UpdateLastRun()
+			}
 		}
-		scheduler.WaitForNextRun()
+		time.Sleep(app.config.schedulerCheckInterval)
 	}
 }
 
 // CollectWrapper wraps the Collect method and logs any errors
 func (app *Application) CollectWrapper() {
+	app.collectWrapper(app.repositories)
+}
+
+// collectWrapper collects the metrics of the given repositories, logs any errors and retries in case of failure.
+// The metrics are pushed to the Pushgateway once done, when configured.
+func (app *Application) collectWrapper(repositories []*repository) {
 	const maxRetries = 5
 	var attempt int
+	defer func() {
+		app.saveState()
+		app.logErrors("Push failed with the following error(s):", app.Push())
+	}()
 
 	for {
-		errs := app.Collect()
+		errs := app.collectRepositories(repositories)
 		if len(errs) == 0 {
 			return
 		}
 
-		// Log errors
-		app.logger.Error("Collection failed with the following error(s):")
-		for _, err := range errs {
-			var repositoryCollectionError *RepositoryCollectionError
-			if errors.As(err, &repositoryCollectionError) {
-				app.logger.Error(repositoryCollectionError.Msg, "repository", repositoryCollectionError.Repository, "error", repositoryCollectionError.Err, "stdErr", repositoryCollectionError.StdErr)
-				continue
-			} else {
-				app.logger.Error(err.Error())
+		app.logErrors("Collection failed with the following error(s):", errs)
+
+		// Not useful to retry the repositories whose refresh interval is smaller than 5 minutes,
+		// the retries would overlap their next refresh
+		var retried []*repository
+		for _, repo := range repositories {
+			if repo.refreshInterval >= 5*time.Minute {
+				retried = append(retried, repo)
 			}
 		}
-
-		// Not useful to retry if the refresh interval is smaller than 5 minutes
-		if app.config.metricsRefreshInterval < 5*time.Minute {
+		if len(retried) == 0 {
 			app.logger.Info("Metrics refresh interval is too short for retries, aborting and waiting for next refresh.")
 			return
 		}
+		repositories = retried
 
 		// Check retry limit
 		if attempt >= maxRetries {
@@ -209,8 +528,24 @@ func (app *Application) CollectWrapper() {
 			return
 		}
 
-		app.logger.Info("Retrying in a minute")
-		time.Sleep(1 * time.Minute)
+		app.logger.Info("Retrying", "delay", app.retryDelay.String())
+		time.Sleep(app.retryDelay)
 		attempt++
 	}
 }
+
+// logErrors logs the given errors, with the details of the repository when available
+func (app *Application) logErrors(msg string, errs []error) {
+	if len(errs) == 0 {
+		return
+	}
+	app.logger.Error(msg)
+	for _, err := range errs {
+		var repositoryCollectionError *RepositoryCollectionError
+		if errors.As(err, &repositoryCollectionError) {
+			app.logger.Error(repositoryCollectionError.Msg, "repository", repositoryCollectionError.Repository, "error", repositoryCollectionError.Err, "stdErr", repositoryCollectionError.StdErr)
+			continue
+		}
+		app.logger.Error(err.Error())
+	}
+}
@@ -0,0 +1,429 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/lefeverd/borg-exporter/internal/models"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxWrapReportSize is the maximum size of the body of a report of the wrap command
+const maxWrapReportSize = 1 << 20
+
+// maxStderrLineSize is the maximum size of a line of the standard error of the wrapped borg command
+const maxStderrLineSize = 1 << 20
+
+// wrapFlags are the flags required by the wrap command, added to the borg create command when missing
+var wrapFlags = []string{"--json", "--log-json", "--progress"}
+
+// wrapProgress is the progress of a backup, reported by the wrap command to the exporter
+type wrapProgress struct {
+	Start            time.Time `json:"start"`
+	OriginalSize     int64     `json:"original_size"`
+	CompressedSize   int64     `json:"compressed_size"`
+	DeduplicatedSize int64     `json:"deduplicated_size"`
+	Files            int64     `json:"files"`
+}
+
+// wrapResult is the result of a backup, reported by the wrap command to the exporter
+type wrapResult struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exit_code"`
+	Warnings int       `json:"warnings"`
+	// Output is the standard output of borg create --json, empty when no archive was created
+	Output json.RawMessage `json:"output,omitempty"`
+}
+
+// wrapProgressTracker holds the progress of the wrapped borg create, updated from its standard error
+type wrapProgressTracker struct {
+	sync.Mutex
+	progress wrapProgress
+}
+
+func (t *wrapProgressTracker) update(progress parser.Progress) {
+	t.Lock()
+	defer t.Unlock()
+	t.progress.OriginalSize = progress.OriginalSize
+	t.progress.CompressedSize = progress.CompressedSize
+	t.progress.DeduplicatedSize = progress.DeduplicatedSize
+	t.progress.Files = progress.NFiles
+}
+
+func (t *wrapProgressTracker) get() wrapProgress {
+	t.Lock()
+	defer t.Unlock()
+	return t.progress
+}
+
+// wrapReporter sends the reports of the wrap command to the exporter
+type wrapReporter struct {
+	url        string
+	repository string
+	client     *http.Client
+}
+
+// post sends a report to an endpoint of the exporter
+func (r *wrapReporter) post(path string, report any) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimSuffix(r.url, "/") + path + "?repository=" + url.QueryEscape(r.repository)
+	resp, err := r.client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("the exporter returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// Wrap runs borg create, reports its progress to a running exporter while it runs,
+// then reports its result, so that the last backup metrics are updated without waiting for the next collection.
+// The standard output of borg is written to stdout and its log messages to stderr.
+// It returns the exit code of borg, or 2 when borg could not be run or for invalid flags.
+// Failing to report to the exporter doesn't change the exit code, as the backup itself is not affected.
+func (app *Application) Wrap(stdout, stderr io.Writer, args []string) int {
+	var cfg config
+	var exporterURL, repositoryName string
+	var progressInterval time.Duration
+	fs := flag.NewFlagSet("wrap", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: borg-exporter wrap [flags] -- borg create [borg flags]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&exporterURL, "exporter-url", app.getEnv("WRAP_EXPORTER_URL", "http://localhost:9099"), "URL of the exporter to report the backup to, which must run with -wrap-endpoints (default http://localhost:9099)")
+	fs.StringVar(&repositoryName, "repository", os.Getenv("WRAP_REPOSITORY"), "name or location of the repository in the configuration of the exporter, taken from the borg command when empty")
+	fs.DurationVar(&progressInterval, "progress-interval", app.getDurationEnv("WRAP_PROGRESS_INTERVAL", 10*time.Second), "interval between two progress reports (default 10s)")
+	fs.StringVar(&cfg.logLevel, "log-level", os.Getenv("LOG_LEVEL"), "log level")
+	err := app.parseFlags(fs, args)
+	app.config = &cfg
+	app.setLogLevel()
+	if err != nil {
+		app.logger.Error("Invalid configuration", "error", err)
+		return 2
+	}
+
+	command, err := wrapCommand(fs.Args())
+	if err != nil {
+		app.logger.Error("Invalid wrapped command", "error", err)
+		return 2
+	}
+	if repositoryName == "" {
+		repositoryName = commandRepository(command[1:])
+	}
+	if repositoryName == "" {
+		app.logger.Error("Cannot find the repository in the borg command, set it with -repository")
+		return 2
+	}
+	if progressInterval <= 0 {
+		app.logger.Error("The progress interval must be positive", "progress interval", progressInterval)
+		return 2
+	}
+	reporter := &wrapReporter{url: exporterURL, repository: repositoryName, client: &http.Client{Timeout: 10 * time.Second}}
+
+	start := time.Now()
+	var output bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(stdout, &output)
+	stdErr, err := cmd.StderrPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		app.logger.Error("Cannot run the borg command", "error", err)
+		app.reportWrapResult(reporter, wrapResult{Start: start, End: time.Now(), ExitCode: 2})
+		return 2
+	}
+
+	// As a shell does for a foreground command, the signals are not forwarded to borg, which receives them from the
+	// terminal or the service manager with the rest of the process group. A second SIGINT would make borg abort
+	// without saving a checkpoint. The wrapper only waits for borg to exit, to report its result.
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				app.logger.Info("Signal received, waiting for borg to exit", "signal", sig.String())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	tracker := &wrapProgressTracker{progress: wrapProgress{Start: start}}
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		app.reportWrapProgress(reporter, tracker, progressInterval, done)
+	}()
+
+	// The standard error must be read entirely before waiting for borg
+	warnings := app.streamWrapStderr(stdErr, stderr, tracker)
+	err = cmd.Wait()
+	close(done)
+	<-reported
+
+	exitCode := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		// Killed by a signal, reported as an error as borg does
+		if exitCode <= 0 {
+			exitCode = 2
+		}
+	}
+	result := wrapResult{Start: start, End: time.Now(), ExitCode: exitCode, Warnings: warnings}
+	if data := bytes.TrimSpace(output.Bytes()); len(data) > 0 && json.Valid(data) {
+		result.Output = data
+	}
+	app.reportWrapResult(reporter, result)
+	return exitCode
+}
+
+// wrapCommand checks that the wrapped command runs borg create, and adds the flags required by the wrap command
+// after the create subcommand when they are missing
+func wrapCommand(command []string) ([]string, error) {
+	if len(command) == 0 {
+		return nil, errors.New("the borg create command is missing, give it after --")
+	}
+	create := -1
+	for i, arg := range command[1:] {
+		if arg == "create" {
+			create = i + 1
+			break
+		}
+	}
+	if create == -1 {
+		return nil, fmt.Errorf("%q is not a borg create command", strings.Join(command, " "))
+	}
+
+	var missing []string
+	for _, required := range wrapFlags {
+		found := false
+		for _, arg := range command[1:] {
+			if arg == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, required)
+		}
+	}
+	wrapped := append([]string{}, command[:create+1]...)
+	wrapped = append(wrapped, missing...)
+	return append(wrapped, command[create+1:]...), nil
+}
+
+// commandRepository returns the repository of the arguments of borg create,
+// given by -r or --repo for borg 2.x or before the archive name for borg 1.x, then BORG_REPO when it is not given
+func commandRepository(args []string) string {
+	for i, arg := range args {
+		switch {
+		case (arg == "-r" || arg == "--repo") && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(arg, "--repo="):
+			return strings.TrimPrefix(arg, "--repo=")
+		case !strings.HasPrefix(arg, "-") && strings.Contains(arg, "::"):
+			if repository, _, _ := strings.Cut(arg, "::"); repository != "" {
+				return repository
+			}
+		}
+	}
+	return os.Getenv("BORG_REPO")
+}
+
+// streamWrapStderr reads the standard error of borg create run with --progress and --log-json until it is closed.
+// The archive progress lines update the tracker, the other progress lines are dropped,
+// and the log messages are written to stderr as borg writes them without --log-json.
+// It returns the number of warnings logged by borg.
+func (app *Application) streamWrapStderr(r io.Reader, stderr io.Writer, tracker *wrapProgressTracker) int {
+	warnings := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStderrLineSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if progress, ok := parser.ParseProgress(line); ok {
+			// The last archive progress line is only flagged as finished, without the sizes
+			if progress.Type == parser.TypeArchiveProgress && !progress.Finished {
+				tracker.update(progress)
+			}
+			continue
+		}
+		records := parser.ParseLogJSON(line)
+		if len(records) == 0 {
+			// Other JSON lines, such as the file status lines of --list
+			fmt.Fprintf(stderr, "%s\n", line)
+			continue
+		}
+		for _, record := range records {
+			fmt.Fprintln(stderr, record.Message)
+			if record.IsWarning() {
+				warnings++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		app.logger.Warn("Cannot read the output of borg, the progress is not reported anymore", "error", err)
+		// Borg would block on a full pipe
+		io.Copy(stderr, r)
+	}
+	return warnings
+}
+
+// reportWrapProgress reports the progress of the tracker to the exporter right away, then at the given interval
+// until done is closed.
+// The reports are sent even when the progress didn't change, so that the exporter knows the backup is still running.
+func (app *Application) reportWrapProgress(reporter *wrapReporter, tracker *wrapProgressTracker, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		// Only the first failure is logged as a warning, to avoid flooding the logs when the exporter is down
+		if err := reporter.post("/wrap/progress", tracker.get()); err != nil {
+			if !failing {
+				app.logger.Warn("Cannot report the backup progress to the exporter", "url", reporter.url, "error", err)
+			}
+			failing = true
+		} else {
+			failing = false
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportWrapResult reports the result of the backup to the exporter, logging the failures
+func (app *Application) reportWrapResult(reporter *wrapReporter, result wrapResult) {
+	if err := reporter.post("/wrap/result", result); err != nil {
+		app.logger.Error("Cannot report the backup result to the exporter", "url", reporter.url, "error", err)
+		return
+	}
+	app.logger.Debug("Reported the backup result to the exporter", "repository", reporter.repository, "exit code", result.ExitCode)
+}
+
+// wrapRepository returns the configured repository a report of the wrap command refers to, and decodes the report.
+// The error response is written and nil is returned when the request is invalid.
+func (app *Application) wrapRepository(w http.ResponseWriter, r *http.Request, report any) *repository {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	repo := app.findRepository(r.URL.Query().Get("repository"))
+	if repo == nil {
+		http.Error(w, "unknown repository", http.StatusNotFound)
+		return nil
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWrapReportSize)).Decode(report); err != nil {
+		http.Error(w, fmt.Sprintf("invalid report: %s", err), http.StatusBadRequest)
+		return nil
+	}
+	return repo
+}
+
+// WrapProgressHandler records the progress of a backup reported by the wrap command
+func (app *Application) WrapProgressHandler(w http.ResponseWriter, r *http.Request) {
+	var progress wrapProgress
+	repo := app.wrapRepository(w, r, &progress)
+	if repo == nil {
+		return
+	}
+
+	app.metricsCache.Lock()
+	snapshot := repositorySnapshot(app.metricsCache, repo)
+	if snapshot.Backup == nil {
+		snapshot.Backup = &models.BackupSnapshot{}
+	}
+	backup := snapshot.Backup
+	backup.Running = true
+	backup.Start = progress.Start
+	backup.Updated = time.Now()
+	backup.OriginalSize = float64(progress.OriginalSize)
+	backup.CompressedSize = float64(progress.CompressedSize)
+	backup.DeduplicatedSize = float64(progress.DeduplicatedSize)
+	backup.Files = float64(progress.Files)
+	app.metricsCache.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WrapResultHandler records the result of a backup reported by the wrap command.
+// The output of borg create is parsed as the last archive of the repository, so that the last backup metrics
+// are updated right away. The metrics are then saved and pushed, as after a collection.
+func (app *Application) WrapResultHandler(w http.ResponseWriter, r *http.Request) {
+	var result wrapResult
+	repo := app.wrapRepository(w, r, &result)
+	if repo == nil {
+		return
+	}
+
+	var created *parser.InfoOutput
+	var parseErr error
+	if len(result.Output) > 0 {
+		info, err := repo.parser.ParseCreate(result.Output)
+		if err == nil && len(info.Archives) > 0 {
+			created = &info
+		}
+		parseErr = err
+	}
+
+	app.metricsCache.Lock()
+	snapshot := repositorySnapshot(app.metricsCache, repo)
+	if snapshot.Backup == nil {
+		snapshot.Backup = &models.BackupSnapshot{}
+	}
+	backup := snapshot.Backup
+	backup.Running = false
+	backup.LastEnd = result.End
+	backup.LastExitCode = result.ExitCode
+	backup.LastWarnings = result.Warnings
+	if created != nil {
+		snapshot.AddArchive(created)
+		// Borg 2 doesn't report the deduplicated compressed size
+		if size := float64(created.Cache.Stats.DeduplicatedCompressedSize); size > 0 {
+			snapshot.AddSizeSample(models.SizeSample{Timestamp: result.End, Size: size}, app.metricsCache.ForecastWindow)
+		}
+		app.metricsCache.LastUpdate = time.Now()
+	}
+	app.metricsCache.Unlock()
+	app.logger.Info("Backup reported by the wrap command", "repository", repo.name(), "exit code", result.ExitCode, "warnings", result.Warnings)
+
+	app.saveState()
+	app.logErrors("Push failed with the following error(s):", app.Push())
+
+	if parseErr != nil {
+		http.Error(w, fmt.Sprintf("invalid borg create output: %s", parseErr), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
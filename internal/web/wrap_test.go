@@ -0,0 +1,249 @@
+package web
+
+import (
+	"bytes"
+	"github.com/lefeverd/borg-exporter/internal/parser"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrapCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "flags added",
+			command: []string{"borg", "create", "/backups/laptop::{now}", "/home"},
+			want:    []string{"borg", "create", "--json", "--log-json", "--progress", "/backups/laptop::{now}", "/home"},
+		},
+		{
+			name:    "flags already given",
+			command: []string{"borg", "--log-json", "create", "--progress", "--json", "--stats", "/backups/laptop::{now}", "/home"},
+			want:    []string{"borg", "--log-json", "create", "--progress", "--json", "--stats", "/backups/laptop::{now}", "/home"},
+		},
+		{name: "not borg create", command: []string{"borg", "prune", "/backups/laptop"}, wantErr: true},
+		{name: "missing command", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := wrapCommand(tt.command)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCommandRepository(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		borgRepo string
+		want     string
+	}{
+		{name: "borg 1.x", args: []string{"create", "--json", "ssh://backup.example.com/./laptop::{hostname}-{now}", "/home"}, want: "ssh://backup.example.com/./laptop"},
+		{name: "borg 1.x with BORG_REPO", args: []string{"create", "::{hostname}-{now}", "/home"}, borgRepo: "/backups/laptop", want: "/backups/laptop"},
+		{name: "borg 2.x", args: []string{"create", "-r", "/backups/laptop", "laptop", "/home"}, want: "/backups/laptop"},
+		{name: "borg 2.x long option", args: []string{"create", "--repo=/backups/laptop", "laptop", "/home"}, want: "/backups/laptop"},
+		{name: "borg 2.x with BORG_REPO", args: []string{"create", "laptop", "/home"}, borgRepo: "/backups/laptop", want: "/backups/laptop"},
+		{name: "unknown", args: []string{"create", "laptop", "/home"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BORG_REPO", tt.borgRepo)
+			if got := commandRepository(tt.args); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStreamWrapStderr(t *testing.T) {
+	app := newApplication(io.Discard)
+	stdErr := `{"type": "progress_message", "operation": 1, "msgid": "cache.begin_transaction", "finished": false, "message": "Initializing cache transaction: Reading files", "time": 1730167200.1}
+{"type": "archive_progress", "original_size": 1048576, "compressed_size": 524288, "deduplicated_size": 4096, "nfiles": 12, "path": "home/user/notes.txt", "time": 1730167200.5, "finished": false}
+{"type": "log_message", "time": 1730167201.0, "message": "/home/user/missing: [Errno 2] No such file or directory", "levelname": "WARNING", "name": "borg.archiver"}
+{"type": "file_status", "status": "A", "path": "home/user/notes.txt"}
+{"type": "archive_progress", "time": 1730167202.0, "finished": true}
+Remote: Warning: Permanently added 'backup.example.com' to the list of known hosts.
+`
+	var stderr bytes.Buffer
+	tracker := &wrapProgressTracker{}
+
+	warnings := app.streamWrapStderr(strings.NewReader(stdErr), &stderr, tracker)
+
+	if warnings != 2 {
+		t.Errorf("Expected 2 warnings, got %d", warnings)
+	}
+	wantProgress := wrapProgress{OriginalSize: 1048576, CompressedSize: 524288, DeduplicatedSize: 4096, Files: 12}
+	if got := tracker.get(); got != wantProgress {
+		t.Errorf("Expected progress %+v, got %+v", wantProgress, got)
+	}
+	wantStderr := `/home/user/missing: [Errno 2] No such file or directory
+{"type": "file_status", "status": "A", "path": "home/user/notes.txt"}
+Remote: Warning: Permanently added 'backup.example.com' to the list of known hosts.
+`
+	if stderr.String() != wantStderr {
+		t.Errorf("Expected stderr %q, got %q", wantStderr, stderr.String())
+	}
+}
+
+func TestWrapHandlers(t *testing.T) {
+	app := newTestApplication(nil, "/backups/laptop")
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{name: "unknown repository", method: http.MethodPost, path: "/wrap/progress?repository=/backups/server", body: `{}`, wantStatus: http.StatusNotFound},
+		{name: "invalid report", method: http.MethodPost, path: "/wrap/progress?repository=/backups/laptop", body: `{"files": "12"}`, wantStatus: http.StatusBadRequest},
+		{name: "not a POST", method: http.MethodGet, path: "/wrap/progress?repository=/backups/laptop", wantStatus: http.StatusMethodNotAllowed},
+		{name: "invalid output", method: http.MethodPost, path: "/wrap/result?repository=/backups/laptop", body: `{"end": "2024-10-29T02:05:12Z", "exit_code": 0, "output": {"archive": []}}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := app.WrapProgressHandler
+			if strings.HasPrefix(tt.path, "/wrap/result") {
+				handler = app.WrapResultHandler
+			}
+			recorder := httptest.NewRecorder()
+			handler(recorder, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.wantStatus, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+
+	// The result with an invalid output is recorded, without archive
+	expected := `
+# HELP borg_backup_in_progress 1 if a backup run by the wrap command is in progress, 0 otherwise
+# TYPE borg_backup_in_progress gauge
+borg_backup_in_progress{repository="/backups/laptop"} 0
+# HELP borg_last_backup_exit_code Exit code of the last borg create run by the wrap command
+# TYPE borg_last_backup_exit_code gauge
+borg_last_backup_exit_code{repository="/backups/laptop"} 0
+`
+	err := testutil.CollectAndCompare(app.metricsCache, strings.NewReader(expected),
+		"borg_backup_in_progress", "borg_backup_progress_files", "borg_last_backup_exit_code", "borg_last_backup_timestamp")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWrapProgressHandler(t *testing.T) {
+	app := newTestApplication(nil, "/backups/laptop")
+	start := time.Now().Add(-90 * time.Second)
+	app.metricsCache.Metrics.Now = func() time.Time { return start.Add(90 * time.Second) }
+
+	body := `{"start": "` + start.Format(time.RFC3339Nano) + `", "original_size": 1048576, "compressed_size": 524288, "deduplicated_size": 4096, "files": 12}`
+	recorder := httptest.NewRecorder()
+	app.WrapProgressHandler(recorder, httptest.NewRequest(http.MethodPost, "/wrap/progress?repository=/backups/laptop", strings.NewReader(body)))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusNoContent, recorder.Code, recorder.Body.String())
+	}
+
+	expected := `
+# HELP borg_backup_in_progress 1 if a backup run by the wrap command is in progress, 0 otherwise
+# TYPE borg_backup_in_progress gauge
+borg_backup_in_progress{repository="/backups/laptop"} 1
+# HELP borg_backup_progress_deduplicated_size_bytes Deduplicated size of the data processed by the backup in progress in bytes
+# TYPE borg_backup_progress_deduplicated_size_bytes gauge
+borg_backup_progress_deduplicated_size_bytes{repository="/backups/laptop"} 4096
+# HELP borg_backup_progress_elapsed_seconds Time elapsed since the start of the backup in progress in seconds
+# TYPE borg_backup_progress_elapsed_seconds gauge
+borg_backup_progress_elapsed_seconds{repository="/backups/laptop"} 90
+# HELP borg_backup_progress_files Number of files processed by the backup in progress
+# TYPE borg_backup_progress_files gauge
+borg_backup_progress_files{repository="/backups/laptop"} 12
+`
+	err := testutil.CollectAndCompare(app.metricsCache, strings.NewReader(expected),
+		"borg_backup_in_progress", "borg_backup_progress_deduplicated_size_bytes", "borg_backup_progress_elapsed_seconds",
+		"borg_backup_progress_files", "borg_last_backup_exit_code")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	// The borg 1.x timestamps of the testdata are read in the local time
+	local := time.Local
+	time.Local = time.UTC
+	defer func() { time.Local = local }()
+
+	exporter := newTestApplication(nil, "/backups/laptop")
+	exporter.metricsCache.Lock()
+	exporter.metricsCache.Repository("/backups/laptop", nil).Info = &parser.InfoOutput{
+		Archives: []parser.InfoOutputArchive{{Name: "laptop-2024-10-28T02:00:00"}},
+	}
+	exporter.metricsCache.Unlock()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wrap/progress", exporter.WrapProgressHandler)
+	mux.HandleFunc("/wrap/result", exporter.WrapResultHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// A fake borg create, which ends with a warning
+	script := `printf '%s\n' '{"type": "archive_progress", "original_size": 1048576, "compressed_size": 524288, "deduplicated_size": 4096, "nfiles": 12, "path": "home/user/notes.txt", "time": 1730167200.5, "finished": false}' >&2
+printf '%s\n' '{"type": "log_message", "time": 1730167201.0, "message": "/home/user/missing: [Errno 2] No such file or directory", "levelname": "WARNING", "name": "borg.archiver"}' >&2
+printf '%s\n' '{"type": "archive_progress", "time": 1730167202.0, "finished": true}' >&2
+cat ../parser/testdata/borg-create.json
+exit 1`
+	var stdout, stderr bytes.Buffer
+	app := newApplication(io.Discard)
+	exitCode := app.Wrap(&stdout, &stderr, []string{
+		"-exporter-url", server.URL, "-progress-interval", "10ms",
+		"--", "sh", "-c", script, "borg", "create", "/backups/laptop::laptop-2024-10-29T02:00:00", "/home",
+	})
+
+	if exitCode != 1 {
+		t.Errorf("Expected the exit code of borg, got %d", exitCode)
+	}
+	if want := string(mustReadFile(t, "../parser/testdata/borg-create.json")); stdout.String() != want {
+		t.Errorf("Expected the output of borg on stdout, got %q", stdout.String())
+	}
+	if want := "/home/user/missing: [Errno 2] No such file or directory\n"; stderr.String() != want {
+		t.Errorf("Expected stderr %q, got %q", want, stderr.String())
+	}
+
+	expected := `
+# HELP borg_backup_in_progress 1 if a backup run by the wrap command is in progress, 0 otherwise
+# TYPE borg_backup_in_progress gauge
+borg_backup_in_progress{repository="/backups/laptop"} 0
+# HELP borg_last_backup_exit_code Exit code of the last borg create run by the wrap command
+# TYPE borg_last_backup_exit_code gauge
+borg_last_backup_exit_code{repository="/backups/laptop"} 1
+# HELP borg_last_backup_files Number of files in the last backup
+# TYPE borg_last_backup_files gauge
+borg_last_backup_files{repository="/backups/laptop"} 241876
+# HELP borg_last_backup_timestamp Timestamp of the last backup
+# TYPE borg_last_backup_timestamp gauge
+borg_last_backup_timestamp{repository="/backups/laptop"} 1.7301672e+09
+# HELP borg_last_backup_warnings Number of warnings logged by the last borg create run by the wrap command
+# TYPE borg_last_backup_warnings gauge
+borg_last_backup_warnings{repository="/backups/laptop"} 1
+# HELP borg_total_chunks Repository total chunks
+# TYPE borg_total_chunks gauge
+borg_total_chunks{repository="/backups/laptop"} 2.861034e+06
+`
+	err := testutil.CollectAndCompare(exporter.metricsCache, strings.NewReader(expected),
+		"borg_backup_in_progress", "borg_last_backup_exit_code", "borg_last_backup_files",
+		"borg_last_backup_timestamp", "borg_last_backup_warnings", "borg_total_chunks")
+	if err != nil {
+		t.Error(err)
+	}
+}